@@ -1,22 +1,119 @@
 package auth
 
 import (
-	"log"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func GenerateHashedPassword(password string) []byte {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+type Argon2Params struct {
+	// memory in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+const argon2SaltLength = 16
+const argon2KeyLength = 32
 
+// owasp's recommended baseline, overridden from the env at startup
+var argon2Params = Argon2Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+}
+
+func SetArgon2Params(params Argon2Params) error {
+	if params.Memory < 8*1024 || params.Time < 1 || params.Threads < 1 {
+		return fmt.Errorf("argon2 parameters too weak: memory must be at least 8192 KiB, time and threads at least 1")
+	}
+	argon2Params = params
+	return nil
+}
+
+// hashes are stored in the standard PHC string format so the parameters travel with the hash
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func GenerateHashedPassword(password string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return hashedPassword
+	key := argon2.IDKey([]byte(password), salt, argon2Params.Time, argon2Params.Memory, argon2Params.Threads, argon2KeyLength)
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		argon2Params.Memory,
+		argon2Params.Time,
+		argon2Params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
 }
 
-func CheckPasswordHash(password string, hash []byte) bool {
+// the second return value is true when the password matched but the stored hash should be replaced
+// either because it is an old bcrypt hash or because it was made with weaker argon2 parameters than the current ones
+func CheckPasswordHash(password string, hash []byte) (bool, bool) {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		return checkArgon2Hash(password, string(hash))
+	}
+
+	// anything else is a bcrypt hash from before argon2 was introduced
 	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
-	return err == nil
+	if err != nil {
+		return false, false
+	}
+
+	return true, true
+}
+
+func checkArgon2Hash(password string, encoded string) (bool, bool) {
+	// splitting on $ gives ["", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash]
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false
+	}
+
+	var params Argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return false, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+
+	storedKey, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(storedKey)))
+
+	// constant time compare so the check doesn't leak how many bytes matched
+	if subtle.ConstantTimeCompare(key, storedKey) != 1 {
+		return false, false
+	}
+
+	needsRehash := params != argon2Params || len(storedKey) != argon2KeyLength
+
+	return true, needsRehash
 }
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// local breached password list, see loadBreachedPasswords for the format
+	BreachedPasswordsFile string
+}
+
+// passphrases must fit so the max can't be configured below this
+const minimumMaxPasswordLength = 128
+
+var passwordPolicy = PasswordPolicy{
+	MinLength: 8,
+	MaxLength: minimumMaxPasswordLength,
+}
+
+// breached password hashes bucketed by the first 5 hex characters of their sha1
+// the same k-anonymity layout the pwned passwords range api uses, so a lookup only ever touches one small bucket
+var breachedPasswords map[string]map[string]struct{}
+
+func SetPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinLength < 1 {
+		return fmt.Errorf("password min length must be at least 1")
+	}
+
+	if policy.MaxLength < minimumMaxPasswordLength {
+		return fmt.Errorf("password max length must be at least %d", minimumMaxPasswordLength)
+	}
+
+	if policy.MinLength > policy.MaxLength {
+		return fmt.Errorf("password min length can't be greater than the max length")
+	}
+
+	if len(policy.BreachedPasswordsFile) > 0 {
+		list, err := loadBreachedPasswords(policy.BreachedPasswordsFile)
+		if err != nil {
+			return err
+		}
+		breachedPasswords = list
+	} else {
+		breachedPasswords = nil
+	}
+
+	passwordPolicy = policy
+	return nil
+}
+
+func PasswordMaxLength() int {
+	return passwordPolicy.MaxLength
+}
+
+// checks a new password against the policy
+// the returned error is safe to show to the user
+func ValidatePassword(password string) error {
+	// count characters rather than bytes so non ascii passphrases aren't penalised
+	length := utf8.RuneCountInString(password)
+
+	if length < passwordPolicy.MinLength || length > passwordPolicy.MaxLength {
+		return fmt.Errorf("Password length must be between %d and %d characters", passwordPolicy.MinLength, passwordPolicy.MaxLength)
+	}
+
+	if isBreachedPassword(password) {
+		return fmt.Errorf("This password has appeared in a known data breach. Please choose a different password")
+	}
+
+	return nil
+}
+
+func isBreachedPassword(password string) bool {
+	if breachedPasswords == nil {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	bucket, exists := breachedPasswords[hash[:5]]
+	if !exists {
+		return false
+	}
+
+	_, breached := bucket[hash[5:]]
+	return breached
+}
+
+// the file holds one upper or lower case sha1 hash per line, optionally followed by ":COUNT"
+// this is the format of the downloadable pwned passwords list, so a trimmed copy of it can be dropped in as is
+func loadBreachedPasswords(path string) (map[string]map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open breached passwords file: %s", err.Error())
+	}
+
+	defer file.Close()
+
+	list := make(map[string]map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		hash, _, _ := strings.Cut(line, ":")
+
+		// skip blank lines and anything that isn't a sha1
+		if len(hash) != sha1.Size*2 {
+			continue
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:5], hash[5:]
+
+		if list[prefix] == nil {
+			list[prefix] = make(map[string]struct{})
+		}
+		list[prefix][suffix] = struct{}{}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read breached passwords file: %s", err.Error())
+	}
+
+	return list, nil
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// settings read from the environment once at startup
+// anything that is optional falls back to a sensible default so a bare .env with just the database details still boots
+type Config struct {
+	PasswordMinLength int
+	PasswordMaxLength int
+	// path to a local copy of a breached password list in "SHA1:COUNT" format, empty disables the check
+	BreachedPasswordsFile string
+
+	// argon2id tuning, memory is in KiB
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+
+	// base url of the web client, used to build links in emails
+	AppURL string
+	// public base url of this api, lets digest emails offer one click unsubscribe, empty leaves it out
+	APIURL string
+
+	// "smtp" or "file"
+	MailDriver   string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+
+	// origins of the web client allowed to make credentialed cross origin requests and state changing requests
+	AllowedOrigins []string
+
+	// json file listing the sso identity providers, empty disables sso
+	OIDCProvidersFile string
+	// domain for the session cookie set after an sso login, empty means the api's own host
+	SessionCookieDomain string
+
+	// org limits for users without a plan, -1 means unlimited
+	OrgOwnedLimit      int
+	OrgMembershipLimit int
+	// json file of per plan org limits, empty means every user gets the defaults
+	PlansFile string
+
+	// read notifications older than this many days are pruned, 0 keeps them forever
+	NotificationRetentionDays int
+	// how often to check for daily and weekly notification digests that are due, 0 turns digest emails off
+	DigestIntervalMinutes int
+	// how often the webhook delivery queue is checked, 0 stops webhooks going out (they still queue up)
+	WebhookPollSeconds int
+	// lets webhooks be sent to loopback and private network addresses, for testing against a local receiver only
+	WebhookAllowPrivateAddresses bool
+}
+
+func Load() Config {
+	return Config{
+		PasswordMinLength:     envInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxLength:     envInt("PASSWORD_MAX_LENGTH", 128),
+		BreachedPasswordsFile: envString("BREACHED_PASSWORDS_FILE", ""),
+
+		Argon2Memory:  uint32(envInt("ARGON2_MEMORY_KIB", 64*1024)),
+		Argon2Time:    uint32(envInt("ARGON2_ITERATIONS", 3)),
+		Argon2Threads: uint8(envInt("ARGON2_THREADS", 2)),
+
+		AppURL: envString("APP_URL", "https://fmsatiya.live"),
+		APIURL: envString("API_URL", ""),
+
+		MailDriver:   envString("MAIL_DRIVER", "file"),
+		MailFrom:     envString("MAIL_FROM", "FMS <no-reply@fmsatiya.live>"),
+		MailDir:      envString("MAIL_DIR", "maildrop"),
+		SMTPHost:     envString("SMTP_HOST", ""),
+		SMTPPort:     envInt("SMTP_PORT", 587),
+		SMTPUsername: envString("SMTP_USERNAME", ""),
+		SMTPPassword: envString("SMTP_PASSWORD", ""),
+
+		AllowedOrigins: envList("ALLOWED_ORIGINS", []string{"http://localhost:5173", "https://fmsatiya.live"}),
+
+		OIDCProvidersFile:   envString("OIDC_PROVIDERS_FILE", ""),
+		SessionCookieDomain: envString("SESSION_COOKIE_DOMAIN", ""),
+
+		OrgOwnedLimit:      envInt("ORG_OWNED_LIMIT", 1),
+		OrgMembershipLimit: envInt("ORG_MEMBERSHIP_LIMIT", 3),
+		PlansFile:          envString("PLANS_FILE", ""),
+
+		NotificationRetentionDays: envInt("NOTIFICATION_RETENTION_DAYS", 90),
+		DigestIntervalMinutes:     envInt("DIGEST_INTERVAL_MINUTES", 60),
+		WebhookPollSeconds:        envInt("WEBHOOK_POLL_SECONDS", 10),
+
+		WebhookAllowPrivateAddresses: envBool("WEBHOOK_ALLOW_PRIVATE_ADDRESSES", false),
+	}
+}
+
+func envString(name string, fallback string) string {
+	value, exists := os.LookupEnv(name)
+	if !exists || len(value) == 0 {
+		return fallback
+	}
+	return value
+}
+
+// comma separated, blank entries are dropped
+func envList(name string, fallback []string) []string {
+	value, exists := os.LookupEnv(name)
+	if !exists || len(value) == 0 {
+		return fallback
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// a value that is set but not a number is a typo in the env file, better to stop than silently use the default
+func envInt(name string, fallback int) int {
+	value, exists := os.LookupEnv(name)
+	if !exists || len(value) == 0 {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("ENV Error: %s must be a number, got %q", name, value)
+	}
+
+	return parsed
+}
+
+// "true", "1" and the like, anything unparseable stops startup the same way a bad number does
+func envBool(name string, fallback bool) bool {
+	value, exists := os.LookupEnv(name)
+	if !exists || len(value) == 0 {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("ENV Error: %s must be true or false, got %q", name, value)
+	}
+
+	return parsed
+}
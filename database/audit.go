@@ -0,0 +1,355 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the prev_hash of the first event in every org
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// two changes to the same org at once both try to take the next seq, the loser reads the chain again and retries
+const auditInsertAttempts = 5
+
+var errAuditContention = errors.New("could not append to the audit log, too many concurrent writes")
+
+// who made a change and where the request came from
+// built by the handlers for every request that changes an org, empty user id for changes nobody signed in made, like a file request upload
+type AuditActor struct {
+	UserID    string
+	IP        string
+	UserAgent string
+}
+
+// one change as the org's owner sees it
+// before and after are whatever the change touched, null when there was nothing before or nothing is left after
+type AuditEvent struct {
+	Seq           int64           `json:"seq"`
+	ActorID       string          `json:"actorId"`
+	ActorUsername string          `json:"actorUsername"`
+	Action        string          `json:"action"`
+	TargetType    string          `json:"targetType"`
+	TargetID      string          `json:"targetId"`
+	IP            string          `json:"ip"`
+	UserAgent     string          `json:"userAgent"`
+	Before        json.RawMessage `json:"before"`
+	After         json.RawMessage `json:"after"`
+	CreatedAt     int64           `json:"createdAt"`
+	PrevHash      string          `json:"prevHash"`
+	Hash          string          `json:"hash"`
+}
+
+// narrows down the log, every field is optional
+type AuditFilter struct {
+	Action     string
+	ActorID    string
+	TargetType string
+	TargetID   string
+	// unix times, inclusive
+	Since int64
+	Until int64
+	// the seq of the last event on the previous page, 0 for the first page
+	Before int64
+	// 0 for every matching event
+	Limit int
+}
+
+// the outcome of walking an org's chain from the first event
+type AuditVerification struct {
+	Valid  bool  `json:"valid"`
+	Events int64 `json:"events"`
+	// the first event whose hash or link to the one before doesn't match, nil when the whole chain checks out
+	BrokenAt *int64 `json:"brokenAt"`
+}
+
+// what a mutation hands to recordAudit
+// action is the target type and what happened to it, like "folder.deleted" or "folder.acl_set"
+type auditEntry struct {
+	OrgID      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Before     any
+	After      any
+}
+
+// appends the change to the org's log once it has gone through
+// the change itself already happened, so a failure here is only logged like a notification that couldn't go out
+func recordAudit(actor AuditActor, entry auditEntry) {
+	err := appendAuditEvent(actor, entry)
+	if err != nil {
+		log.Printf("error: could not record audit event %s for org %s: %v", entry.Action, entry.OrgID, err.Error())
+	}
+}
+
+func appendAuditEvent(actor AuditActor, entry auditEntry) error {
+	orgId, err := strconv.ParseInt(entry.OrgID, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	before, err := auditValue(entry.Before)
+	if err != nil {
+		return err
+	}
+
+	after, err := auditValue(entry.After)
+	if err != nil {
+		return err
+	}
+
+	event := AuditEvent{
+		ActorID:    actor.UserID,
+		Action:     entry.Action,
+		TargetType: entry.TargetType,
+		TargetID:   entry.TargetID,
+		IP:         actor.IP,
+		UserAgent:  actor.UserAgent,
+		CreatedAt:  time.Now().Unix(),
+	}
+
+	if len(actor.UserID) > 0 {
+		event.ActorUsername, err = GetUsernameById(actor.UserID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	for attempt := 0; attempt < auditInsertAttempts; attempt++ {
+		err := dbClient.QueryRow("SELECT seq, hash FROM audit_event WHERE org_id = ? ORDER BY seq DESC LIMIT 1", orgId).Scan(&event.Seq, &event.PrevHash)
+		if err == sql.ErrNoRows {
+			event.Seq, event.PrevHash = 0, auditGenesisHash
+		} else if err != nil {
+			return err
+		}
+
+		event.Seq++
+		event.Hash = auditHash(orgId, event, before, after)
+
+		_, err = dbClient.Exec(`
+			INSERT INTO audit_event
+			(org_id, seq, actor_id, actor_username, action, target_type, target_id, ip, user_agent, before, after, created_at, prev_hash, hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			orgId, event.Seq, nullIfEmpty(event.ActorID), nullIfEmpty(event.ActorUsername), event.Action, event.TargetType, nullIfEmpty(event.TargetID),
+			nullIfEmpty(event.IP), nullIfEmpty(event.UserAgent), nullIfEmpty(before), nullIfEmpty(after), event.CreatedAt, event.PrevHash, event.Hash,
+		)
+		if err == nil {
+			return nil
+		}
+
+		if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return err
+		}
+	}
+
+	return errAuditContention
+}
+
+// before and after are stored as json, nil stays empty and is stored as null
+func auditValue(value any) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// hex sha256 of the previous event's hash followed by a json array of
+// [org_id, seq, actor_id, actor_username, action, target_type, target_id, ip, user_agent, before, after, created_at]
+// where missing values are empty strings and before and after are the stored json text, so an export can be checked without this server
+// the array is compact json without html escaping, the way most other languages write it
+func auditHash(orgId int64, event AuditEvent, before string, after string) string {
+	var fields bytes.Buffer
+
+	encoder := json.NewEncoder(&fields)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode([]any{
+		orgId, event.Seq, event.ActorID, event.ActorUsername, event.Action, event.TargetType, event.TargetID,
+		event.IP, event.UserAgent, before, after, event.CreatedAt,
+	})
+
+	// Encode ends with a newline that isn't part of the json
+	sum := sha256.Sum256(append([]byte(event.PrevHash), bytes.TrimSuffix(fields.Bytes(), []byte("\n"))...))
+	return hex.EncodeToString(sum[:])
+}
+
+// newest first when paging, the next cursor is nil on the last page
+func GetAuditEvents(orgId string, filter AuditFilter) ([]AuditEvent, *int64, error) {
+	events, err := queryAuditEvents(orgId, filter, "DESC")
+	if err != nil {
+		return events, nil, err
+	}
+
+	if filter.Limit == 0 || len(events) <= filter.Limit {
+		return events, nil, nil
+	}
+
+	events = events[:filter.Limit]
+	next := events[len(events)-1].Seq
+
+	return events, &next, nil
+}
+
+// every matching event oldest first, the order the chain is checked in
+func ExportAuditEvents(orgId string, filter AuditFilter) ([]AuditEvent, error) {
+	filter.Before = 0
+	filter.Limit = 0
+	return queryAuditEvents(orgId, filter, "ASC")
+}
+
+func queryAuditEvents(orgId string, filter AuditFilter, order string) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+
+	where := "org_id = ?"
+	args := []any{orgId}
+
+	if len(filter.Action) > 0 {
+		where += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+
+	if len(filter.ActorID) > 0 {
+		where += " AND actor_id = ?"
+		args = append(args, filter.ActorID)
+	}
+
+	if len(filter.TargetType) > 0 {
+		where += " AND target_type = ?"
+		args = append(args, filter.TargetType)
+	}
+
+	if len(filter.TargetID) > 0 {
+		where += " AND target_id = ?"
+		args = append(args, filter.TargetID)
+	}
+
+	if filter.Since > 0 {
+		where += " AND created_at >= ?"
+		args = append(args, filter.Since)
+	}
+
+	if filter.Until > 0 {
+		where += " AND created_at <= ?"
+		args = append(args, filter.Until)
+	}
+
+	if filter.Before > 0 {
+		where += " AND seq < ?"
+		args = append(args, filter.Before)
+	}
+
+	limit := ""
+	if filter.Limit > 0 {
+		// one extra row tells us whether there is another page
+		limit = " LIMIT ?"
+		args = append(args, filter.Limit+1)
+	}
+
+	rows, err := dbClient.Query(`
+		SELECT seq, COALESCE(actor_id, ''), COALESCE(actor_username, ''), action, target_type, COALESCE(target_id, ''),
+		COALESCE(ip, ''), COALESCE(user_agent, ''), before, after, created_at, prev_hash, hash
+		FROM audit_event
+		WHERE `+where+`
+		ORDER BY seq `+order+limit, args...)
+	if err != nil {
+		return events, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		event, _, _, err := scanAuditEvent(rows)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// also returns before and after as stored, empty for null, which is what the hash was taken over
+func scanAuditEvent(rows *sql.Rows) (AuditEvent, string, string, error) {
+	var event AuditEvent
+	var before, after sql.NullString
+
+	err := rows.Scan(
+		&event.Seq, &event.ActorID, &event.ActorUsername, &event.Action, &event.TargetType, &event.TargetID,
+		&event.IP, &event.UserAgent, &before, &after, &event.CreatedAt, &event.PrevHash, &event.Hash,
+	)
+	if err != nil {
+		return event, "", "", err
+	}
+
+	event.Before = json.RawMessage("null")
+	if before.Valid {
+		event.Before = json.RawMessage(before.String)
+	}
+
+	event.After = json.RawMessage("null")
+	if after.Valid {
+		event.After = json.RawMessage(after.String)
+	}
+
+	return event, before.String, after.String, nil
+}
+
+// walks the org's chain from the first event, recomputing every hash and checking each one links to the one before
+// the triggers stop the log being changed through the app, this catches it being changed any other way
+func VerifyAuditChain(orgId string) (AuditVerification, error) {
+	verification := AuditVerification{Valid: true}
+
+	id, err := strconv.ParseInt(orgId, 10, 64)
+	if err != nil {
+		return verification, err
+	}
+
+	rows, err := dbClient.Query(`
+		SELECT seq, COALESCE(actor_id, ''), COALESCE(actor_username, ''), action, target_type, COALESCE(target_id, ''),
+		COALESCE(ip, ''), COALESCE(user_agent, ''), before, after, created_at, prev_hash, hash
+		FROM audit_event
+		WHERE org_id = ?
+		ORDER BY seq ASC
+	`, id)
+	if err != nil {
+		return verification, err
+	}
+
+	defer rows.Close()
+
+	prevHash := auditGenesisHash
+
+	for rows.Next() {
+		event, before, after, err := scanAuditEvent(rows)
+		if err != nil {
+			return verification, err
+		}
+
+		verification.Events++
+
+		if event.Seq != verification.Events || event.PrevHash != prevHash || auditHash(id, event, before, after) != event.Hash {
+			seq := event.Seq
+			verification.Valid = false
+			verification.BrokenAt = &seq
+			return verification, nil
+		}
+
+		prevHash = event.Hash
+	}
+
+	return verification, rows.Err()
+}
@@ -2,15 +2,21 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fms/auth"
+	"fms/ioOperations"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-// takes in username and password, attempts to create user, returns user id or error
-func CreateUser(username string, password string) (string, error) {
+var ErrEmailTaken = errors.New("this email address is already in use")
+
+// takes in username, password and an optional email, attempts to create user, returns user id or error
+func CreateUser(username string, password string, email string) (string, error) {
 
 	usernameExists, err := UsernameExists(username)
 
@@ -22,10 +28,14 @@ func CreateUser(username string, password string) (string, error) {
 		return "", fmt.Errorf("username taken")
 	}
 
-	hashedPassword := auth.GenerateHashedPassword(password)
+	hashedPassword, err := auth.GenerateHashedPassword(password)
+	if err != nil {
+		return "", err
+	}
+
 	userId := uuid.New().String()
 
-	statement, err := dbClient.Prepare("INSERT INTO user (id, username, password) VALUES (?, ?, ?)")
+	statement, err := dbClient.Prepare("INSERT INTO user (id, username, password, email) VALUES (?, ?, ?, ?)")
 
 	if err != nil {
 		return "", err
@@ -33,9 +43,12 @@ func CreateUser(username string, password string) (string, error) {
 
 	defer statement.Close()
 
-	_, err = statement.Exec(userId, username, hashedPassword)
+	_, err = statement.Exec(userId, username, hashedPassword, nullableString(email))
 
 	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return "", ErrEmailTaken
+		}
 		return "", err
 	}
 
@@ -90,7 +103,7 @@ func UsernameExists(username string) (bool, error) {
 }
 
 func UserExists(username string, password string) (string, error) {
-	statement, err := dbClient.Prepare("SELECT * FROM user WHERE username = ?")
+	statement, err := dbClient.Prepare("SELECT id, username, password FROM user WHERE username = ?")
 	if err != nil {
 		return "", err
 	}
@@ -106,13 +119,23 @@ func UserExists(username string, password string) (string, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("invalid username")
+			return "", ErrInvalidCredentials
 		}
 		return "", err
 	}
 
-	if !auth.CheckPasswordHash(password, user.password) {
-		return "", fmt.Errorf("incorrect password")
+	matches, needsRehash := auth.CheckPasswordHash(password, user.password)
+	if !matches {
+		return "", ErrInvalidCredentials
+	}
+
+	// this is the only time the plain password is available, so old bcrypt hashes and hashes made with weaker params get upgraded here
+	// a failed upgrade shouldn't fail the login, the next successful login will try again
+	if needsRehash {
+		err = ChangePassword(user.id, password)
+		if err != nil {
+			log.Printf("error: could not upgrade password hash for user %v: %v", user.id, err.Error())
+		}
 	}
 
 	return user.id, nil
@@ -143,7 +166,7 @@ func GetUserWithSession(sessionId string) UserWithSession {
 	var userWithSession UserWithSession
 
 	statement, err := dbClient.Prepare(`
-		SELECT user.id, user.username, user_session.id, user_session.expires_at 
+		SELECT user.id, user.username, COALESCE(user.email, ''), user.email_verified_at IS NOT NULL, user_session.id, user_session.expires_at
 		FROM user_session 
 		LEFT JOIN user ON user_session.user_id = user.id 
 		WHERE user_session.id = ?
@@ -155,7 +178,7 @@ func GetUserWithSession(sessionId string) UserWithSession {
 
 	defer statement.Close()
 
-	err = statement.QueryRow(sessionId).Scan(&userWithSession.User.ID, &userWithSession.User.Username, &userWithSession.Session.ID, &userWithSession.Session.ExpiresAt)
+	err = statement.QueryRow(sessionId).Scan(&userWithSession.User.ID, &userWithSession.User.Username, &userWithSession.User.Email, &userWithSession.User.EmailVerified, &userWithSession.Session.ID, &userWithSession.Session.ExpiresAt)
 
 	if err != nil {
 		return UserWithSession{}
@@ -183,14 +206,14 @@ func InvalidateSession(sessionId string) {
 func GetUsernameById(id string) (string, error) {
 	var username string
 
-	statement, err := dbClient.Prepare("SELECT username FROM user WHERE username =  LIMIT 1)")
+	statement, err := dbClient.Prepare("SELECT username FROM user WHERE id = ? LIMIT 1")
 	if err != nil {
 		return username, err
 	}
 
 	defer statement.Close()
 
-	err = statement.QueryRow(username).Scan(&username)
+	err = statement.QueryRow(id).Scan(&username)
 
 	if err != nil {
 		return username, err
@@ -207,7 +230,10 @@ func ChangePassword(userId string, password string) error {
 
 	defer statement.Close()
 
-	hashedPassword := auth.GenerateHashedPassword(password)
+	hashedPassword, err := auth.GenerateHashedPassword(password)
+	if err != nil {
+		return err
+	}
 
 	result, err := statement.Exec(hashedPassword, userId)
 
@@ -256,15 +282,109 @@ func ChangeUsername(userId string, username string) error {
 	return nil
 }
 
-func DeleteAccount(userId string) error {
-	statement, err := dbClient.Prepare("DELETE FROM user WHERE id = ?")
+// deleting a user cascades to the orgs they created, so those are handed to a co-owner first
+// an org where the user is the only owner and other people are still members blocks the deletion
+// every org the user was in gets an entry in its log, the user is gone afterwards so it is read first
+func DeleteAccount(userId string, actor AuditActor) error {
+	blockingOrgs, err := GetOwnedOrgsWithMembers(userId)
 	if err != nil {
 		return err
 	}
 
-	defer statement.Close()
+	if len(blockingOrgs) > 0 {
+		return ErrOwnsOrgWithMembers
+	}
 
-	result, err := statement.Exec(userId)
+	username, err := GetUsernameById(userId)
+	if err != nil {
+		return err
+	}
+
+	memberships, err := dbClient.Query("SELECT org_id, role FROM org_members WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	roles := map[string]string{}
+
+	for memberships.Next() {
+		var orgId, role string
+		err := memberships.Scan(&orgId, &role)
+		if err != nil {
+			memberships.Close()
+			return err
+		}
+		roles[orgId] = role
+	}
+
+	memberships.Close()
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM organisation WHERE creator_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	var createdOrgs []string
+
+	for rows.Next() {
+		var orgId string
+		err := rows.Scan(&orgId)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		createdOrgs = append(createdOrgs, orgId)
+	}
+
+	rows.Close()
+
+	for _, orgId := range createdOrgs {
+		err = handOverCreator(tx, orgId, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// uploads belong to the org more than to the person, the uploader_id cascade would drop the rows and leave the files on disk
+	// so in every org that outlives the account they move to its creator, the audit log still says who uploaded them
+	_, err = tx.Exec(`
+		UPDATE folder SET uploader_id = (SELECT creator_id FROM organisation WHERE organisation.id = folder.org_id)
+		WHERE uploader_id = ? AND org_id IN (SELECT id FROM organisation WHERE creator_id != ?)
+	`, userId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE file SET uploader_id = (SELECT creator_id FROM organisation WHERE organisation.id = file.org_id)
+		WHERE uploader_id = ? AND org_id IN (SELECT id FROM organisation WHERE creator_id != ?)
+	`, userId, userId)
+	if err != nil {
+		return err
+	}
+
+	// orgs nobody could be handed go with the account, their directories are removed once it is gone
+	var removedOrgs []string
+
+	for _, orgId := range createdOrgs {
+		var creatorId string
+		err = tx.QueryRow("SELECT creator_id FROM organisation WHERE id = ?", orgId).Scan(&creatorId)
+		if err != nil {
+			return err
+		}
+		if creatorId == userId {
+			removedOrgs = append(removedOrgs, orgId)
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM user WHERE id = ?", userId)
 
 	if err != nil {
 		return err
@@ -280,5 +400,135 @@ func DeleteAccount(userId string) error {
 		return fmt.Errorf("could not delete account. please try again later or contact support")
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, orgId := range removedOrgs {
+		err = ioOperations.DeleteOrgDir(orgId)
+		if err != nil {
+			log.Printf("error: could not remove the directory of org %v: %v", orgId, err.Error())
+		}
+	}
+
+	for orgId, role := range roles {
+		recordAudit(actor, auditEntry{
+			OrgID:      orgId,
+			Action:     "member.account_deleted",
+			TargetType: "member",
+			TargetID:   userId,
+			Before:     map[string]any{"username": username, "role": role},
+		})
+	}
+
+	return nil
+}
+
+// sets a new email address on the account, it stays unverified until the user follows the link sent to it
+func SetUserEmail(userId string, email string) error {
+	statement, err := dbClient.Prepare("UPDATE user SET email = ?, email_verified_at = NULL WHERE id = ?")
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	result, err := statement.Exec(email, userId)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrEmailTaken
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("could not update email. please try again later or contact support")
+	}
+
 	return nil
 }
+
+// the email is part of the where clause so a verification link for an address the user has since replaced does nothing
+func MarkEmailVerified(userId string, email string) error {
+	statement, err := dbClient.Prepare("UPDATE user SET email_verified_at = ? WHERE id = ? AND email = ? COLLATE NOCASE")
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	result, err := statement.Exec(time.Now().Unix(), userId, email)
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// finds the account a password reset is for by username or email
+// only accounts with a verified email are returned, there is nowhere safe to send the link otherwise
+func GetUserForRecovery(identifier string) (User, error) {
+	var user User
+
+	statement, err := dbClient.Prepare(`
+		SELECT id, username, email
+		FROM user
+		WHERE (username = ? OR email = ? COLLATE NOCASE) AND email IS NOT NULL AND email_verified_at IS NOT NULL
+		LIMIT 1
+	`)
+	if err != nil {
+		return user, err
+	}
+
+	defer statement.Close()
+
+	err = statement.QueryRow(identifier, identifier).Scan(&user.ID, &user.Username, &user.Email)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.EmailVerified = true
+
+	return user, nil
+}
+
+// logs the user out everywhere, used after a password reset so whoever knew the old password loses access
+func InvalidateUserSessions(userId string) error {
+	statement, err := dbClient.Prepare("DELETE FROM user_session WHERE user_id = ?")
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	_, err = statement.Exec(userId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// optional text columns are stored as NULL rather than an empty string so unique indexes ignore them
+func nullableString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: len(value) > 0}
+}
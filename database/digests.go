@@ -0,0 +1,268 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+	DigestOff    = "off"
+
+	TokenPurposeUnsubscribeDigest = "unsubscribe_digest"
+)
+
+// unsubscribe links keep working for a while after the email, and more than once, so an old digest can still be used to opt out
+const unsubscribeTokenTTL = 90 * 24 * time.Hour
+
+// unread notifications older than this never go out in a digest, so the first one after turning digests on isn't the whole backlog
+const digestLookback = 7 * 24 * time.Hour
+
+// someone with unread notifications whose digest is due
+type DigestRecipient struct {
+	UserID    string
+	Username  string
+	Email     string
+	Frequency string
+}
+
+type DigestNotification struct {
+	ID            int64
+	OrgName       string
+	NotifType     string
+	ActorUsername string
+	Message       string
+	PayloadName   string
+	CreatedAt     string
+}
+
+func IsDigestFrequency(frequency string) bool {
+	return frequency == DigestDaily || frequency == DigestWeekly || frequency == DigestOff
+}
+
+// users with a verified email who have something new to read and haven't had a digest within their frequency
+// something new is a notification they sent to email, or anything unread once they have opted in
+func GetDueDigestRecipients(now time.Time) ([]DigestRecipient, error) {
+	recipients := []DigestRecipient{}
+
+	rows, err := dbClient.Query(`
+		SELECT u.id, u.username, u.email, u.digest_frequency
+		FROM user u
+		WHERE u.email IS NOT NULL AND u.email_verified_at IS NOT NULL
+		AND (
+			(u.digest_frequency = 'daily' AND u.digest_sent_at <= ?)
+			OR (u.digest_frequency = 'weekly' AND u.digest_sent_at <= ?)
+		)
+		AND EXISTS (
+			SELECT 1 FROM notification n
+			WHERE n.user_id = u.id AND n.digested_at IS NULL AND n.is_read = 0 AND n.created_at >= ?
+			AND (n.delivery = 'email_digest' OR u.digest_opted_in = 1)
+		)
+	`, now.Add(-24*time.Hour).Unix(), now.Add(-7*24*time.Hour).Unix(), now.Add(-digestLookback).UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return recipients, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipient DigestRecipient
+		err := rows.Scan(&recipient.UserID, &recipient.Username, &recipient.Email, &recipient.Frequency)
+		if err != nil {
+			return recipients, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, rows.Err()
+}
+
+// everything unread that hasn't been in a digest yet, sorted so it can be grouped by org and type as it is read
+// notifications that aren't about an org come first with an empty org name
+// access can change between the notification and the digest, so anything about a folder the user can no longer view is left out
+func GetPendingDigestNotifications(userId string, now time.Time) ([]DigestNotification, error) {
+	notifications := []DigestNotification{}
+
+	type folderRef struct {
+		orgId    string
+		folderId string
+	}
+	var folders []folderRef
+
+	rows, err := dbClient.Query(`
+		SELECT n.id, COALESCE(o.name, ''), n.type, u.username, n.message, n.payload_name, n.created_at,
+		COALESCE(n.org_id, ''), COALESCE(json_extract(n.payload, '$.parent_folder_id'), '')
+		FROM notification n
+		JOIN user u ON u.id = n.actor_id
+		LEFT JOIN organisation o ON o.id = n.org_id
+		JOIN user r ON r.id = n.user_id
+		WHERE n.user_id = ? AND n.digested_at IS NULL AND n.is_read = 0 AND n.created_at >= ?
+		AND (n.delivery = 'email_digest' OR r.digest_opted_in = 1)
+		ORDER BY COALESCE(o.name, ''), n.type, n.id DESC
+	`, userId, now.Add(-digestLookback).UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return notifications, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var notif DigestNotification
+		var folder folderRef
+		err := rows.Scan(&notif.ID, &notif.OrgName, &notif.NotifType, &notif.ActorUsername, &notif.Message, &notif.PayloadName, &notif.CreatedAt, &folder.orgId, &folder.folderId)
+		if err != nil {
+			return notifications, err
+		}
+		notifications = append(notifications, notif)
+		folders = append(folders, folder)
+	}
+
+	if err = rows.Err(); err != nil {
+		return notifications, err
+	}
+
+	rows.Close()
+
+	// one load per org the digest touches, nil once the user has left it
+	access := map[string]*FolderAccess{}
+	visible := []DigestNotification{}
+
+	for i, notif := range notifications {
+		folder := folders[i]
+		if len(folder.orgId) == 0 || len(folder.folderId) == 0 {
+			visible = append(visible, notif)
+			continue
+		}
+
+		orgAccess, loaded := access[folder.orgId]
+		if !loaded {
+			orgAccess, err = LoadMemberFolderAccess(userId, folder.orgId)
+			if err != nil && err != ErrNotOrgMember {
+				return visible, err
+			}
+			access[folder.orgId] = orgAccess
+		}
+
+		if orgAccess != nil && orgAccess.Allows(folder.folderId, FolderPermissionView) {
+			visible = append(visible, notif)
+		}
+	}
+
+	return visible, nil
+}
+
+// the notifications in the digest won't go out again
+// ones that only went out by email count as read once sent, so they are pruned like anything read in the app
+func MarkDigestSent(userId string, notificationIds []int64, sentAt time.Time) error {
+	ids, err := json.Marshal(notificationIds)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user SET digest_sent_at = ? WHERE id = ?", sentAt.Unix(), userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE notification SET digested_at = ?, is_read = CASE WHEN delivery = 'email_digest' THEN 1 ELSE is_read END
+		WHERE user_id = ? AND id IN (SELECT value FROM json_each(?))
+	`, sentAt.Unix(), userId, string(ids))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// optedIn is false until the user picks a frequency, until then only the types they send to email go in a digest
+func GetDigestFrequency(userId string) (string, bool, error) {
+	var frequency string
+	var optedIn bool
+	err := dbClient.QueryRow("SELECT digest_frequency, digest_opted_in FROM user WHERE id = ?", userId).Scan(&frequency, &optedIn)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, ErrUserNotFound
+		}
+		return "", false, err
+	}
+
+	return frequency, optedIn, nil
+}
+
+// turning digests off moves anything waiting for the next digest into the app so it isn't lost
+// picking daily or weekly is the user opting in to everything unread, not just the types they send to email
+func SetDigestFrequency(userId string, frequency string) error {
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user SET digest_frequency = ?, digest_opted_in = ? WHERE id = ?", frequency, frequency != DigestOff, userId)
+	if err != nil {
+		return err
+	}
+
+	if frequency == DigestOff {
+		_, err = tx.Exec("UPDATE notification SET delivery = 'in_app' WHERE user_id = ? AND delivery = 'email_digest' AND digested_at IS NULL", userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// a new token for every digest, unlike CreateUserToken older ones aren't removed so every digest's link keeps working
+func CreateUnsubscribeToken(userId string, email string) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	_, err = dbClient.Exec(
+		"INSERT INTO user_token (id, user_id, purpose, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		HashToken(token), userId, TokenPurposeUnsubscribeDigest, email, now.Unix(), now.Add(unsubscribeTokenTTL).Unix(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// the token isn't used up, clicking the link twice or a mail client following it first does no harm
+func UnsubscribeFromDigest(token string) error {
+	var userId string
+	err := dbClient.QueryRow(
+		"SELECT user_id FROM user_token WHERE id = ? AND purpose = ? AND expires_at > ?",
+		HashToken(token), TokenPurposeUnsubscribeDigest, time.Now().Unix(),
+	).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	return SetDigestFrequency(userId, DigestOff)
+}
+
+// a digest goes out every day for some users, so the tokens are cleared out once they stop working
+func PruneUnsubscribeTokens(now time.Time) error {
+	_, err := dbClient.Exec("DELETE FROM user_token WHERE purpose = ? AND expires_at <= ?", TokenPurposeUnsubscribeDigest, now.Unix())
+	return err
+}
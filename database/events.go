@@ -0,0 +1,296 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+)
+
+var ErrUnknownEvent = errors.New("unknown event")
+
+// what happened, the name clients and webhooks key off instead of the notification's free text type
+const (
+	EventFileUploaded              = "file.uploaded"
+	EventFileDeleted               = "file.deleted"
+	EventFolderCreated             = "folder.created"
+	EventFolderDeleted             = "folder.deleted"
+	EventFileRequestUploaded       = "file_request.uploaded"
+	EventMemberInvited             = "member.invited"
+	EventMemberJoined              = "member.joined"
+	EventInviteDeclined            = "invite.declined"
+	EventMemberLeft                = "member.left"
+	EventOrgRenamed                = "org.renamed"
+	EventOwnershipTransferred      = "org.ownership_transferred"
+	EventJoinRequestCreated        = "join_request.created"
+	EventJoinRequestApproved       = "join_request.approved"
+	EventInviteReceived            = "invite.received"
+	EventJoinRequestDenied         = "join_request.denied"
+	EventOwnershipTransferSent     = "ownership_transfer.requested"
+	EventOwnershipTransferDeclined = "ownership_transfer.declined"
+	EventShareReceived             = "share.received"
+	EventAccountLocked             = "account.locked"
+)
+
+const (
+	// the org's members hear about it, subject to their preferences, and so do its webhooks
+	EventScopeOrg = "org"
+	// sent to one user about something that concerns only them
+	EventScopeUser = "user"
+)
+
+// one folder on the way down from the root of the org
+type PathEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// every field an event can carry, each type in the catalogue lists the ones it fills in and only those are stored
+// org_name, parent_folder_id and parent_path are filled in from the notification where the type has them
+type EventPayload struct {
+	OrgID          string      `json:"org_id"`
+	OrgName        string      `json:"org_name"`
+	FileID         string      `json:"file_id"`
+	FileName       string      `json:"file_name"`
+	FolderID       string      `json:"folder_id"`
+	FolderName     string      `json:"folder_name"`
+	ParentFolderID string      `json:"parent_folder_id"`
+	ParentPath     []PathEntry `json:"parent_path"`
+	UserID         string      `json:"user_id"`
+	Username       string      `json:"username"`
+	Role           string      `json:"role"`
+	RequestID      string      `json:"request_id"`
+	FileRequestID  string      `json:"file_request_id"`
+	UploaderName   string      `json:"uploader_name"`
+	ResourceType   string      `json:"resource_type"`
+	ResourceID     string      `json:"resource_id"`
+	ResourceName   string      `json:"resource_name"`
+	LockedUntil    int64       `json:"locked_until"`
+}
+
+// one field of an event's payload as described to clients
+type EventField struct {
+	// "string", "integer" or "path", a path being a list of {id, name} folders from the root down
+	Type string `json:"type"`
+	// empty values are sent as null
+	Nullable    bool   `json:"nullable"`
+	Description string `json:"description"`
+}
+
+var eventFields = map[string]EventField{
+	"org_id":           {Type: "string", Description: "The org the event happened in"},
+	"org_name":         {Type: "string", Description: "The org's name at the time of the event"},
+	"file_id":          {Type: "string", Description: "The file the event is about"},
+	"file_name":        {Type: "string", Description: "The file's name"},
+	"folder_id":        {Type: "string", Description: "The folder the event is about"},
+	"folder_name":      {Type: "string", Description: "The folder's name"},
+	"parent_folder_id": {Type: "string", Nullable: true, Description: "The folder the file or folder is in, null at the root of the org"},
+	"parent_path":      {Type: "path", Description: "The folder the file or folder is in and every folder above it, from the root of the org down, empty at the root"},
+	"user_id":          {Type: "string", Description: "The user the event is about, who isn't always the actor"},
+	"username":         {Type: "string", Description: "That user's username"},
+	"role":             {Type: "string", Description: "The role the user joins as"},
+	"request_id":       {Type: "string", Description: "The join request"},
+	"file_request_id":  {Type: "string", Description: "The file request the file was sent through"},
+	"uploader_name":    {Type: "string", Nullable: true, Description: "The name the uploader gave, null when they didn't give one"},
+	"resource_type":    {Type: "string", Description: "file or folder"},
+	"resource_id":      {Type: "string", Description: "The file or folder that was shared"},
+	"resource_name":    {Type: "string", Description: "Its name"},
+	"locked_until":     {Type: "integer", Description: "Unix time the account unlocks at"},
+}
+
+// one type of event in the catalogue
+type EventType struct {
+	Name string `json:"name"`
+	// the notification type it is stored with, which is also what notification preferences are set for
+	NotificationType string   `json:"notificationType"`
+	Scope            string   `json:"scope"`
+	Description      string   `json:"description"`
+	Fields           []string `json:"fields"`
+	// what goes in the notification's payload_id and payload_name, kept for clients that still read those
+	legacy func(p EventPayload) (string, string)
+}
+
+func fileSubject(p EventPayload) (string, string)   { return p.FileID, p.FileName }
+func folderSubject(p EventPayload) (string, string) { return p.FolderID, p.FolderName }
+func userSubject(p EventPayload) (string, string)   { return p.UserID, p.Username }
+func orgSubject(p EventPayload) (string, string)    { return p.OrgID, p.OrgName }
+
+var fileFields = []string{"org_id", "org_name", "file_id", "file_name", "parent_folder_id", "parent_path"}
+var folderFields = []string{"org_id", "org_name", "folder_id", "folder_name", "parent_folder_id", "parent_path"}
+var memberFields = []string{"org_id", "org_name", "user_id", "username"}
+var orgFields = []string{"org_id", "org_name"}
+
+var EventCatalogue = []EventType{
+	{Name: EventFileUploaded, NotificationType: "file upload", Scope: EventScopeOrg, Description: "A file was uploaded", Fields: fileFields, legacy: fileSubject},
+	{Name: EventFileDeleted, NotificationType: "file delete", Scope: EventScopeOrg, Description: "A file was deleted", Fields: fileFields, legacy: fileSubject},
+	{Name: EventFolderCreated, NotificationType: "folder upload", Scope: EventScopeOrg, Description: "A folder was created", Fields: folderFields, legacy: folderSubject},
+	{Name: EventFolderDeleted, NotificationType: "folder delete", Scope: EventScopeOrg, Description: "A folder and everything in it was deleted", Fields: folderFields, legacy: folderSubject},
+	{Name: EventFileRequestUploaded, NotificationType: "file request upload", Scope: EventScopeOrg, Description: "Someone outside the org sent a file through a file request", Fields: append(slices.Clone(fileFields), "file_request_id", "uploader_name"), legacy: fileSubject},
+	{Name: EventMemberInvited, NotificationType: "invite", Scope: EventScopeOrg, Description: "A user was invited to the org", Fields: append(slices.Clone(memberFields), "role"), legacy: userSubject},
+	{Name: EventMemberJoined, NotificationType: "join org", Scope: EventScopeOrg, Description: "A user joined the org", Fields: memberFields, legacy: userSubject},
+	{Name: EventInviteDeclined, NotificationType: "decline invite", Scope: EventScopeOrg, Description: "A user declined their invite to the org", Fields: memberFields, legacy: userSubject},
+	{Name: EventMemberLeft, NotificationType: "leave org", Scope: EventScopeOrg, Description: "A member left the org", Fields: memberFields, legacy: userSubject},
+	{Name: EventOrgRenamed, NotificationType: "org name", Scope: EventScopeOrg, Description: "The org was renamed, org_name is the new name", Fields: orgFields, legacy: orgSubject},
+	{Name: EventOwnershipTransferred, NotificationType: "ownership transfer", Scope: EventScopeOrg, Description: "The org has a new owner", Fields: memberFields, legacy: orgSubject},
+	{Name: EventJoinRequestCreated, NotificationType: "join request", Scope: EventScopeOrg, Description: "A user asked to join the org, only members who can approve it hear about it", Fields: append(slices.Clone(memberFields), "request_id"), legacy: func(p EventPayload) (string, string) { return p.OrgID, p.Username }},
+	{Name: EventJoinRequestApproved, NotificationType: "join request approved", Scope: EventScopeOrg, Description: "The user's request to join the org was approved", Fields: append(slices.Clone(orgFields), "request_id"), legacy: orgSubject},
+	{Name: EventInviteReceived, NotificationType: "invite", Scope: EventScopeUser, Description: "The user was invited to an org", Fields: orgFields, legacy: orgSubject},
+	{Name: EventJoinRequestDenied, NotificationType: "join request denied", Scope: EventScopeUser, Description: "The user's request to join an org was declined", Fields: orgFields, legacy: orgSubject},
+	{Name: EventOwnershipTransferSent, NotificationType: "ownership transfer", Scope: EventScopeUser, Description: "The owner of an org wants to make the user its owner", Fields: orgFields, legacy: orgSubject},
+	{Name: EventOwnershipTransferDeclined, NotificationType: "ownership transfer declined", Scope: EventScopeUser, Description: "The member the user offered their org to declined it", Fields: orgFields, legacy: orgSubject},
+	{Name: EventShareReceived, NotificationType: "share", Scope: EventScopeUser, Description: "A file or folder was shared with the user", Fields: []string{"org_id", "org_name", "resource_type", "resource_id", "resource_name"}, legacy: func(p EventPayload) (string, string) { return p.ResourceID, p.ResourceName }},
+	{Name: EventAccountLocked, NotificationType: "account locked", Scope: EventScopeUser, Description: "Too many failed sign in attempts locked the user's account", Fields: []string{"locked_until"}, legacy: func(p EventPayload) (string, string) {
+		return p.UserID, time.Unix(p.LockedUntil, 0).UTC().Format(time.RFC3339)
+	}},
+}
+
+// the notification types an org sends out to its members, the ones a preference can be set for
+// notifications sent straight to one user, like an invite or a share, always come through
+var NotificationTypes = orgNotificationTypes()
+
+func orgNotificationTypes() []string {
+	types := []string{}
+	for _, eventType := range EventCatalogue {
+		if eventType.Scope == EventScopeOrg && !slices.Contains(types, eventType.NotificationType) {
+			types = append(types, eventType.NotificationType)
+		}
+	}
+	return types
+}
+
+func GetEventType(name string) (*EventType, error) {
+	for i := range EventCatalogue {
+		if EventCatalogue[i].Name == name {
+			return &EventCatalogue[i], nil
+		}
+	}
+
+	return nil, ErrUnknownEvent
+}
+
+// a json schema for the payload of every event type, keyed by event name
+func EventSchemas() map[string]any {
+	schemas := map[string]any{}
+
+	for _, eventType := range EventCatalogue {
+		properties := map[string]any{}
+		for _, name := range eventType.Fields {
+			properties[name] = fieldSchema(eventFields[name])
+		}
+
+		schemas[eventType.Name] = map[string]any{
+			"$schema":              "https://json-schema.org/draft/2020-12/schema",
+			"title":                eventType.Name,
+			"description":          eventType.Description,
+			"type":                 "object",
+			"properties":           properties,
+			"required":             eventType.Fields,
+			"additionalProperties": false,
+		}
+	}
+
+	return schemas
+}
+
+func fieldSchema(field EventField) map[string]any {
+	var schema map[string]any
+
+	switch field.Type {
+	case "integer":
+		schema = map[string]any{"type": "integer"}
+	case "path":
+		schema = map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"id":   map[string]any{"type": "string"},
+					"name": map[string]any{"type": "string"},
+				},
+				"required": []string{"id", "name"},
+			},
+		}
+	default:
+		schema = map[string]any{"type": "string"}
+	}
+
+	if field.Nullable {
+		schema["type"] = []string{schema["type"].(string), "null"}
+	}
+
+	schema["description"] = field.Description
+
+	return schema
+}
+
+// the payload with only the fields the event type lists, so what is stored always matches its schema
+func encodeEventPayload(eventType *EventType, payload EventPayload) (string, error) {
+	if payload.ParentPath == nil {
+		payload.ParentPath = []PathEntry{}
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var all map[string]any
+	err = json.Unmarshal(raw, &all)
+	if err != nil {
+		return "", err
+	}
+
+	fields := map[string]any{}
+	for _, name := range eventType.Fields {
+		value := all[name]
+		if eventFields[name].Nullable && value == "" {
+			value = nil
+		}
+		fields[name] = value
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// the folder and every folder above it, root first, empty for the root of the org
+func getFolderPathEntries(folderId string) ([]PathEntry, error) {
+	path := []PathEntry{}
+
+	if len(folderId) == 0 {
+		return path, nil
+	}
+
+	rows, err := dbClient.Query(`
+		WITH RECURSIVE folder_path(id, name, parent_id, depth) AS (
+			SELECT id, name, parent_folder_id, 0 FROM folder WHERE id = ?
+			UNION ALL
+			SELECT folder.id, folder.name, folder.parent_folder_id, folder_path.depth + 1
+			FROM folder JOIN folder_path ON folder.id = folder_path.parent_id
+		)
+		SELECT id, name FROM folder_path ORDER BY depth DESC
+	`, folderId)
+	if err != nil {
+		return path, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var entry PathEntry
+		err := rows.Scan(&id, &entry.Name)
+		if err != nil {
+			return path, err
+		}
+		entry.ID = strconv.FormatInt(id, 10)
+		path = append(path, entry)
+	}
+
+	return path, rows.Err()
+}
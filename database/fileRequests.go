@@ -0,0 +1,405 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many "name (n).ext" variations an upload tries before giving up on finding a free name
+const maxFileRequestNameAttempts = 100
+
+var (
+	ErrFileRequestNotFound = errors.New("file request not found")
+	ErrFileRequestFull     = errors.New("this file request isn't accepting any more uploads")
+)
+
+// a file request as the org sees it
+type FileRequestLink struct {
+	ID              int64    `json:"id"`
+	FolderID        int64    `json:"folderId"`
+	FolderName      string   `json:"folderName"`
+	CreatedBy       string   `json:"createdBy"`
+	Message         string   `json:"message"`
+	MaxFileSize     int64    `json:"maxFileSize"`
+	AllowedTypes    []string `json:"allowedTypes"`
+	MaxUploads      *int64   `json:"maxUploads"`
+	UploadCount     int64    `json:"uploadCount"`
+	RequireUploader bool     `json:"requireUploader"`
+	ExpiresAt       *int64   `json:"expiresAt"`
+	CreatedAt       int64    `json:"createdAt"`
+}
+
+// what the public routes need to take an upload, only returned for links that are still live
+type FileRequestAccess struct {
+	ID              int64
+	OrgID           string
+	FolderID        string
+	FolderName      string
+	CreatedBy       string
+	Message         string
+	MaxFileSize     int64
+	AllowedTypes    []string
+	MaxUploads      *int64
+	UploadCount     int64
+	RequireUploader bool
+	ExpiresAt       *int64
+}
+
+// one file that came in through a file request, with whatever the uploader said about themselves
+type FileRequestUpload struct {
+	ID            int64  `json:"id"`
+	FileID        int64  `json:"fileId"`
+	FileName      string `json:"fileName"`
+	UploaderName  string `json:"uploaderName"`
+	UploaderEmail string `json:"uploaderEmail"`
+	CreatedAt     int64  `json:"createdAt"`
+}
+
+// allowedTypes are lowercase extensions with the dot, empty for every type uploads accept
+// ttl and maxUploads of 0 mean no limit
+func CreateFileRequestLink(orgId string, createdBy string, folderId string, message string, maxFileSize int64, allowedTypes []string, maxUploads int64, requireUploader bool, ttl time.Duration, actor AuditActor) (string, int64, error) {
+	inOrg, err := ResourceInOrg(&Resource{Type: ResourceFolder, ID: folderId}, orgId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !inOrg {
+		return "", 0, ErrFolderNotFound
+	}
+
+	now := time.Now()
+
+	token, err := GenerateToken()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var expiresAt, limit any
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+	if maxUploads > 0 {
+		limit = maxUploads
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO file_request_link (token_hash, org_id, folder_id, created_by, message, max_file_size, allowed_types, max_uploads, require_uploader, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, HashToken(token), orgId, folderId, createdBy, message, maxFileSize, nullIfEmpty(strings.Join(allowedTypes, ",")), limit, requireUploader, expiresAt, now.Unix())
+	if err != nil {
+		return "", 0, err
+	}
+
+	linkId, err := result.LastInsertId()
+	if err != nil {
+		return "", 0, err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "file_request.created",
+		TargetType: "file_request",
+		TargetID:   strconv.FormatInt(linkId, 10),
+		After: map[string]any{
+			"folderId": folderId, "message": message, "maxFileSize": maxFileSize, "allowedTypes": allowedTypes,
+			"maxUploads": limit, "requireUploader": requireUploader, "expiresAt": expiresAt,
+		},
+	})
+
+	return token, linkId, nil
+}
+
+// every live file request in the org, or only the ones one member made when createdBy is set
+func GetFileRequestLinks(orgId string, createdBy string) ([]FileRequestLink, error) {
+	links := []FileRequestLink{}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			r.id,
+			r.folder_id,
+			COALESCE(folder.name, ''),
+			COALESCE(user.username, ''),
+			r.message,
+			r.max_file_size,
+			COALESCE(r.allowed_types, ''),
+			r.max_uploads,
+			r.upload_count,
+			r.require_uploader,
+			r.expires_at,
+			r.created_at
+		FROM file_request_link r
+		LEFT JOIN folder ON folder.id = r.folder_id
+		LEFT JOIN user ON user.id = r.created_by
+		WHERE r.org_id = ? AND r.revoked_at IS NULL AND (? = '' OR r.created_by = ?)
+		ORDER BY r.created_at DESC
+	`, orgId, createdBy, createdBy)
+	if err != nil {
+		return links, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var link FileRequestLink
+		var allowedTypes string
+		var maxUploads, expiresAt sql.NullInt64
+		err := rows.Scan(
+			&link.ID,
+			&link.FolderID,
+			&link.FolderName,
+			&link.CreatedBy,
+			&link.Message,
+			&link.MaxFileSize,
+			&allowedTypes,
+			&maxUploads,
+			&link.UploadCount,
+			&link.RequireUploader,
+			&expiresAt,
+			&link.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		link.AllowedTypes = splitList(allowedTypes)
+		link.MaxUploads = nullableInt(maxUploads)
+		link.ExpiresAt = nullableInt(expiresAt)
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// createdBy limits the revoke to the member's own file requests, empty for members who can manage every one
+func RevokeFileRequestLink(orgId string, linkId string, createdBy string, actor AuditActor) error {
+	result, err := dbClient.Exec(`
+		UPDATE file_request_link SET revoked_at = ?
+		WHERE id = ? AND org_id = ? AND revoked_at IS NULL AND (? = '' OR created_by = ?)
+	`, time.Now().Unix(), linkId, orgId, createdBy, createdBy)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFileRequestNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "file_request.revoked",
+		TargetType: "file_request",
+		TargetID:   linkId,
+	})
+
+	return nil
+}
+
+// the uploads of one file request, newest first, uploads whose file has since been deleted go with it
+func GetFileRequestUploads(orgId string, linkId string, createdBy string) ([]FileRequestUpload, error) {
+	uploads := []FileRequestUpload{}
+
+	var exists bool
+	err := dbClient.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM file_request_link WHERE id = ? AND org_id = ? AND (? = '' OR created_by = ?))",
+		linkId, orgId, createdBy, createdBy,
+	).Scan(&exists)
+	if err != nil {
+		return uploads, err
+	}
+
+	if !exists {
+		return uploads, ErrFileRequestNotFound
+	}
+
+	rows, err := dbClient.Query(`
+		SELECT u.id, u.file_id, file.name, COALESCE(u.uploader_name, ''), COALESCE(u.uploader_email, ''), u.created_at
+		FROM file_request_upload u
+		JOIN file ON file.id = u.file_id
+		WHERE u.link_id = ?
+		ORDER BY u.created_at DESC
+	`, linkId)
+	if err != nil {
+		return uploads, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var upload FileRequestUpload
+		err := rows.Scan(&upload.ID, &upload.FileID, &upload.FileName, &upload.UploaderName, &upload.UploaderEmail, &upload.CreatedAt)
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// ErrInvalidToken for links that are unknown, revoked or expired
+// full links are still returned so the uploader can be told, UploadToFileRequest enforces the limit
+func GetFileRequestLinkByToken(token string) (*FileRequestAccess, error) {
+	var link FileRequestAccess
+	var allowedTypes string
+	var maxUploads, expiresAt sql.NullInt64
+
+	err := dbClient.QueryRow(`
+		SELECT
+			r.id,
+			r.org_id,
+			r.folder_id,
+			folder.name,
+			r.created_by,
+			r.message,
+			r.max_file_size,
+			COALESCE(r.allowed_types, ''),
+			r.max_uploads,
+			r.upload_count,
+			r.require_uploader,
+			r.expires_at
+		FROM file_request_link r
+		JOIN folder ON folder.id = r.folder_id
+		WHERE r.token_hash = ? AND r.revoked_at IS NULL AND (r.expires_at IS NULL OR r.expires_at > ?)
+	`, HashToken(token), time.Now().Unix()).Scan(
+		&link.ID,
+		&link.OrgID,
+		&link.FolderID,
+		&link.FolderName,
+		&link.CreatedBy,
+		&link.Message,
+		&link.MaxFileSize,
+		&allowedTypes,
+		&maxUploads,
+		&link.UploadCount,
+		&link.RequireUploader,
+		&expiresAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	link.AllowedTypes = splitList(allowedTypes)
+	link.MaxUploads = nullableInt(maxUploads)
+	link.ExpiresAt = nullableInt(expiresAt)
+
+	return &link, nil
+}
+
+// the file is credited to the member who made the link, the uploader's name and email are kept next to it
+// the slot is taken before the file is written so parallel uploads can't go over the limit, and handed back if the upload fails
+// the actor has no user id, whoever has the link is uploading
+func UploadToFileRequest(link *FileRequestAccess, file *multipart.FileHeader, uploaderName string, uploaderEmail string, actor AuditActor) error {
+	result, err := dbClient.Exec(`
+		UPDATE file_request_link SET upload_count = upload_count + 1
+		WHERE id = ? AND revoked_at IS NULL AND (max_uploads IS NULL OR upload_count < max_uploads)
+	`, link.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFileRequestFull
+	}
+
+	fileId, name, err := saveFileRequestUpload(link, file)
+	if err != nil {
+		_, releaseErr := dbClient.Exec("UPDATE file_request_link SET upload_count = upload_count - 1 WHERE id = ? AND upload_count > 0", link.ID)
+		if releaseErr != nil {
+			log.Printf("error: could not release file request upload slot: %v", releaseErr.Error())
+		}
+		return err
+	}
+
+	// the file is stored at this point, losing the uploader details or the notification isn't worth failing the upload over
+	_, err = dbClient.Exec(
+		"INSERT INTO file_request_upload (link_id, file_id, uploader_name, uploader_email, created_at) VALUES (?, ?, ?, ?, ?)",
+		link.ID, fileId, nullIfEmpty(uploaderName), nullIfEmpty(uploaderEmail), time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("error: could not record file request upload: %v", err.Error())
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      link.OrgID,
+		Action:     "file_request.uploaded",
+		TargetType: ResourceFile,
+		TargetID:   fileId,
+		After: map[string]any{
+			"name": name, "size": file.Size, "folderId": link.FolderID,
+			"fileRequestId": link.ID, "uploaderName": uploaderName, "uploaderEmail": uploaderEmail,
+		},
+	})
+
+	message := "Someone sent a file through a file request to " + link.FolderName
+	if len(uploaderName) > 0 {
+		message = fmt.Sprintf("%s sent a file through a file request to %s", uploaderName, link.FolderName)
+	}
+
+	// nobody in the org did this themselves, so the member the file is credited to hears about it too
+	err = NotifyOrg(Notify{
+		OrgID:        link.OrgID,
+		ActorID:      link.CreatedBy,
+		IncludeActor: true,
+		Event:        EventFileRequestUploaded,
+		Message:      message,
+		Payload: EventPayload{
+			FileID:        fileId,
+			FileName:      name,
+			FileRequestID: strconv.FormatInt(link.ID, 10),
+			UploaderName:  uploaderName,
+		},
+		FolderID: link.FolderID,
+	})
+	if err != nil {
+		log.Printf("error: could not send out notification to file request upload: %v", err.Error())
+	}
+
+	return nil
+}
+
+// saved into the folder the link was made for by id, never by name, another folder could share the name
+// the uploader can't see the folder, so a name that is already taken gets a number added rather than telling them it is there
+func saveFileRequestUpload(link *FileRequestAccess, file *multipart.FileHeader) (string, string, error) {
+	ext := filepath.Ext(file.Filename)
+	base := strings.TrimSuffix(file.Filename, ext)
+
+	name := file.Filename
+	for attempt := 1; attempt <= maxFileRequestNameAttempts; attempt++ {
+		fileId, _, err := saveFileToFolderId(file, name, link.OrgID, link.FolderID, link.CreatedBy)
+		if err != errFileNameTaken {
+			return fileId, name, err
+		}
+
+		name = fmt.Sprintf("%s (%d)%s", base, attempt, ext)
+	}
+
+	return "", "", errFileNameTaken
+}
+
+// comma separated columns like allowed_types, empty for an empty list
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(list, ",")
+}
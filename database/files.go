@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fms/ioOperations"
 	"fmt"
 	"log"
@@ -11,7 +12,11 @@ import (
 	"strings"
 )
 
-func UploadFileToRoot(file *multipart.FileHeader, orgId string, uploaderId string) error {
+// the handlers look for "exists" in the message to answer with a conflict
+var errFileNameTaken = errors.New("file name already exists in this location")
+
+// notifyGroupId sends the upload notification to one group instead of the whole org, empty for everyone
+func UploadFileToRoot(file *multipart.FileHeader, orgId string, uploaderId string, notifyGroupId string, actor AuditActor) error {
 	fileExists, err := FileExists(file.Filename, nil, nil)
 	if err != nil {
 		return err
@@ -65,8 +70,26 @@ func UploadFileToRoot(file *multipart.FileHeader, orgId string, uploaderId strin
 	}
 
 	tx.Commit()
-	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, uploaderId, "file upload", "Uploaded a file to", payloadID, file.Filename)
+
+	publishFolderChange(orgId, "", "file.added", payloadID, file.Filename)
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "file.uploaded",
+		TargetType: ResourceFile,
+		TargetID:   payloadID,
+		After:      map[string]any{"name": file.Filename, "size": file.Size, "folderId": nil},
+	})
+
+	// send notification to all org members, or just the group the uploader picked
+	err = NotifyOrg(Notify{
+		OrgID:   orgId,
+		GroupID: notifyGroupId,
+		ActorID: uploaderId,
+		Event:   EventFileUploaded,
+		Message: "Uploaded a file to",
+		Payload: EventPayload{FileID: payloadID, FileName: file.Filename},
+	})
 	if err != nil {
 		log.Printf("error: could not send out notification to file upload: %v", err.Error())
 	}
@@ -75,55 +98,111 @@ func UploadFileToRoot(file *multipart.FileHeader, orgId string, uploaderId strin
 
 }
 
-func UploadFileToFolder(file *multipart.FileHeader, orgId string, parentFolderName string, uploaderId string) error {
-	fileExists, err := FileExists(file.Filename, &parentFolderName, &orgId)
+func UploadFileToFolder(file *multipart.FileHeader, orgId string, parentFolderName string, uploaderId string, notifyGroupId string, actor AuditActor) error {
+	payloadID, folderId, err := saveFileToFolder(file, orgId, parentFolderName, uploaderId)
 	if err != nil {
 		return err
 	}
-	if fileExists {
-		return fmt.Errorf("file name already exists in this location")
+
+	fileUploaded(file, orgId, payloadID, folderId, uploaderId, notifyGroupId, actor)
+
+	return nil
+}
+
+// for callers that already know which folder they mean, such as an upload through an edit grant
+func UploadFileToFolderId(file *multipart.FileHeader, orgId string, folderId string, uploaderId string, notifyGroupId string, actor AuditActor) error {
+	payloadID, _, err := saveFileToFolderId(file, file.Filename, orgId, folderId, uploaderId)
+	if err != nil {
+		return err
+	}
+
+	fileUploaded(file, orgId, payloadID, folderId, uploaderId, notifyGroupId, actor)
+
+	return nil
+}
+
+// the audit entry and notification for a file that has been saved into a folder
+func fileUploaded(file *multipart.FileHeader, orgId string, fileId string, folderId string, uploaderId string, notifyGroupId string, actor AuditActor) {
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "file.uploaded",
+		TargetType: ResourceFile,
+		TargetID:   fileId,
+		After:      map[string]any{"name": file.Filename, "size": file.Size, "folderId": folderId},
+	})
+
+	// send notification to all org members, or just the group the uploader picked
+	err := NotifyOrg(Notify{
+		OrgID:    orgId,
+		GroupID:  notifyGroupId,
+		ActorID:  uploaderId,
+		Event:    EventFileUploaded,
+		Message:  "Uploaded a file to",
+		Payload:  EventPayload{FileID: fileId, FileName: file.Filename},
+		FolderID: folderId,
+	})
+	if err != nil {
+		log.Printf("error: could not send out notification to file upload: %v", err.Error())
 	}
+}
 
+// stores the file in the folder and returns its id and the folder's, the caller decides who gets told about it
+func saveFileToFolder(file *multipart.FileHeader, orgId string, parentFolderName string, uploaderId string) (string, string, error) {
 	//  get the folder ID so we can find its path
 	var folderId string
-	err = dbClient.QueryRow("SELECT id FROM folder WHERE name = ? AND org_id = ?", parentFolderName, orgId).Scan(&folderId)
+	err := dbClient.QueryRow("SELECT id FROM folder WHERE name = ? AND org_id = ?", parentFolderName, orgId).Scan(&folderId)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("folder not found")
+			return "", "", fmt.Errorf("folder not found")
 		}
-		return err
+		return "", "", err
+	}
+
+	return saveFileToFolderId(file, file.Filename, orgId, folderId, uploaderId)
+}
+
+// folder names are only unique under their parent, so anything that already knows which folder it means saves by id
+// name is what the file is listed as, the upload's own name unless the caller had to pick another
+func saveFileToFolderId(file *multipart.FileHeader, name string, orgId string, folderId string, uploaderId string) (string, string, error) {
+	var taken bool
+	err := dbClient.QueryRow("SELECT EXISTS(SELECT 1 FROM file WHERE name = ? AND folder_id = ? AND org_id = ?)", name, folderId, orgId).Scan(&taken)
+	if err != nil {
+		return "", "", err
+	}
+	if taken {
+		return "", "", errFileNameTaken
 	}
 
 	// get the folder path
 	folderPath, err := getFolderPath(folderId)
 	if err != nil {
-		return fmt.Errorf("error getting folder path: %w", err)
+		return "", "", fmt.Errorf("error getting folder path: %w", err)
 	}
 
 	tx, err := dbClient.Begin()
 
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	defer tx.Rollback()
 	statement, err := tx.Prepare(`
 	 	INSERT INTO file (org_id, uploader_id, name, type, size, folder_id)
-		VALUES (?, ?, ?, ?, ?, (SELECT id FROM folder WHERE name = ? AND org_id = ?))
+		VALUES (?, ?, ?, ?, ?, ?)
 	 `)
 
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
 	defer statement.Close()
 
-	res, err := statement.Exec(orgId, uploaderId, file.Filename, filepath.Ext(file.Filename), file.Size, parentFolderName, orgId)
+	res, err := statement.Exec(orgId, uploaderId, name, filepath.Ext(name), file.Size, folderId)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return fmt.Errorf("file name already exists in this location")
+			return "", "", errFileNameTaken
 		} else {
-			return err
+			return "", "", err
 		}
 	}
 
@@ -141,17 +220,17 @@ func UploadFileToFolder(file *multipart.FileHeader, orgId string, parentFolderNa
 	err = ioOperations.CreateOrgFileAsChild(file, payloadID, folderPath)
 	if err != nil {
 		log.Printf("ERROR CREATING FILE ID %s, error: %s", payloadID, err.Error())
-		return err
+		return "", "", err
 	}
 
-	tx.Commit()
-	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, uploaderId, "file upload", "Uploaded a file to", payloadID, file.Filename)
+	err = tx.Commit()
 	if err != nil {
-		log.Printf("error: could not send out notification to file upload: %v", err.Error())
+		return "", "", err
 	}
 
-	return nil
+	publishFolderChange(orgId, folderId, "file.added", payloadID, name)
+
+	return payloadID, folderId, nil
 }
 
 func GetRootFilesOfOrg(orgId string) []FileData {
@@ -198,13 +277,23 @@ func GetRootFilesOfOrg(orgId string) []FileData {
 
 }
 
+// the first folder in the org with the name, callers that know which folder they mean use GetFolderFilesById
 func GetFolderFiles(folderName string, orgId string) []FileData {
+	folderId, err := GetFolderIdByName(folderName, orgId)
+	if err != nil {
+		return nil
+	}
+
+	return GetFolderFilesById(folderId, orgId)
+}
+
+func GetFolderFilesById(folderId string, orgId string) []FileData {
 	var files []FileData
 	statement, err := dbClient.Prepare(`
 		SELECT file.id, file.folder_id, file.org_id, user.username, file.name, file.type, file.size, file.uploaded_at  
 		FROM file 
 		LEFT JOIN user ON user.id = file.uploader_id
-		WHERE org_id = ? AND folder_id = (SELECT id FROM folder WHERE name = ? AND org_id = ?)
+		WHERE org_id = ? AND folder_id = ?
 		ORDER BY uploaded_at DESC`)
 	if err != nil {
 		fmt.Print(err.Error())
@@ -213,7 +302,7 @@ func GetFolderFiles(folderName string, orgId string) []FileData {
 
 	defer statement.Close()
 
-	rows, err := statement.Query(orgId, folderName, orgId)
+	rows, err := statement.Query(orgId, folderId)
 
 	if err != nil {
 		fmt.Print(err.Error())
@@ -280,12 +369,18 @@ func FileExists(fileName string, folderName *string, orgId *string) (bool, error
 	}
 }
 
-func DeleteFile(fileId string, orgId string, userId string, fileName string) error {
+func DeleteFile(fileId string, orgId string, userId string, fileName string, actor AuditActor) error {
 	path, err := GetFilePath(fileId)
 	if err != nil {
 		fmt.Println(err)
 	}
 
+	// read before the row goes so connected clients can be told which folder lost it
+	folderId, err := GetFileFolderId(fileId)
+	if err != nil {
+		log.Printf("error: could not read folder of file %v: %v", fileId, err.Error())
+	}
+
 	statement, err := dbClient.Prepare("DELETE FROM file WHERE id = ?")
 	if err != nil {
 		return err
@@ -310,8 +405,25 @@ func DeleteFile(fileId string, orgId string, userId string, fileName string) err
 		fmt.Printf("ERROR REMOVING FILE WITH ID: %v\n", fileId)
 	}
 
+	publishFolderChange(orgId, folderId, "file.deleted", fileId, fileName)
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "file.deleted",
+		TargetType: ResourceFile,
+		TargetID:   fileId,
+		Before:     map[string]any{"name": fileName, "folderId": nullIfEmpty(folderId)},
+	})
+
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "file delete", "Delete a file from", fileId, fileName)
+	err = NotifyOrg(Notify{
+		OrgID:    orgId,
+		ActorID:  userId,
+		Event:    EventFileDeleted,
+		Message:  "Delete a file from",
+		Payload:  EventPayload{FileID: fileId, FileName: fileName},
+		FolderID: folderId,
+	})
 	if err != nil {
 		log.Printf("error: could not send out notification to file delete: %v", err.Error())
 	}
@@ -353,3 +465,46 @@ func GetFilePath(fileId string) (string, error) {
 	// return the full path
 	return filepath.Join(parentPath, fmt.Sprintf("file-%s", fileId)), nil
 }
+
+func GetFileById(fileId string, orgId string) (*FileData, error) {
+	var file FileData
+
+	err := dbClient.QueryRow(`
+		SELECT file.id, file.folder_id, file.org_id, COALESCE(user.username, ''), file.name, file.type, file.size, file.uploaded_at
+		FROM file
+		LEFT JOIN user ON user.id = file.uploader_id
+		WHERE file.id = ? AND file.org_id = ?
+	`, fileId, orgId).Scan(
+		&file.Id,
+		&file.ParentFolderId,
+		&file.OrgId,
+		&file.Uploader,
+		&file.Name,
+		&file.Type,
+		&file.Size,
+		&file.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("file not found")
+		}
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// the folder a file sits in, empty for files at the root of the org
+func GetFileFolderId(fileId string) (string, error) {
+	var folderId sql.NullString
+
+	err := dbClient.QueryRow("SELECT folder_id FROM file WHERE id = ?", fileId).Scan(&folderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("file not found")
+		}
+		return "", err
+	}
+
+	return folderId.String, nil
+}
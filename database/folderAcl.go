@@ -0,0 +1,459 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+const (
+	FolderPermissionView = "view"
+	FolderPermissionEdit = "edit"
+)
+
+const (
+	ACLEffectAllow = "allow"
+	ACLEffectDeny  = "deny"
+)
+
+const (
+	ACLPrincipalUser  = "user"
+	ACLPrincipalGroup = "group"
+)
+
+var (
+	ErrFolderNotFound    = errors.New("folder not found")
+	ErrPrincipalNotFound = errors.New("no member or group with this name in the organisation")
+	ErrACLEntryNotFound  = errors.New("access entry not found")
+)
+
+type aclRule struct {
+	permission string
+	effect     string
+}
+
+type folderNode struct {
+	parentId   int64
+	restricted bool
+}
+
+// a user's view of every folder in one org, loaded once per request and then checked in memory
+// the whole tree is loaded so inheritance can be resolved without a query per level
+type FolderAccess struct {
+	// set for members who can manage folders, they see and edit everything
+	unrestricted bool
+	folders      map[int64]folderNode
+	rules        map[int64][]aclRule
+}
+
+// for callers that already know the user can see past the access lists
+func UnrestrictedFolderAccess() *FolderAccess {
+	return &FolderAccess{unrestricted: true}
+}
+
+func LoadFolderAccess(userId string, orgId string) (*FolderAccess, error) {
+	access := &FolderAccess{
+		folders: map[int64]folderNode{},
+		rules:   map[int64][]aclRule{},
+	}
+
+	rows, err := dbClient.Query("SELECT id, COALESCE(parent_folder_id, 0), restricted FROM folder WHERE org_id = ?", orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var node folderNode
+		err := rows.Scan(&id, &node.parentId, &node.restricted)
+		if err != nil {
+			return nil, err
+		}
+		access.folders[id] = node
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// entries for the user and for every group they are in count the same, so a group deny still beats a personal allow on the same folder
+	ruleRows, err := dbClient.Query(`
+		SELECT a.folder_id, a.permission, a.effect
+		FROM folder_acl a
+		JOIN folder f ON f.id = a.folder_id
+		WHERE f.org_id = ? AND (
+			(a.principal_type = 'user' AND a.principal_id = ?)
+			OR (a.principal_type = 'group' AND a.principal_id IN (
+				SELECT CAST(gm.group_id AS TEXT) FROM org_group_member gm
+				JOIN org_group g ON g.id = gm.group_id
+				WHERE g.org_id = ? AND gm.user_id = ?
+			))
+		)
+	`, orgId, userId, orgId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ruleRows.Close()
+
+	for ruleRows.Next() {
+		var folderId int64
+		var rule aclRule
+		err := ruleRows.Scan(&folderId, &rule.permission, &rule.effect)
+		if err != nil {
+			return nil, err
+		}
+		access.rules[folderId] = append(access.rules[folderId], rule)
+	}
+
+	return access, ruleRows.Err()
+}
+
+// folder access for a member who isn't the one making the request, such as the member who made a share link
+// ErrNotOrgMember once they have left the org
+func LoadMemberFolderAccess(userId string, orgId string) (*FolderAccess, error) {
+	access, err := GetOrgAccess(userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	if access == nil {
+		return nil, ErrNotOrgMember
+	}
+
+	if access.Has(CapFolderManage) {
+		return UnrestrictedFolderAccess(), nil
+	}
+
+	return LoadFolderAccess(userId, orgId)
+}
+
+// walks from the folder up to the root, the closest folder with a matching entry decides
+// deny beats allow on the same folder, and a restricted folder with no decision on it or below it stops the walk with a deny
+// with no entries anywhere the org's capabilities apply as they always have
+// an empty folder id is the org's root which has no access list
+func (a *FolderAccess) Allows(folderId string, permission string) bool {
+	if a.unrestricted || len(folderId) == 0 {
+		return true
+	}
+
+	id, err := strconv.ParseInt(folderId, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	// bounded by the number of folders so a bad parent link can't loop forever
+	for range len(a.folders) + 1 {
+		node, ok := a.folders[id]
+		if !ok {
+			break
+		}
+
+		allowed, denied := false, false
+		for _, rule := range a.rules[id] {
+			if !ruleApplies(rule, permission) {
+				continue
+			}
+			if rule.effect == ACLEffectDeny {
+				denied = true
+			} else {
+				allowed = true
+			}
+		}
+
+		if denied {
+			return false
+		}
+
+		if allowed {
+			return true
+		}
+
+		if node.restricted {
+			return false
+		}
+
+		if node.parentId == 0 {
+			break
+		}
+
+		id = node.parentId
+	}
+
+	return true
+}
+
+// whether the folder was there when the access was loaded, a folder deleted since is unknown and Allows can't say anything about its rules
+func (a *FolderAccess) Knows(folderId string) bool {
+	if a.unrestricted {
+		return true
+	}
+
+	id, err := strconv.ParseInt(folderId, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	_, ok := a.folders[id]
+	return ok
+}
+
+// only the folders in the list the user is allowed to see
+func (a *FolderAccess) FilterFolders(folders []FolderData) []FolderData {
+	if a.unrestricted {
+		return folders
+	}
+
+	var visible []FolderData
+
+	for _, folder := range folders {
+		if folder.Id != nil && a.Allows(strconv.FormatInt(*folder.Id, 10), FolderPermissionView) {
+			visible = append(visible, folder)
+		}
+	}
+
+	return visible
+}
+
+// only the files in the list whose folder the user is allowed to see, files at the root have no access list
+func (a *FolderAccess) FilterFiles(files []FileData) []FileData {
+	if a.unrestricted {
+		return files
+	}
+
+	var visible []FileData
+
+	for _, file := range files {
+		folderId := ""
+		if file.ParentFolderId != nil {
+			folderId = strconv.FormatInt(*file.ParentFolderId, 10)
+		}
+
+		if a.Allows(folderId, FolderPermissionView) {
+			visible = append(visible, file)
+		}
+	}
+
+	return visible
+}
+
+// edit implies view, so an edit grant lets the user see the folder and a view denial also takes away edit
+func ruleApplies(rule aclRule, permission string) bool {
+	if rule.permission == permission {
+		return true
+	}
+
+	if permission == FolderPermissionView {
+		return rule.permission == FolderPermissionEdit && rule.effect == ACLEffectAllow
+	}
+
+	return rule.permission == FolderPermissionView && rule.effect == ACLEffectDeny
+}
+
+func GetFolderIdByName(folderName string, orgId string) (string, error) {
+	var folderId string
+
+	err := dbClient.QueryRow("SELECT id FROM folder WHERE name = ? AND org_id = ? LIMIT 1", folderName, orgId).Scan(&folderId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrFolderNotFound
+		}
+		return "", err
+	}
+
+	return folderId, nil
+}
+
+func GetFolderACL(orgId string, folderId string) ([]FolderACLEntry, error) {
+	entries := []FolderACLEntry{}
+
+	statement, err := dbClient.Prepare(`
+		SELECT a.id, a.folder_id, a.principal_type, COALESCE(user.username, org_group.name, ''), a.permission, a.effect, a.created_at
+		FROM folder_acl a
+		JOIN folder f ON f.id = a.folder_id
+		LEFT JOIN user ON a.principal_type = 'user' AND user.id = a.principal_id
+		LEFT JOIN org_group ON a.principal_type = 'group' AND CAST(org_group.id AS TEXT) = a.principal_id
+		WHERE a.folder_id = ? AND f.org_id = ?
+		ORDER BY a.created_at
+	`)
+	if err != nil {
+		return entries, err
+	}
+
+	defer statement.Close()
+
+	rows, err := statement.Query(folderId, orgId)
+	if err != nil {
+		return entries, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry FolderACLEntry
+		err := rows.Scan(&entry.ID, &entry.FolderID, &entry.PrincipalType, &entry.PrincipalName, &entry.Permission, &entry.Effect, &entry.CreatedAt)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// adding an entry that already exists for the same member or group and permission flips its effect instead of failing
+func SetFolderACLEntry(orgId string, folderId string, principalType string, principalName string, permission string, effect string, actor AuditActor) error {
+	var principalId string
+
+	switch principalType {
+	case ACLPrincipalUser:
+		err := dbClient.QueryRow(`
+			SELECT id FROM user
+			WHERE username = ?
+			AND id IN (SELECT user_id FROM org_members WHERE org_id = ?)
+		`, principalName, orgId).Scan(&principalId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrPrincipalNotFound
+			}
+			return err
+		}
+	case ACLPrincipalGroup:
+		err := dbClient.QueryRow("SELECT CAST(id AS TEXT) FROM org_group WHERE name = ? AND org_id = ?", principalName, orgId).Scan(&principalId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrPrincipalNotFound
+			}
+			return err
+		}
+	default:
+		return ErrPrincipalNotFound
+	}
+
+	var previousEffect string
+	err := dbClient.QueryRow(
+		"SELECT effect FROM folder_acl WHERE folder_id = ? AND principal_type = ? AND principal_id = ? AND permission = ?",
+		folderId, principalType, principalId, permission,
+	).Scan(&previousEffect)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO folder_acl (folder_id, principal_type, principal_id, permission, effect)
+		SELECT id, ?, ?, ?, ? FROM folder WHERE id = ? AND org_id = ?
+		ON CONFLICT(folder_id, principal_type, principal_id, permission) DO UPDATE SET effect = excluded.effect
+	`, principalType, principalId, permission, effect, folderId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotFound
+	}
+
+	// before is only there when an existing entry had its effect flipped
+	var before any
+	if len(previousEffect) > 0 {
+		before = map[string]any{"principalType": principalType, "principalName": principalName, "permission": permission, "effect": previousEffect}
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.acl_set",
+		TargetType: ResourceFolder,
+		TargetID:   folderId,
+		Before:     before,
+		After:      map[string]any{"principalType": principalType, "principalName": principalName, "permission": permission, "effect": effect},
+	})
+
+	return nil
+}
+
+func DeleteFolderACLEntry(orgId string, entryId string, actor AuditActor) error {
+	// read first so the log has what was removed, a missing entry is reported by the delete below
+	var folderId int64
+	var principalType, principalId, permission, effect string
+	err := dbClient.QueryRow(`
+		SELECT folder_id, principal_type, principal_id, permission, effect FROM folder_acl
+		WHERE id = ? AND folder_id IN (SELECT id FROM folder WHERE org_id = ?)
+	`, entryId, orgId).Scan(&folderId, &principalType, &principalId, &permission, &effect)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM folder_acl WHERE id = ? AND folder_id IN (SELECT id FROM folder WHERE org_id = ?)", entryId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrACLEntryNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.acl_removed",
+		TargetType: ResourceFolder,
+		TargetID:   strconv.FormatInt(folderId, 10),
+		Before:     map[string]any{"entryId": entryId, "principalType": principalType, "principalId": principalId, "permission": permission, "effect": effect},
+	})
+
+	return nil
+}
+
+func SetFolderRestricted(orgId string, folderId string, restricted bool, actor AuditActor) error {
+	var wasRestricted bool
+	err := dbClient.QueryRow("SELECT restricted FROM folder WHERE id = ? AND org_id = ?", folderId, orgId).Scan(&wasRestricted)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrFolderNotFound
+		}
+		return err
+	}
+
+	result, err := dbClient.Exec("UPDATE folder SET restricted = ? WHERE id = ? AND org_id = ?", restricted, folderId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.restriction_changed",
+		TargetType: ResourceFolder,
+		TargetID:   folderId,
+		Before:     map[string]any{"restricted": wasRestricted},
+		After:      map[string]any{"restricted": restricted},
+	})
+
+	return nil
+}
+
+func IsValidFolderPermission(permission string) bool {
+	return permission == FolderPermissionView || permission == FolderPermissionEdit
+}
+
+func IsValidACLEffect(effect string) bool {
+	return effect == ACLEffectAllow || effect == ACLEffectDeny
+}
@@ -3,13 +3,15 @@ package database
 import (
 	"database/sql"
 	"fms/ioOperations"
+	"fms/realtime"
 	"fmt"
 	"log"
 	"path/filepath"
 	"strconv"
 )
 
-func CreateFolder(userId string, folderName string, orgId string) error {
+// notifyGroupId sends the notification to one group instead of the whole org, empty for everyone
+func CreateFolder(userId string, folderName string, orgId string, notifyGroupId string, actor AuditActor) error {
 	folderExists, err := FolderExists(folderName, nil, orgId)
 
 	if err != nil {
@@ -65,9 +67,26 @@ func CreateFolder(userId string, folderName string, orgId string) error {
 	if err != nil {
 		return err
 	}
+
+	publishFolderChange(orgId, "", "folder.added", payloadID, folderName)
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.created",
+		TargetType: ResourceFolder,
+		TargetID:   payloadID,
+		After:      map[string]any{"name": folderName, "parentFolderId": nil},
+	})
 	// send notification to all org members + org owner if applicable
 	// this is a non-critical operation so neither transaction nor folder creation care about the result
-	err = SendNotificationToOrgMembers(orgId, userId, "folder upload", "Uploaded a folder to", payloadID, folderName)
+	err = NotifyOrg(Notify{
+		OrgID:   orgId,
+		GroupID: notifyGroupId,
+		ActorID: userId,
+		Event:   EventFolderCreated,
+		Message: "Uploaded a folder to",
+		Payload: EventPayload{FolderID: payloadID, FolderName: folderName},
+	})
 	if err != nil {
 		log.Printf("error: could not send out notification to upload folder: %v", err.Error())
 	}
@@ -75,7 +94,7 @@ func CreateFolder(userId string, folderName string, orgId string) error {
 	return nil
 }
 
-func CreateFolderAsChild(userId string, folderName string, orgId string, parentFolderName string) error {
+func CreateFolderAsChild(userId string, folderName string, orgId string, parentFolderName string, notifyGroupId string, actor AuditActor) error {
 	folderExists, err := FolderExists(folderName, &parentFolderName, orgId)
 
 	if err != nil {
@@ -124,8 +143,31 @@ func CreateFolderAsChild(userId string, folderName string, orgId string, parentF
 		log.Printf("ERROR: UNABLE TO CREATE FOLDER FOR FOLDER ID: %v ORG ID: %v \n", payloadID, orgId)
 	}
 
+	parentId, err := getParentFolderId(payloadID)
+	if err != nil {
+		log.Printf("error: could not read parent of folder %v: %v", payloadID, err.Error())
+	}
+
+	publishFolderChange(orgId, parentId, "folder.added", payloadID, folderName)
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.created",
+		TargetType: ResourceFolder,
+		TargetID:   payloadID,
+		After:      map[string]any{"name": folderName, "parentFolderId": nullIfEmpty(parentId)},
+	})
+
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "folder upload", "Uploaded a folder to", payloadID, folderName)
+	err = NotifyOrg(Notify{
+		OrgID:    orgId,
+		GroupID:  notifyGroupId,
+		ActorID:  userId,
+		Event:    EventFolderCreated,
+		Message:  "Uploaded a folder to",
+		Payload:  EventPayload{FolderID: payloadID, FolderName: folderName},
+		FolderID: parentId,
+	})
 	if err != nil {
 		log.Printf("error: could not send out notification to upload folder: %v", err.Error())
 	}
@@ -145,12 +187,13 @@ func GetRootFolderOfOrg(orgId string) []FolderData {
 			folder.name, 
 			folder.parent_folder_id, 
 			folder.created_at,
-			COALESCE(SUM(file.size), 0) AS total_size
+			COALESCE(SUM(file.size), 0) AS total_size,
+			folder.restricted
 		FROM folder 
 		LEFT JOIN user ON user.id = folder.uploader_id
 		LEFT JOIN file ON file.folder_id = folder.id
 		WHERE folder.org_id = ? AND folder.parent_folder_id IS NULL
-		GROUP BY folder.id, folder.org_id, user.username, folder.name, folder.parent_folder_id, folder.created_at
+		GROUP BY folder.id, folder.org_id, user.username, folder.name, folder.parent_folder_id, folder.created_at, folder.restricted
 		ORDER BY folder.created_at DESC
 	`)
 
@@ -176,6 +219,7 @@ func GetRootFolderOfOrg(orgId string) []FolderData {
 			&folder.ParentFolderId,
 			&folder.CreatedAt,
 			&folder.Size,
+			&folder.Restricted,
 		)
 		if err != nil {
 			continue
@@ -191,18 +235,28 @@ func GetRootFolderOfOrg(orgId string) []FolderData {
 
 }
 
+// the first folder in the org with the name, callers that know which folder they mean use GetFolderChildrenById
 func GetFolderChildren(folderName string, orgId string) []FolderData {
+	folderId, err := GetFolderIdByName(folderName, orgId)
+	if err != nil {
+		return nil
+	}
+
+	return GetFolderChildrenById(folderId, orgId)
+}
+
+func GetFolderChildrenById(folderId string, orgId string) []FolderData {
 	var folders []FolderData
 
 	statement, err := dbClient.Prepare(`
 		SELECT 
 			folder.id, folder.org_id, user.username, folder.name, 
-			folder.parent_folder_id, folder.created_at, COALESCE(SUM(file.size), 0) AS total_size
+			folder.parent_folder_id, folder.created_at, COALESCE(SUM(file.size), 0) AS total_size, folder.restricted
 		FROM folder 
 		LEFT JOIN user ON user.id = folder.uploader_id
 		LEFT JOIN file ON file.folder_id = folder.id
-		WHERE folder.parent_folder_id = (SELECT id FROM folder WHERE name = ? AND org_id = ? LIMIT 1) AND folder.org_id = ?
-		GROUP BY folder.id, folder.org_id, user.username, folder.name, folder.parent_folder_id, folder.created_at
+		WHERE folder.parent_folder_id = ? AND folder.org_id = ?
+		GROUP BY folder.id, folder.org_id, user.username, folder.name, folder.parent_folder_id, folder.created_at, folder.restricted
 		ORDER BY folder.created_at DESC
 	`)
 
@@ -212,7 +266,7 @@ func GetFolderChildren(folderName string, orgId string) []FolderData {
 
 	defer statement.Close()
 
-	rows, err := statement.Query(folderName, orgId, orgId)
+	rows, err := statement.Query(folderId, orgId)
 	if err != nil {
 		return folders
 	}
@@ -228,6 +282,7 @@ func GetFolderChildren(folderName string, orgId string) []FolderData {
 			&folder.ParentFolderId,
 			&folder.CreatedAt,
 			&folder.Size,
+			&folder.Restricted,
 		)
 		if err != nil {
 			continue
@@ -242,13 +297,19 @@ func GetFolderChildren(folderName string, orgId string) []FolderData {
 	return folders
 }
 
-func DeleteFolder(folderId string, userId string, orgId string, folderName string) error {
+func DeleteFolder(folderId string, userId string, orgId string, folderName string, actor AuditActor) error {
 	folderPath, err := getFolderPath(folderId)
 
 	if err != nil {
 		log.Printf("ERROR: UNABLE TO PARSE FOLDER PATH TREE. FOLDER ID:%v ORG ID:%v \n", folderId, orgId)
 	}
 
+	// read before the row goes so connected clients can be told which folder lost it
+	parentId, err := getParentFolderId(folderId)
+	if err != nil {
+		log.Printf("error: could not read parent of folder %v: %v", folderId, err.Error())
+	}
+
 	statement, err := dbClient.Prepare("DELETE FROM folder WHERE id = ?")
 	if err != nil {
 		return err
@@ -273,8 +334,26 @@ func DeleteFolder(folderId string, userId string, orgId string, folderName strin
 		log.Printf("ERROR: UNABLE TO DELETE CHILD FOLDER IN AN ORG. FOLDER ID:%v ORG ID:%v \n", folderId, orgId)
 	}
 
+	publishFolderChange(orgId, parentId, "folder.deleted", folderId, folderName)
+
+	// everything inside went with it, the one event stands for all of it
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "folder.deleted",
+		TargetType: ResourceFolder,
+		TargetID:   folderId,
+		Before:     map[string]any{"name": folderName, "parentFolderId": nullIfEmpty(parentId)},
+	})
+
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "folder delete", "Deleted a folder from", folderId, folderName)
+	err = NotifyOrg(Notify{
+		OrgID:    orgId,
+		ActorID:  userId,
+		Event:    EventFolderDeleted,
+		Message:  "Deleted a folder from",
+		Payload:  EventPayload{FolderID: folderId, FolderName: folderName},
+		FolderID: parentId,
+	})
 	if err != nil {
 		log.Printf("error: could not send out notification to delete folder: %v", err.Error())
 	}
@@ -361,3 +440,25 @@ func getFolderPath(folderId string) (string, error) {
 	// return the full path
 	return filepath.Join(parentPath, fmt.Sprintf("folder-%s", folderId)), nil
 }
+
+// empty for a folder at the root of the org
+func getParentFolderId(folderId string) (string, error) {
+	var parentId sql.NullString
+
+	err := dbClient.QueryRow("SELECT parent_folder_id FROM folder WHERE id = ?", folderId).Scan(&parentId)
+	if err != nil {
+		return "", err
+	}
+
+	return parentId.String, nil
+}
+
+// tells the org's connected members that a folder's contents changed, folderId is empty for the root
+func publishFolderChange(orgId string, folderId string, action string, id string, name string) {
+	realtime.Publish(realtime.Event{
+		Type:     "folder.changed",
+		OrgID:    orgId,
+		FolderID: folderId,
+		Data:     realtime.FolderChange{Action: action, ID: id, Name: name},
+	})
+}
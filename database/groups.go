@@ -0,0 +1,325 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrGroupNameTaken = errors.New("a group with this name already exists")
+	ErrNotGroupMember = errors.New("user is not in this group")
+)
+
+// a named set of members inside one org
+// the group's role is optional, its capabilities are added to whatever each member's own role already gives them
+type OrgGroup struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	MemberCount int    `json:"memberCount"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+func GetOrgGroups(orgId string) ([]OrgGroup, error) {
+	groups := []OrgGroup{}
+
+	rows, err := dbClient.Query(`
+		SELECT g.id, g.name, COALESCE(g.role, ''), (SELECT COUNT(*) FROM org_group_member WHERE group_id = g.id), g.created_at
+		FROM org_group g
+		WHERE g.org_id = ?
+		ORDER BY g.name
+	`, orgId)
+	if err != nil {
+		return groups, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var group OrgGroup
+		err := rows.Scan(&group.ID, &group.Name, &group.Role, &group.MemberCount, &group.CreatedAt)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+func GetOrgGroup(orgId string, groupId string) (*OrgGroup, error) {
+	var group OrgGroup
+
+	err := dbClient.QueryRow(`
+		SELECT g.id, g.name, COALESCE(g.role, ''), (SELECT COUNT(*) FROM org_group_member WHERE group_id = g.id), g.created_at
+		FROM org_group g
+		WHERE g.id = ? AND g.org_id = ?
+	`, groupId, orgId).Scan(&group.ID, &group.Name, &group.Role, &group.MemberCount, &group.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// role is empty for a group that only exists for folder access and notifications
+func CreateOrgGroup(orgId string, name string, role string, actor AuditActor) (int64, error) {
+	result, err := dbClient.Exec(
+		"INSERT INTO org_group (org_id, name, role, created_at) VALUES (?, ?, ?, ?)",
+		orgId, name, nullIfEmpty(role), time.Now().Unix(),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return 0, ErrGroupNameTaken
+		}
+		return 0, err
+	}
+
+	groupId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "group.created",
+		TargetType: "group",
+		TargetID:   strconv.FormatInt(groupId, 10),
+		After:      map[string]any{"name": name, "role": nullIfEmpty(role)},
+	})
+
+	return groupId, nil
+}
+
+// members pick up a role change on their next request, the same as a change to a custom role
+func UpdateOrgGroup(orgId string, groupId string, name string, role string, actor AuditActor) error {
+	group, err := GetOrgGroup(orgId, groupId)
+	if err != nil {
+		return err
+	}
+
+	result, err := dbClient.Exec("UPDATE org_group SET name = ?, role = ? WHERE id = ? AND org_id = ?", name, nullIfEmpty(role), groupId, orgId)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrGroupNameTaken
+		}
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "group.updated",
+		TargetType: "group",
+		TargetID:   groupId,
+		Before:     map[string]any{"name": group.Name, "role": nullIfEmpty(group.Role)},
+		After:      map[string]any{"name": name, "role": nullIfEmpty(role)},
+	})
+
+	return nil
+}
+
+// access list entries for the group go with it, nothing else references a group by id without a foreign key
+func DeleteOrgGroup(orgId string, groupId string, actor AuditActor) error {
+	group, err := GetOrgGroup(orgId, groupId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM org_group WHERE id = ? AND org_id = ?", groupId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrGroupNotFound
+	}
+
+	_, err = tx.Exec("DELETE FROM folder_acl WHERE principal_type = 'group' AND principal_id = ?", groupId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "group.deleted",
+		TargetType: "group",
+		TargetID:   groupId,
+		Before:     map[string]any{"name": group.Name, "role": nullIfEmpty(group.Role), "members": group.MemberCount},
+	})
+
+	return nil
+}
+
+func GetOrgGroupMembers(orgId string, groupId string) ([]OrganisationMembers, error) {
+	members := []OrganisationMembers{}
+
+	rows, err := dbClient.Query(`
+		SELECT user.username, org_members.role
+		FROM org_group_member gm
+		JOIN org_group g ON g.id = gm.group_id
+		JOIN user ON user.id = gm.user_id
+		JOIN org_members ON org_members.user_id = gm.user_id AND org_members.org_id = g.org_id
+		WHERE g.id = ? AND g.org_id = ?
+		ORDER BY user.username
+	`, groupId, orgId)
+	if err != nil {
+		return members, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var member OrganisationMembers
+		err := rows.Scan(&member.Username, &member.Role)
+		if err != nil {
+			continue
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// only members of the org can be put in one of its groups, adding someone twice is not an error
+func AddOrgGroupMember(orgId string, groupId string, username string, actor AuditActor) error {
+	var userId string
+
+	err := dbClient.QueryRow(`
+		SELECT user.id FROM org_members
+		JOIN user ON user.id = org_members.user_id
+		WHERE org_members.org_id = ? AND user.username = ?
+	`, orgId, username).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotOrgMember
+		}
+		return err
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO org_group_member (group_id, user_id)
+		SELECT id, ? FROM org_group WHERE id = ? AND org_id = ?
+		ON CONFLICT(group_id, user_id) DO NOTHING
+	`, userId, groupId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		_, err = GetOrgGroup(orgId, groupId)
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "group.member_added",
+		TargetType: "group",
+		TargetID:   groupId,
+		After:      map[string]any{"userId": userId, "username": username},
+	})
+
+	return nil
+}
+
+func RemoveOrgGroupMember(orgId string, groupId string, username string, actor AuditActor) error {
+	result, err := dbClient.Exec(`
+		DELETE FROM org_group_member
+		WHERE group_id = (SELECT id FROM org_group WHERE id = ? AND org_id = ?)
+		AND user_id = (SELECT id FROM user WHERE username = ?)
+	`, groupId, orgId, username)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotGroupMember
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "group.member_removed",
+		TargetType: "group",
+		TargetID:   groupId,
+		Before:     map[string]any{"username": username},
+	})
+
+	return nil
+}
+
+// the roles the user picks up from the groups they are in
+func getGroupRoles(userId string, orgId string) ([]string, error) {
+	rows, err := dbClient.Query(`
+		SELECT DISTINCT g.role FROM org_group g
+		JOIN org_group_member gm ON gm.group_id = g.id
+		WHERE g.org_id = ? AND gm.user_id = ? AND g.role IS NOT NULL
+	`, orgId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var roles []string
+
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func nullIfEmpty(value string) any {
+	if len(value) == 0 {
+		return nil
+	}
+
+	return value
+}
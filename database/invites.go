@@ -0,0 +1,512 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// how long a direct invite or an emailed invite stays valid
+const orgInviteTTL = 7 * 24 * time.Hour
+
+// stops resend and email invites being used to flood someone's notifications or inbox
+const inviteResendCooldown = 10 * time.Minute
+
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrAlreadyMember       = errors.New("user is already a member of this organisation")
+	ErrAlreadyInvited      = errors.New("user already has a pending invite to this organisation")
+	ErrInviteNotFound      = errors.New("invite not found")
+	ErrInviteRateLimited   = errors.New("an invite was sent recently. please wait a few minutes before sending another")
+	ErrInviteEmailMismatch = errors.New("this invite was sent to a different email address. verify that address on your account to join")
+)
+
+// an invite link as the person holding it sees it before joining
+type InviteLinkPreview struct {
+	OrgName string `json:"orgName"`
+	Role    string `json:"role"`
+}
+
+// *sql.DB or *sql.Tx, for lookups that run both inside and outside a transaction
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// the role to give a new member, falling back to the default when the custom role it names no longer exists
+func roleOrDefault(q queryRower, orgId string, role string) (string, error) {
+	if len(role) == 0 {
+		return DefaultMemberRole, nil
+	}
+
+	if _, builtIn := builtInRoles[role]; builtIn {
+		return role, nil
+	}
+
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM org_role WHERE org_id = ? AND name = ?)", orgId, role).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+
+	if !exists {
+		return DefaultMemberRole, nil
+	}
+
+	return role, nil
+}
+
+// ErrUserNotFound when there's no account with the username
+func isOrgMemberByUsername(orgId string, username string) (bool, error) {
+	var isMember bool
+
+	err := dbClient.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = ? AND user_id = user.id)
+		FROM user WHERE username = ?
+	`, orgId, username).Scan(&isMember)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+
+	return isMember, nil
+}
+
+// the invitee gets their own notification, the org id is the payload so the client can accept straight from it
+func notifyInvitee(orgId string, inviterId string, username string, message string) {
+	var inviteeId string
+
+	err := dbClient.QueryRow("SELECT id FROM user WHERE username = ?", username).Scan(&inviteeId)
+	if err == nil {
+		err = SendNotificationToUser(inviteeId, inviterId, EventInviteReceived, message, EventPayload{OrgID: orgId})
+	}
+
+	if err != nil {
+		log.Printf("error: could not send out invite notification: %v", err.Error())
+	}
+}
+
+// pending invites for the org, expired ones are included so they can be resent or cleaned up
+func GetOrgInvites(orgId string) ([]PendingOrgInvite, error) {
+	invites := []PendingOrgInvite{}
+
+	rows, err := dbClient.Query(`
+		SELECT i.id, u.username, COALESCE(inviter.username, ''), COALESCE(i.role, ?), i.invited_at, i.expires_at
+		FROM org_invites i
+		JOIN user u ON u.id = i.user_id
+		LEFT JOIN user inviter ON inviter.id = i.invited_by
+		WHERE i.org_id = ? AND i.status = 'pending'
+		ORDER BY i.expires_at DESC
+	`, DefaultMemberRole, orgId)
+	if err != nil {
+		return invites, err
+	}
+
+	defer rows.Close()
+
+	now := time.Now().Unix()
+
+	for rows.Next() {
+		var invite PendingOrgInvite
+		err := rows.Scan(&invite.ID, &invite.Username, &invite.InvitedBy, &invite.Role, &invite.InvitedAt, &invite.ExpiresAt)
+		if err != nil {
+			continue
+		}
+		invite.Expired = invite.ExpiresAt <= now
+		invites = append(invites, invite)
+	}
+
+	return invites, rows.Err()
+}
+
+func RevokeOrgInvite(orgId string, inviteId string, actor AuditActor) error {
+	var username, role string
+	err := dbClient.QueryRow(`
+		SELECT u.username, COALESCE(i.role, ?) FROM org_invites i
+		JOIN user u ON u.id = i.user_id
+		WHERE i.id = ? AND i.org_id = ?
+	`, DefaultMemberRole, inviteId, orgId).Scan(&username, &role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM org_invites WHERE id = ? AND org_id = ?", inviteId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite.revoked",
+		TargetType: "invite",
+		TargetID:   inviteId,
+		Before:     map[string]any{"username": username, "role": role},
+	})
+
+	return nil
+}
+
+// gives the invite a fresh expiry and notifies the invitee again, works on expired invites too
+func ResendOrgInvite(orgId string, inviteId string, actorId string, actor AuditActor) error {
+	now := time.Now()
+
+	var username string
+	var lastSentAt, expiresAt int64
+
+	err := dbClient.QueryRow(`
+		SELECT u.username, i.last_sent_at, i.expires_at FROM org_invites i
+		JOIN user u ON u.id = i.user_id
+		WHERE i.id = ? AND i.org_id = ?
+	`, inviteId, orgId).Scan(&username, &lastSentAt, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	if now.Unix()-lastSentAt < int64(inviteResendCooldown.Seconds()) {
+		return ErrInviteRateLimited
+	}
+
+	_, err = dbClient.Exec(
+		"UPDATE org_invites SET expires_at = ?, last_sent_at = ?, invited_by = ? WHERE id = ?",
+		now.Add(orgInviteTTL).Unix(), now.Unix(), actorId, inviteId,
+	)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite.resent",
+		TargetType: "invite",
+		TargetID:   inviteId,
+		Before:     map[string]any{"username": username, "expiresAt": expiresAt},
+		After:      map[string]any{"username": username, "expiresAt": now.Add(orgInviteTTL).Unix()},
+	})
+
+	notifyInvitee(orgId, actorId, username, "Reminded you of your invite to join")
+
+	return nil
+}
+
+// creates a link anyone with the token can use to join with the given role, only the hash is stored so the raw token is returned once
+// maxUses and ttl of 0 mean no limit
+func CreateInviteLink(orgId string, createdBy string, role string, maxUses int64, ttl time.Duration, actor AuditActor) (string, error) {
+	return createInviteLink(orgId, createdBy, role, "", maxUses, ttl, actor)
+}
+
+// an invite for someone who may not have an account yet, it's a single use link that only the account with that verified email can use
+// an earlier unused invite to the same address is replaced
+func CreateEmailInvite(orgId string, createdBy string, role string, email string, actor AuditActor) (string, error) {
+	now := time.Now()
+
+	var lastCreatedAt int64
+	err := dbClient.QueryRow(`
+		SELECT COALESCE(MAX(created_at), 0) FROM org_invite_link
+		WHERE org_id = ? AND email = ? COLLATE NOCASE AND revoked_at IS NULL AND uses = 0
+	`, orgId, email).Scan(&lastCreatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	if now.Unix()-lastCreatedAt < int64(inviteResendCooldown.Seconds()) {
+		return "", ErrInviteRateLimited
+	}
+
+	_, err = dbClient.Exec(`
+		UPDATE org_invite_link SET revoked_at = ?
+		WHERE org_id = ? AND email = ? COLLATE NOCASE AND revoked_at IS NULL AND uses = 0
+	`, now.Unix(), orgId, email)
+	if err != nil {
+		return "", err
+	}
+
+	return createInviteLink(orgId, createdBy, role, email, 1, orgInviteTTL, actor)
+}
+
+func createInviteLink(orgId string, createdBy string, role string, email string, maxUses int64, ttl time.Duration, actor AuditActor) (string, error) {
+	now := time.Now()
+
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	var limit, expiresAt, emailValue any
+	if maxUses > 0 {
+		limit = maxUses
+	}
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+	if len(email) > 0 {
+		emailValue = email
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO org_invite_link (token_hash, org_id, created_by, role, email, max_uses, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, HashToken(token), orgId, createdBy, role, emailValue, limit, expiresAt, now.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	linkId, err := result.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	// the token itself never goes in the log, it would let anyone reading the log use the link
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite_link.created",
+		TargetType: "invite_link",
+		TargetID:   strconv.FormatInt(linkId, 10),
+		After:      map[string]any{"role": role, "email": emailValue, "maxUses": limit, "expiresAt": expiresAt},
+	})
+
+	return token, nil
+}
+
+// links that haven't been revoked, used up links and expired links are still listed so the org can see what happened to them
+func GetInviteLinks(orgId string) ([]OrgInviteLink, error) {
+	links := []OrgInviteLink{}
+
+	rows, err := dbClient.Query(`
+		SELECT l.id, COALESCE(u.username, ''), l.role, COALESCE(l.email, ''), l.max_uses, l.uses, l.expires_at, l.created_at
+		FROM org_invite_link l
+		LEFT JOIN user u ON u.id = l.created_by
+		WHERE l.org_id = ? AND l.revoked_at IS NULL
+		ORDER BY l.created_at DESC
+	`, orgId)
+	if err != nil {
+		return links, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var link OrgInviteLink
+		var maxUses, expiresAt sql.NullInt64
+		err := rows.Scan(&link.ID, &link.CreatedBy, &link.Role, &link.Email, &maxUses, &link.Uses, &expiresAt, &link.CreatedAt)
+		if err != nil {
+			continue
+		}
+		if maxUses.Valid {
+			link.MaxUses = &maxUses.Int64
+		}
+		if expiresAt.Valid {
+			link.ExpiresAt = &expiresAt.Int64
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+func RevokeInviteLink(orgId string, linkId string, actor AuditActor) error {
+	now := time.Now().Unix()
+
+	result, err := dbClient.Exec("UPDATE org_invite_link SET revoked_at = ? WHERE id = ? AND org_id = ? AND revoked_at IS NULL", now, linkId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite_link.revoked",
+		TargetType: "invite_link",
+		TargetID:   linkId,
+		Before:     map[string]any{"revokedAt": nil},
+		After:      map[string]any{"revokedAt": now},
+	})
+
+	return nil
+}
+
+// takes back an email invite whose email never went out, so the sender can try again straight away instead of waiting out the cooldown
+func WithdrawEmailInvite(orgId string, token string, actor AuditActor) error {
+	now := time.Now().Unix()
+
+	var linkId string
+	err := dbClient.QueryRow(`
+		UPDATE org_invite_link SET revoked_at = ?
+		WHERE token_hash = ? AND org_id = ? AND email IS NOT NULL AND revoked_at IS NULL AND uses = 0
+		RETURNING id
+	`, now, HashToken(token), orgId).Scan(&linkId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite_link.revoked",
+		TargetType: "invite_link",
+		TargetID:   linkId,
+		Before:     map[string]any{"revokedAt": nil},
+		After:      map[string]any{"revokedAt": now, "reason": "email not sent"},
+	})
+
+	return nil
+}
+
+type inviteLink struct {
+	id      int64
+	orgId   string
+	role    string
+	email   sql.NullString
+	maxUses sql.NullInt64
+	uses    int64
+}
+
+// ErrInvalidToken for links that are unknown, revoked, expired or used up, same as the account tokens
+func getUsableInviteLink(q queryRower, token string) (*inviteLink, error) {
+	var link inviteLink
+
+	err := q.QueryRow(`
+		SELECT id, org_id, role, email, max_uses, uses FROM org_invite_link
+		WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)
+	`, HashToken(token), time.Now().Unix()).Scan(&link.id, &link.orgId, &link.role, &link.email, &link.maxUses, &link.uses)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	if link.maxUses.Valid && link.uses >= link.maxUses.Int64 {
+		return nil, ErrInvalidToken
+	}
+
+	return &link, nil
+}
+
+func GetInviteLinkPreview(token string) (*InviteLinkPreview, error) {
+	link, err := getUsableInviteLink(dbClient, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InviteLinkPreview{OrgName: orgName(link.orgId), Role: link.role}, nil
+}
+
+// joins the org the link belongs to and returns its id
+// if the link's custom role was deleted since it was made the member gets the default role instead
+func JoinByInviteLink(token string, userId string, username string, actor AuditActor) (string, error) {
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	link, err := getUsableInviteLink(tx, token)
+	if err != nil {
+		return "", err
+	}
+
+	if link.email.Valid {
+		var matches bool
+		err = tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM user WHERE id = ? AND email = ? COLLATE NOCASE AND email_verified_at IS NOT NULL)",
+			userId, link.email.String,
+		).Scan(&matches)
+		if err != nil {
+			return "", err
+		}
+
+		if !matches {
+			return "", ErrInviteEmailMismatch
+		}
+	}
+
+	var isMember bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = ? AND user_id = ?)", link.orgId, userId).Scan(&isMember)
+	if err != nil {
+		return "", err
+	}
+
+	if isMember {
+		return "", ErrAlreadyMember
+	}
+
+	role, err := roleOrDefault(tx, link.orgId, link.role)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)", link.orgId, userId, role)
+	if err != nil {
+		return "", err
+	}
+
+	// guarded on uses so two people racing for the last use can't both get in
+	result, err := tx.Exec("UPDATE org_invite_link SET uses = uses + 1 WHERE id = ? AND (max_uses IS NULL OR uses < max_uses)", link.id)
+	if err != nil {
+		return "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if rowsAffected == 0 {
+		return "", ErrInvalidToken
+	}
+
+	// a direct invite to the same org is no longer needed
+	_, err = tx.Exec("DELETE FROM org_invites WHERE org_id = ? AND user_id = ?", link.orgId, userId)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      link.orgId,
+		Action:     "member.joined",
+		TargetType: "member",
+		TargetID:   userId,
+		After:      map[string]any{"username": username, "role": role, "inviteLinkId": link.id},
+	})
+
+	err = SendNotificationToOrgMembers(link.orgId, userId, EventMemberJoined, "Joined the organisation through an invite link", EventPayload{UserID: userId, Username: username})
+	if err != nil {
+		log.Printf("error: could not send out notification to join org: %v", err.Error())
+	}
+
+	return link.orgId, nil
+}
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// how long after a denial before the same user can ask to join again
+const joinRequestCooldown = 24 * time.Hour
+
+var (
+	ErrOrgNotDiscoverable  = errors.New("organisation not found")
+	ErrJoinRequestExists   = errors.New("you have already asked to join this organisation recently")
+	ErrJoinRequestNotFound = errors.New("join request not found")
+	ErrJoinLimitExceeded   = errors.New("this user has reached the organisation limit for their plan")
+)
+
+func SetOrgDiscoverable(orgId string, discoverable bool, actor AuditActor) error {
+	var wasDiscoverable bool
+	err := dbClient.QueryRow("SELECT discoverable FROM organisation WHERE id = ?", orgId).Scan(&wasDiscoverable)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbClient.Exec("UPDATE organisation SET discoverable = ? WHERE id = ?", discoverable, orgId)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "org.discoverability_changed",
+		TargetType: "org",
+		TargetID:   orgId,
+		Before:     map[string]any{"discoverable": wasDiscoverable},
+		After:      map[string]any{"discoverable": discoverable},
+	})
+
+	return nil
+}
+
+// discoverable orgs the user isn't already in, matched on name the same way as the user search
+func SearchDiscoverableOrgs(name string, userId string) ([]DiscoverableOrg, error) {
+	orgs := []DiscoverableOrg{}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			o.id,
+			o.name,
+			(SELECT COUNT(*) FROM org_members WHERE org_id = o.id),
+			EXISTS(SELECT 1 FROM org_join_request WHERE org_id = o.id AND user_id = ? AND status = 'pending')
+		FROM organisation o
+		WHERE o.discoverable = 1
+		AND o.name LIKE ?
+		AND o.id NOT IN (SELECT org_id FROM org_members WHERE user_id = ?)
+		ORDER BY o.name
+		LIMIT 20
+	`, userId, "%"+name+"%", userId)
+	if err != nil {
+		return orgs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var org DiscoverableOrg
+		err := rows.Scan(&org.ID, &org.Name, &org.MemberCount, &org.Requested)
+		if err != nil {
+			continue
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// a denied request can be made again once the cooldown has passed, a pending one can't be repeated
+// users with a pending invite are told so rather than queueing a request nobody needs to approve
+func RequestToJoinOrg(orgId string, userId string, username string, message string, actor AuditActor) error {
+	now := time.Now()
+
+	var discoverable, isMember, isInvited bool
+
+	err := dbClient.QueryRow(`
+		SELECT
+			discoverable,
+			EXISTS(SELECT 1 FROM org_members WHERE org_id = organisation.id AND user_id = ?),
+			EXISTS(SELECT 1 FROM org_invites WHERE org_id = organisation.id AND user_id = ? AND expires_at > ?)
+		FROM organisation WHERE id = ?
+	`, userId, userId, now.Unix(), orgId).Scan(&discoverable, &isMember, &isInvited)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrOrgNotDiscoverable
+		}
+		return err
+	}
+
+	if isMember {
+		return ErrAlreadyMember
+	}
+
+	if !discoverable {
+		return ErrOrgNotDiscoverable
+	}
+
+	if isInvited {
+		return ErrAlreadyInvited
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO org_join_request (org_id, user_id, message, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(org_id, user_id) DO UPDATE SET
+			message = excluded.message,
+			status = 'pending',
+			created_at = excluded.created_at,
+			decided_by = NULL,
+			decided_at = NULL
+		WHERE org_join_request.status = 'denied' AND org_join_request.decided_at <= ?
+	`, orgId, userId, message, now.Unix(), now.Add(-joinRequestCooldown).Unix())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrJoinRequestExists
+	}
+
+	// the upsert's insert id can't be trusted when it reopened a denied request, so the id is read back
+	var requestId int64
+	err = dbClient.QueryRow("SELECT id FROM org_join_request WHERE org_id = ? AND user_id = ?", orgId, userId).Scan(&requestId)
+	if err != nil {
+		log.Printf("error: could not read join request id: %v", err.Error())
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "join_request.created",
+		TargetType: "join_request",
+		TargetID:   strconv.FormatInt(requestId, 10),
+		After:      map[string]any{"userId": userId, "username": username, "message": message},
+	})
+
+	approvers, err := GetMembersWithCapability(orgId, CapMemberInvite)
+	if err == nil {
+		err = SendNotificationToOrgUsers(orgId, approvers, userId, EventJoinRequestCreated, "Asked to join", EventPayload{UserID: userId, Username: username, RequestID: strconv.FormatInt(requestId, 10)})
+	}
+
+	if err != nil {
+		log.Printf("error: could not send out join request notification: %v", err.Error())
+	}
+
+	return nil
+}
+
+func CancelJoinRequest(orgId string, userId string, actor AuditActor) error {
+	var requestId int64
+	err := dbClient.QueryRow("SELECT id FROM org_join_request WHERE org_id = ? AND user_id = ? AND status = 'pending'", orgId, userId).Scan(&requestId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrJoinRequestNotFound
+		}
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM org_join_request WHERE id = ? AND status = 'pending'", requestId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrJoinRequestNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "join_request.cancelled",
+		TargetType: "join_request",
+		TargetID:   strconv.FormatInt(requestId, 10),
+		Before:     map[string]any{"userId": userId, "status": "pending"},
+	})
+
+	return nil
+}
+
+// the user's own requests that are still waiting on the org
+func GetUserJoinRequests(userId string) ([]JoinRequest, error) {
+	return queryJoinRequests("r.user_id = ?", userId)
+}
+
+// the org's queue, oldest first
+func GetOrgJoinRequests(orgId string) ([]JoinRequest, error) {
+	return queryJoinRequests("r.org_id = ?", orgId)
+}
+
+func queryJoinRequests(filter string, arg string) ([]JoinRequest, error) {
+	requests := []JoinRequest{}
+
+	rows, err := dbClient.Query(`
+		SELECT r.id, r.org_id, o.name, u.username, r.message, r.created_at
+		FROM org_join_request r
+		JOIN organisation o ON o.id = r.org_id
+		JOIN user u ON u.id = r.user_id
+		WHERE r.status = 'pending' AND `+filter+`
+		ORDER BY r.created_at
+	`, arg)
+	if err != nil {
+		return requests, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var request JoinRequest
+		err := rows.Scan(&request.ID, &request.OrgID, &request.OrgName, &request.Username, &request.Message, &request.CreatedAt)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, rows.Err()
+}
+
+// adds the requester with the given role, the caller has already checked the approver may hand it out
+// the requester's membership limit is checked here since they aren't the one making the call
+func ApproveJoinRequest(orgId string, requestId string, actorId string, role string, actor AuditActor) error {
+	var userId, username string
+
+	err := dbClient.QueryRow(`
+		SELECT r.user_id, u.username FROM org_join_request r
+		JOIN user u ON u.id = r.user_id
+		WHERE r.id = ? AND r.org_id = ? AND r.status = 'pending'
+	`, requestId, orgId).Scan(&userId, &username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrJoinRequestNotFound
+		}
+		return err
+	}
+
+	hasExceededLimit, err := HasExceededLimit(userId)
+	if err != nil {
+		return err
+	}
+
+	if hasExceededLimit {
+		return ErrJoinLimitExceeded
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// guarded on status so two approvers acting at once can't both add the member
+	result, err := tx.Exec("DELETE FROM org_join_request WHERE id = ? AND status = 'pending'", requestId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrJoinRequestNotFound
+	}
+
+	_, err = tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)", orgId, userId, role)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM org_invites WHERE org_id = ? AND user_id = ?", orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "join_request.approved",
+		TargetType: "join_request",
+		TargetID:   requestId,
+		Before:     map[string]any{"userId": userId, "username": username, "status": "pending"},
+		After:      map[string]any{"userId": userId, "username": username, "status": "approved", "role": role},
+	})
+
+	err = SendNotificationToOrgUsers(orgId, []string{userId}, actorId, EventJoinRequestApproved, "Approved your request to join", EventPayload{RequestID: requestId})
+	if err != nil {
+		log.Printf("error: could not send out join request notification: %v", err.Error())
+	}
+
+	err = SendNotificationToOrgMembers(orgId, userId, EventMemberJoined, "Is now a member of", EventPayload{UserID: userId, Username: username})
+	if err != nil {
+		log.Printf("error: could not send out notification to join org: %v", err.Error())
+	}
+
+	return nil
+}
+
+// the request is kept as denied until the cooldown passes so the user can't immediately ask again
+func DenyJoinRequest(orgId string, requestId string, actorId string, actor AuditActor) error {
+	var userId string
+
+	err := dbClient.QueryRow("SELECT user_id FROM org_join_request WHERE id = ? AND org_id = ? AND status = 'pending'", requestId, orgId).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrJoinRequestNotFound
+		}
+		return err
+	}
+
+	_, err = dbClient.Exec(
+		"UPDATE org_join_request SET status = 'denied', decided_by = ?, decided_at = ? WHERE id = ?",
+		actorId, time.Now().Unix(), requestId,
+	)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "join_request.denied",
+		TargetType: "join_request",
+		TargetID:   requestId,
+		Before:     map[string]any{"userId": userId, "status": "pending"},
+		After:      map[string]any{"userId": userId, "status": "denied"},
+	})
+
+	// the org is left off so the requester isn't shown a link into an org they can't open
+	err = SendNotificationToUser(userId, actorId, EventJoinRequestDenied, "Declined your request to join", EventPayload{OrgID: orgId})
+	if err != nil {
+		log.Printf("error: could not send out join request notification: %v", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// -1 in either field means no limit
+type OrgLimits struct {
+	// organisations the user can create, counted by organisation.creator_id so co-owners don't use up each other's allowance
+	OwnedOrgs int `json:"ownedOrgs"`
+	// organisations the user can join as a member, orgs they are an owner of don't count
+	Memberships int `json:"memberships"`
+}
+
+const UnlimitedOrgs = -1
+
+var ErrOrgLimitReached = errors.New("organisation limit reached for your plan")
+
+// used for users without a plan and for plans that aren't in the plans file
+var defaultOrgLimits = OrgLimits{OwnedOrgs: 1, Memberships: 3}
+
+var planOrgLimits = map[string]OrgLimits{}
+
+func SetDefaultOrgLimits(limits OrgLimits) error {
+	if limits.OwnedOrgs < UnlimitedOrgs || limits.Memberships < UnlimitedOrgs {
+		return fmt.Errorf("org limits must be %d (unlimited) or more", UnlimitedOrgs)
+	}
+
+	defaultOrgLimits = limits
+
+	return nil
+}
+
+// the plans file is a json object of plan name to limits, e.g. {"pro": {"ownedOrgs": 5, "memberships": 20}}
+// user.plan is set by whatever handles billing, a plan missing from the file falls back to the defaults
+func LoadPlanLimits(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read plans file: %s", err.Error())
+	}
+
+	var plans map[string]OrgLimits
+
+	err = json.Unmarshal(data, &plans)
+	if err != nil {
+		return fmt.Errorf("could not parse plans file: %s", err.Error())
+	}
+
+	for name, limits := range plans {
+		if limits.OwnedOrgs < UnlimitedOrgs || limits.Memberships < UnlimitedOrgs {
+			return fmt.Errorf("plan %q: org limits must be %d (unlimited) or more", name, UnlimitedOrgs)
+		}
+	}
+
+	planOrgLimits = plans
+
+	return nil
+}
+
+func GetUserOrgLimits(userId string) (OrgLimits, error) {
+	var plan sql.NullString
+
+	err := dbClient.QueryRow("SELECT plan FROM user WHERE id = ?", userId).Scan(&plan)
+	if err != nil {
+		return defaultOrgLimits, err
+	}
+
+	if limits, ok := planOrgLimits[plan.String]; plan.Valid && ok {
+		return limits, nil
+	}
+
+	return defaultOrgLimits, nil
+}
+
+func HasReachedOwnedOrgLimit(userId string) (bool, error) {
+	limits, err := GetUserOrgLimits(userId)
+	if err != nil {
+		return true, err
+	}
+
+	if limits.OwnedOrgs == UnlimitedOrgs {
+		return false, nil
+	}
+
+	var count int
+
+	err = dbClient.QueryRow("SELECT COUNT(id) FROM organisation WHERE creator_id = ?", userId).Scan(&count)
+	if err != nil {
+		return true, err
+	}
+
+	return count >= limits.OwnedOrgs, nil
+}
+
+func HasExceededLimit(userId string) (bool, error) {
+	limits, err := GetUserOrgLimits(userId)
+	if err != nil {
+		return true, err
+	}
+
+	if limits.Memberships == UnlimitedOrgs {
+		return false, nil
+	}
+
+	statement, err := dbClient.Prepare("SELECT COUNT(id) FROM org_members WHERE user_id = ? AND role != 'Owner'")
+
+	if err != nil {
+		return true, err
+	}
+
+	defer statement.Close()
+
+	var count int
+
+	err = statement.QueryRow(userId).Scan(&count)
+
+	if err != nil {
+		return true, err
+	}
+
+	return count >= limits.Memberships, nil
+
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// returned by UserExists for both unknown usernames and wrong passwords
+// the login endpoint must not tell the two apart or it can be used to find out which usernames exist
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type throttleRule struct {
+	// failures allowed inside the window before a lockout starts
+	threshold int
+	// how long a key has to stay quiet before its failure count resets
+	window time.Duration
+	// first lockout duration, doubled for every failure past the threshold
+	baseLockout time.Duration
+	maxLockout  time.Duration
+}
+
+// ip gets a higher threshold than username because many users can sit behind one NAT'd address
+var loginThrottleRules = map[string]throttleRule{
+	"ip": {
+		threshold:   20,
+		window:      15 * time.Minute,
+		baseLockout: time.Minute,
+		maxLockout:  time.Hour,
+	},
+	"username": {
+		threshold:   5,
+		window:      15 * time.Minute,
+		baseLockout: time.Minute,
+		maxLockout:  24 * time.Hour,
+	},
+	// passwords on public share links, keyed by the link id
+	"share": {
+		threshold:   10,
+		window:      15 * time.Minute,
+		baseLockout: time.Minute,
+		maxLockout:  time.Hour,
+	},
+}
+
+// returns the unix time until which a login from this ip or for this username is blocked
+// 0 means the login attempt can go ahead
+func LoginLockedUntil(ip string, username string) (int64, error) {
+	statement, err := dbClient.Prepare(`
+		SELECT COALESCE(MAX(locked_until), 0)
+		FROM login_throttle
+		WHERE (scope = 'ip' AND key = ?) OR (scope = 'username' AND key = ?)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	defer statement.Close()
+
+	var lockedUntil int64
+
+	err = statement.QueryRow(ip, normaliseLoginKey(username)).Scan(&lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	if lockedUntil <= time.Now().Unix() {
+		return 0, nil
+	}
+
+	return lockedUntil, nil
+}
+
+// records a failed login against both the ip and the username
+// if this failure locks the username, the account (if it exists) gets a notification
+func RecordFailedLogin(ip string, username string) error {
+	_, _, err := recordThrottleFailure("ip", ip)
+	if err != nil {
+		return err
+	}
+
+	lockedUntil, newlyLocked, err := recordThrottleFailure("username", normaliseLoginKey(username))
+	if err != nil {
+		return err
+	}
+
+	if newlyLocked {
+		notifyAccountLocked(username, lockedUntil)
+	}
+
+	return nil
+}
+
+// called after a successful login
+// only the username is cleared, clearing the ip would let an attacker with one valid account reset their own counter
+func ClearFailedLogins(username string) error {
+	statement, err := dbClient.Prepare("DELETE FROM login_throttle WHERE scope = 'username' AND key = ?")
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	_, err = statement.Exec(normaliseLoginKey(username))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// bumps the failure counter for a key and works out whether it is now locked
+// the second return value is true only when this failure is the one that started a new lockout
+func recordThrottleFailure(scope string, key string) (int64, bool, error) {
+	rule := loginThrottleRules[scope]
+	now := time.Now()
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer tx.Rollback()
+
+	var failures int
+	var lastFailureAt int64
+	var lockedUntil int64
+
+	err = tx.QueryRow("SELECT failures, last_failure_at, locked_until FROM login_throttle WHERE scope = ? AND key = ?", scope, key).Scan(&failures, &lastFailureAt, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	wasLocked := lockedUntil > now.Unix()
+
+	// the window is measured from whichever came last, the last failure or the end of the last lockout
+	// otherwise a lockout longer than the window would reset the count and the backoff would never grow
+	quietSince := max(lastFailureAt, lockedUntil)
+	if now.Unix()-quietSince > int64(rule.window.Seconds()) {
+		failures = 0
+	}
+
+	failures++
+
+	if failures >= rule.threshold {
+		exponent := float64(failures - rule.threshold)
+		lockout := time.Duration(float64(rule.baseLockout) * math.Pow(2, exponent))
+		if lockout > rule.maxLockout || lockout <= 0 {
+			lockout = rule.maxLockout
+		}
+		lockedUntil = now.Add(lockout).Unix()
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO login_throttle (scope, key, failures, last_failure_at, locked_until)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(scope, key) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure_at = excluded.last_failure_at,
+			locked_until = excluded.locked_until
+	`, scope, key, failures, now.Unix(), lockedUntil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
+	}
+
+	newlyLocked := !wasLocked && lockedUntil > now.Unix()
+
+	return lockedUntil, newlyLocked, nil
+}
+
+// usernames are looked up case sensitively but the throttle should not be bypassed by changing the case
+func normaliseLoginKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// lockouts are keyed on the submitted username whether it exists or not
+// so the notification is best effort and silently skipped for unknown usernames
+// the key ignores case, so every account it covers is locked and every one of them is told
+func notifyAccountLocked(username string, lockedUntil int64) {
+	rows, err := dbClient.Query("SELECT id FROM user WHERE username = ? COLLATE NOCASE", normaliseLoginKey(username))
+	if err != nil {
+		log.Printf("error: could not look up locked account: %v", err.Error())
+		return
+	}
+
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		err := rows.Scan(&userId)
+		if err != nil {
+			log.Printf("error: could not look up locked account: %v", err.Error())
+			continue
+		}
+		userIds = append(userIds, userId)
+	}
+
+	rows.Close()
+
+	for _, userId := range userIds {
+		err = SendNotificationToUser(userId, userId, EventAccountLocked, "Too many failed sign in attempts. Your account is locked until", EventPayload{UserID: userId, LockedUntil: lockedUntil})
+		if err != nil {
+			log.Printf("error: could not send out account locked notification: %v", err.Error())
+		}
+	}
+}
+
+// a key that has been quiet for longer than its window would start again from zero anyway, so its row can go
+// runs once straight away and then every interval for as long as the server is up
+func StartLoginThrottlePruning(interval time.Duration) {
+	go func() {
+		for {
+			pruned, err := PruneLoginThrottle(time.Now())
+			if err != nil {
+				log.Printf("error: could not prune the login throttle: %v", err.Error())
+			} else if pruned > 0 {
+				log.Printf("login throttle: pruned %d stale entries", pruned)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func PruneLoginThrottle(now time.Time) (int64, error) {
+	var pruned int64
+
+	for scope, rule := range loginThrottleRules {
+		// the same quiet period recordThrottleFailure uses to reset the count
+		result, err := dbClient.Exec(
+			"DELETE FROM login_throttle WHERE scope = ? AND MAX(last_failure_at, locked_until) < ?",
+			scope, now.Add(-rule.window).Unix(),
+		)
+		if err != nil {
+			return pruned, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return pruned, err
+		}
+
+		pruned += rowsAffected
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	NotificationChannelInApp       = "in_app"
+	NotificationChannelEmailDigest = "email_digest"
+	NotificationChannelOff         = "off"
+)
+
+var ErrFolderNotMuted = errors.New("folder is not muted")
+
+// an empty type is the member's default for every type in the org
+type NotificationPreference struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+}
+
+type MutedFolder struct {
+	FolderID   int64  `json:"folderId"`
+	FolderName string `json:"folderName"`
+	CreatedAt  int64  `json:"createdAt"`
+}
+
+func IsNotificationChannel(channel string) bool {
+	return channel == NotificationChannelInApp || channel == NotificationChannelEmailDigest || channel == NotificationChannelOff
+}
+
+// types without a row fall back to the org default, and without that to in_app
+func GetNotificationPreferences(userId string, orgId string) ([]NotificationPreference, error) {
+	preferences := []NotificationPreference{}
+
+	rows, err := dbClient.Query("SELECT type, channel FROM notification_preference WHERE user_id = ? AND org_id = ? ORDER BY type", userId, orgId)
+	if err != nil {
+		return preferences, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var preference NotificationPreference
+		err := rows.Scan(&preference.Type, &preference.Channel)
+		if err != nil {
+			continue
+		}
+		preferences = append(preferences, preference)
+	}
+
+	return preferences, rows.Err()
+}
+
+func SetNotificationPreference(userId string, orgId string, _type string, channel string) error {
+	_, err := dbClient.Exec(`
+		INSERT INTO notification_preference (user_id, org_id, type, channel) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, org_id, type) DO UPDATE SET channel = excluded.channel
+	`, userId, orgId, _type, channel)
+	return err
+}
+
+// the type goes back to following the org default, or the org default goes back to in_app
+func ClearNotificationPreference(userId string, orgId string, _type string) error {
+	_, err := dbClient.Exec("DELETE FROM notification_preference WHERE user_id = ? AND org_id = ? AND type = ?", userId, orgId, _type)
+	return err
+}
+
+func GetMutedFolders(userId string, orgId string) ([]MutedFolder, error) {
+	folders := []MutedFolder{}
+
+	rows, err := dbClient.Query(`
+		SELECT m.folder_id, folder.name, m.created_at
+		FROM notification_folder_mute m
+		JOIN folder ON folder.id = m.folder_id
+		WHERE m.user_id = ? AND folder.org_id = ?
+		ORDER BY folder.name
+	`, userId, orgId)
+	if err != nil {
+		return folders, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder MutedFolder
+		err := rows.Scan(&folder.FolderID, &folder.FolderName, &folder.CreatedAt)
+		if err != nil {
+			continue
+		}
+		folders = append(folders, folder)
+	}
+
+	return folders, rows.Err()
+}
+
+// muting a folder also mutes everything below it, muting it twice is a no-op
+func MuteFolder(userId string, orgId string, folderId string) error {
+	inOrg, err := ResourceInOrg(&Resource{Type: ResourceFolder, ID: folderId}, orgId)
+	if err != nil {
+		return err
+	}
+
+	if !inOrg {
+		return ErrFolderNotFound
+	}
+
+	_, err = dbClient.Exec(
+		"INSERT INTO notification_folder_mute (user_id, folder_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		userId, folderId, time.Now().Unix(),
+	)
+	return err
+}
+
+func UnmuteFolder(userId string, orgId string, folderId string) error {
+	result, err := dbClient.Exec(
+		"DELETE FROM notification_folder_mute WHERE user_id = ? AND folder_id IN (SELECT id FROM folder WHERE id = ? AND org_id = ?)",
+		userId, folderId, orgId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotMuted
+	}
+
+	return nil
+}
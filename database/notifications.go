@@ -1,99 +1,402 @@
 package database
 
-import "fmt"
-
-// type is a perserved keyword so its prefixed with an underscore
-func SendNotificationToOrgMembers(orgId string, actorId string, _type string, message string, payloadId string, payloadName string) error {
-
-	// a lot going on here
-	// with recipients is a temporary table to hold all the users and the creator of an organisation, this table is referenced when inserting notifications for users
-	// using a select in an insert will copy over the user ids from the recipients table as well as insert the data passed in as args into this function
-	// for each userId in the recipients table, the statement will insert (uid, .... args)
-	// see https://www.geeksforgeeks.org/sqlite-insert-into-select/ for insert with select
-	// the actor is excluded from this operation as the actor should not recieve a notification
-	statement, err := dbClient.Prepare(`
-		WITH recipients AS (
-		SELECT user_id AS uid
-			FROM org_members
-		WHERE org_id = ?
-		UNION
-		SELECT creator_id AS uid
-			FROM organisation
-		WHERE id = ?
+import (
+	"encoding/json"
+	"errors"
+	"fms/realtime"
+	"log"
+	"strings"
+	"time"
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// one notification going out to an org's members
+type Notify struct {
+	OrgID   string
+	ActorID string
+	// the members of one group instead of the whole org, empty for everyone
+	GroupID string
+	// only these users instead of the org or a group, such as the members who can approve a join request
+	UserIDs []string
+	// the actor doesn't hear about what they did themselves unless this is set
+	IncludeActor bool
+	// one of the org events in the catalogue, its notification type is what preferences are checked against
+	Event   string
+	Message string
+	// org_id, org_name, parent_folder_id and parent_path are filled in here, the rest is up to the caller
+	Payload EventPayload
+	// the folder the activity happened in, members who can't view it or muted it or a folder above it are skipped
+	// empty for the root of the org or anything that isn't about a folder
+	FolderID string
+}
+
+// fans the notification out to its recipients the way each of them asked for
+// a member's preference for the type in this org wins over their preference for the org as a whole, with neither it shows in the app
+// "off" and muted folders skip the member, "email_digest" keeps it for their next digest instead of showing it in the app
+// members who can't get a digest, with no verified email or after unsubscribing, get it in the app instead of not at all
+func NotifyOrg(n Notify) error {
+	eventType, err := GetEventType(n.Event)
+	if err != nil {
+		return err
+	}
+
+	n.Payload.OrgID = n.OrgID
+	if len(n.Payload.OrgName) == 0 {
+		n.Payload.OrgName = orgName(n.OrgID)
+	}
+
+	n.Payload.ParentFolderID = n.FolderID
+	n.Payload.ParentPath, err = getFolderPathEntries(n.FolderID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := encodeEventPayload(eventType, n.Payload)
+	if err != nil {
+		return err
+	}
+
+	payloadId, payloadName := eventType.legacy(n.Payload)
+
+	recipients := "SELECT user_id FROM org_members WHERE org_id = ?"
+	recipientArgs := []any{n.OrgID}
+
+	if n.UserIDs != nil {
+		userIds, err := json.Marshal(n.UserIDs)
+		if err != nil {
+			return err
+		}
+		recipients = "SELECT value FROM json_each(?)"
+		recipientArgs = []any{string(userIds)}
+	} else if len(n.GroupID) > 0 {
+		recipients = "SELECT gm.user_id FROM org_group_member gm JOIN org_group g ON g.id = gm.group_id WHERE g.id = ? AND g.org_id = ?"
+		recipientArgs = []any{n.GroupID, n.OrgID}
+	}
+
+	// the payload names the file or folder and the path to it, so nobody the folder's access list hides it from gets told
+	if len(n.FolderID) > 0 {
+		userIds, err := folderViewers(n.OrgID, n.FolderID, recipients, recipientArgs)
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(userIds)
+		if err != nil {
+			return err
+		}
+		recipients = "SELECT value FROM json_each(?)"
+		recipientArgs = []any{string(encoded)}
+	}
+
+	excludedId := n.ActorID
+	if n.IncludeActor {
+		excludedId = ""
+	}
+
+	// recipients holds everyone the notification is meant for, folder_path is the folder it happened in and every folder above it
+	// delivery pairs each recipient who hasn't muted anything on that path with the channel they want this type on
+	query := `
+		WITH RECURSIVE recipients(uid) AS (` + recipients + `),
+		folder_path(id, parent_id) AS (
+			SELECT id, parent_folder_id FROM folder WHERE id = ?
+			UNION ALL
+			SELECT folder.id, folder.parent_folder_id FROM folder JOIN folder_path ON folder.id = folder_path.parent_id
+		),
+		delivery(uid, channel) AS (
+			SELECT uid, COALESCE(
+				(SELECT channel FROM notification_preference WHERE user_id = uid AND org_id = ? AND type = ?),
+				(SELECT channel FROM notification_preference WHERE user_id = uid AND org_id = ? AND type = ''),
+				'in_app'
+			)
+			FROM recipients
+			WHERE uid != ?
+			AND NOT EXISTS (SELECT 1 FROM notification_folder_mute WHERE user_id = uid AND folder_id IN (SELECT id FROM folder_path))
 		)
 
 		INSERT INTO notification
-		(user_id, org_id, actor_id, type, message, payload_id, payload_name)
-		SELECT
-		uid,      
-		?,        
-		?,        
-		?,        
-		?,
-		?,
-		?         
-		FROM recipients
-		WHERE uid != ?
-	`)
+		(user_id, org_id, actor_id, type, event, message, payload_id, payload_name, payload, delivery)
+		SELECT uid, ?, ?, ?, ?, ?, ?, ?, ?, CASE
+			WHEN channel = 'email_digest' AND NOT EXISTS (
+				SELECT 1 FROM user WHERE id = uid AND email_verified_at IS NOT NULL AND digest_frequency != 'off'
+			) THEN 'in_app'
+			ELSE channel
+		END
+		FROM delivery
+		WHERE channel != 'off'
+		RETURNING id
+	`
+
+	notifType := eventType.NotificationType
+	args := append(recipientArgs, n.FolderID, n.OrgID, notifType, n.OrgID, excludedId, n.OrgID, n.ActorID, notifType, n.Event, n.Message, payloadId, payloadName, payload)
 
+	err = insertNotifications(query, args...)
 	if err != nil {
 		return err
 	}
 
-	defer statement.Close()
+	// the org's webhooks hear about it whoever the notification went to
+	err = enqueueWebhookEvent(n, payload)
+	if err != nil {
+		log.Printf("error: could not queue webhook event: %v", err.Error())
+	}
 
-	_, err = statement.Exec(orgId, orgId, orgId, actorId, _type, message, payloadId, payloadName, actorId)
+	return nil
+}
 
+// the recipients the query finds who are allowed to view the folder
+// anyone who has left the org since is dropped
+func folderViewers(orgId string, folderId string, recipients string, args []any) ([]string, error) {
+	rows, err := dbClient.Query(recipients, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	for rows.Next() {
+		var userId string
+		err := rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, userId)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	viewers := []string{}
+	for _, userId := range candidates {
+		access, err := LoadMemberFolderAccess(userId, orgId)
+		if err != nil {
+			if err == ErrNotOrgMember {
+				continue
+			}
+			return nil, err
+		}
+
+		if access.Allows(folderId, FolderPermissionView) {
+			viewers = append(viewers, userId)
+		}
+	}
+
+	return viewers, nil
+}
+
+// every member of the org apart from the actor
+func SendNotificationToOrgMembers(orgId string, actorId string, event string, message string, payload EventPayload) error {
+	return NotifyOrg(Notify{OrgID: orgId, ActorID: actorId, Event: event, Message: message, Payload: payload})
+}
+
+// notification for some of an org's members rather than all of them, such as the people who can approve a join request
+// the actor is skipped the same way as SendNotificationToOrgMembers
+func SendNotificationToOrgUsers(orgId string, userIds []string, actorId string, event string, message string, payload EventPayload) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+
+	return NotifyOrg(Notify{OrgID: orgId, UserIDs: userIds, ActorID: actorId, Event: event, Message: message, Payload: payload})
+}
+
+// notification for a single user, used for things that aren't tied to an org like account security alerts
+// the event has to be a user event from the catalogue, org_name is filled in when the payload names an org
+func SendNotificationToUser(userId string, actorId string, event string, message string, payload EventPayload) error {
+	eventType, err := GetEventType(event)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if len(payload.OrgID) > 0 && len(payload.OrgName) == 0 {
+		payload.OrgName = orgName(payload.OrgID)
+	}
+
+	encoded, err := encodeEventPayload(eventType, payload)
+	if err != nil {
+		return err
+	}
+
+	payloadId, payloadName := eventType.legacy(payload)
+
+	return insertNotifications(`
+		INSERT INTO notification
+		(user_id, org_id, actor_id, type, event, message, payload_id, payload_name, payload)
+		VALUES (?, NULL, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, userId, actorId, eventType.NotificationType, event, message, payloadId, payloadName, encoded)
+}
+
+// narrows down a page of notifications, every field is optional
+type NotificationFilter struct {
+	OrgID string
+	Type  string
+	Event string
+	// "read", "unread" or empty for both
+	ReadState string
+	// the id of the last notification on the previous page, 0 for the first page
+	Before int64
+	Limit  int
 }
 
-func GetUserNotifications(userId string) ([]Notification, error) {
-	var notifications []Notification
-	statement, err := dbClient.Prepare(`
+// newest first, the next cursor is nil on the last page
+// ids only ever go up so paging by id stays stable while new notifications come in
+func GetUserNotifications(userId string, filter NotificationFilter) ([]Notification, *int64, error) {
+	notifications := []Notification{}
+
+	where, args := notificationFilterClause(userId, filter)
+	if filter.Before > 0 {
+		where += " AND n.id < ?"
+		args = append(args, filter.Before)
+	}
+
+	// one extra row tells us whether there is another page
+	args = append(args, filter.Limit+1)
+
+	rows, err := dbClient.Query(`
 		SELECT
 			n.id,
+			COALESCE(n.org_id, ''),
 			u.username AS actor_username,
-			o.name AS org_name,
+			COALESCE(o.name, '') AS org_name,
 			n.message,
 			n.payload_name,
 			n.type,
+			COALESCE(n.event, ''),
+			COALESCE(n.payload, 'null'),
 			n.is_read,
 			n.created_at
 		FROM notification AS n
 		JOIN "user" AS u ON u.id = n.actor_id
-		JOIN organisation AS o ON o.id = n.org_id
-		WHERE n.user_id = ?
-		ORDER BY n.created_at DESC;
-	`)
+		LEFT JOIN organisation AS o ON o.id = n.org_id
+		WHERE `+where+`
+		ORDER BY n.id DESC
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return notifications, nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var notif Notification
+		err := rows.Scan(&notif.ID, &notif.OrgID, &notif.ActorUsername, &notif.OrgName, &notif.Message, &notif.Payload_name, &notif.NotifType, &notif.Event, &notif.Payload, &notif.IsRead, &notif.CreatedAt)
+		if err != nil {
+			return notifications, nil, err
+		}
+		notifications = append(notifications, notif)
+	}
 
+	err = rows.Err()
 	if err != nil {
-		fmt.Println(err.Error())
-		return notifications, err
+		return notifications, nil, err
 	}
 
-	defer statement.Close()
+	if len(notifications) <= filter.Limit {
+		return notifications, nil, nil
+	}
+
+	notifications = notifications[:filter.Limit]
+	next := int64(notifications[len(notifications)-1].ID)
 
-	rows, err := statement.Query(userId)
+	return notifications, &next, nil
+}
 
+// the filter's org and type apply, its read state and cursor don't
+func GetUnreadNotificationCount(userId string, filter NotificationFilter) (int, error) {
+	filter.ReadState = "unread"
+	where, args := notificationFilterClause(userId, filter)
+
+	var count int
+	err := dbClient.QueryRow("SELECT COUNT(*) FROM notification AS n WHERE "+where, args...).Scan(&count)
 	if err != nil {
-		fmt.Println(err.Error())
-		return notifications, err
+		return 0, err
 	}
 
-	for rows.Next() {
-		var notif Notification
-		err := rows.Scan(&notif.ID, &notif.ActorUsername, &notif.OrgName, &notif.Message, &notif.Payload_name, &notif.NotifType, &notif.IsRead, &notif.CreatedAt)
-		if err != nil {
-			fmt.Println(err.Error())
+	return count, nil
+}
+
+func notificationFilterClause(userId string, filter NotificationFilter) (string, []any) {
+	// digest notifications wait for the email and never show in the app
+	where := "n.user_id = ? AND n.delivery = 'in_app'"
+	args := []any{userId}
+
+	if len(filter.OrgID) > 0 {
+		where += " AND n.org_id = ?"
+		args = append(args, filter.OrgID)
+	}
+
+	if len(filter.Type) > 0 {
+		where += " AND n.type = ?"
+		args = append(args, filter.Type)
+	}
+
+	if len(filter.Event) > 0 {
+		where += " AND n.event = ?"
+		args = append(args, filter.Event)
+	}
+
+	switch filter.ReadState {
+	case "read":
+		where += " AND n.is_read = 1"
+	case "unread":
+		where += " AND n.is_read = 0"
+	}
+
+	return where, args
+}
+
+func DeleteNotification(id string, userId string) error {
+	result, err := dbClient.Exec("DELETE FROM notification WHERE id = ? AND user_id = ?", id, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotificationNotFound
+	}
+
+	return nil
+}
+
+// like marking them all read, notifications still waiting for the digest are left alone
+func DeleteAllNotifications(userId string) error {
+	_, err := dbClient.Exec("DELETE FROM notification WHERE user_id = ? AND delivery = 'in_app'", userId)
+	return err
+}
+
+// read notifications older than the retention are removed in the background, unread ones are kept however old they are
+// runs once straight away and then every interval for as long as the server is up
+func StartNotificationRetention(retention time.Duration, interval time.Duration) {
+	go func() {
+		for {
+			pruned, err := PruneReadNotifications(time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("error: could not prune old notifications: %v", err.Error())
+			} else if pruned > 0 {
+				log.Printf("notifications: pruned %d read notifications older than %s", pruned, retention)
+			}
+
+			time.Sleep(interval)
 		}
-		notifications = append(notifications, notif)
+	}()
+}
+
+func PruneReadNotifications(olderThan time.Time) (int64, error) {
+	// created_at is stored by sqlite's CURRENT_TIMESTAMP, which is utc in this format
+	result, err := dbClient.Exec("DELETE FROM notification WHERE is_read = 1 AND created_at < ?", olderThan.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
 	}
 
-	return notifications, nil
+	return result.RowsAffected()
 }
 
 func MarkAsRead(id string, userId string) error {
@@ -115,7 +418,8 @@ func MarkAsRead(id string, userId string) error {
 }
 
 func MarkAllAsRead(userId string) error {
-	statement, err := dbClient.Prepare("UPDATE notification SET is_read = 1 WHERE user_id = ?")
+	// notifications waiting for the user's digest aren't in the app, so they aren't theirs to mark yet
+	statement, err := dbClient.Prepare("UPDATE notification SET is_read = 1 WHERE user_id = ? AND delivery = 'in_app'")
 
 	if err != nil {
 		return err
@@ -131,3 +435,85 @@ func MarkAllAsRead(userId string) error {
 
 	return nil
 }
+
+// runs a notification insert that ends in RETURNING id, then pushes the new rows to their users
+func insertNotifications(query string, args ...any) error {
+	rows, err := dbClient.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	publishNotifications(ids)
+
+	return nil
+}
+
+// the rows go out in the same shape GetUserNotifications returns them so the client can put them straight into its list
+// the notification is already stored, so a failure here is only logged
+func publishNotifications(ids []int64) {
+	if len(ids) == 0 {
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			n.id,
+			n.user_id,
+			COALESCE(n.org_id, ''),
+			u.username,
+			COALESCE(o.name, ''),
+			n.message,
+			n.payload_name,
+			n.type,
+			COALESCE(n.event, ''),
+			COALESCE(n.payload, 'null'),
+			n.is_read,
+			n.created_at
+		FROM notification AS n
+		JOIN "user" AS u ON u.id = n.actor_id
+		LEFT JOIN organisation AS o ON o.id = n.org_id
+		WHERE n.id IN (`+placeholders+`) AND n.delivery = 'in_app'
+	`, args...)
+	if err != nil {
+		log.Printf("error: could not read notifications to publish: %v", err.Error())
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var notif Notification
+		var userId string
+		err := rows.Scan(&notif.ID, &userId, &notif.OrgID, &notif.ActorUsername, &notif.OrgName, &notif.Message, &notif.Payload_name, &notif.NotifType, &notif.Event, &notif.Payload, &notif.IsRead, &notif.CreatedAt)
+		if err != nil {
+			log.Printf("error: could not read notification to publish: %v", err.Error())
+			continue
+		}
+
+		realtime.Publish(realtime.Event{Type: "notification", OrgID: notif.OrgID, UserID: userId, Data: notif})
+	}
+}
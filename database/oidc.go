@@ -0,0 +1,228 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type OIDCLoginState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	// set when a logged in user started the flow to link the identity to their existing account
+	LinkUserID string
+	RedirectTo string
+}
+
+// long enough to get through an identity provider's login page including mfa
+const oidcLoginStateTTL = 10 * time.Minute
+
+func SaveOIDCLoginState(state string, loginState OIDCLoginState) error {
+	statement, err := dbClient.Prepare(`
+		INSERT INTO oidc_login_state (id, provider, nonce, code_verifier, link_user_id, redirect_to, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	_, err = statement.Exec(
+		HashToken(state),
+		loginState.Provider,
+		loginState.Nonce,
+		loginState.CodeVerifier,
+		nullableString(loginState.LinkUserID),
+		loginState.RedirectTo,
+		time.Now().Add(oidcLoginStateTTL).Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// looks up and deletes the state in one go so a callback can never be replayed
+func ConsumeOIDCLoginState(state string, provider string) (OIDCLoginState, error) {
+	var loginState OIDCLoginState
+	var linkUserId sql.NullString
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return loginState, err
+	}
+
+	defer tx.Rollback()
+
+	// abandoned logins are never consumed, so they are cleaned up here rather than needing a separate job
+	_, err = tx.Exec("DELETE FROM oidc_login_state WHERE expires_at < ?", time.Now().Unix())
+	if err != nil {
+		return loginState, err
+	}
+
+	err = tx.QueryRow(
+		"SELECT provider, nonce, code_verifier, link_user_id, redirect_to FROM oidc_login_state WHERE id = ? AND provider = ?",
+		HashToken(state), provider,
+	).Scan(&loginState.Provider, &loginState.Nonce, &loginState.CodeVerifier, &linkUserId, &loginState.RedirectTo)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return OIDCLoginState{}, ErrInvalidToken
+		}
+		return OIDCLoginState{}, err
+	}
+
+	_, err = tx.Exec("DELETE FROM oidc_login_state WHERE id = ?", HashToken(state))
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+
+	loginState.LinkUserID = linkUserId.String
+
+	return loginState, nil
+}
+
+// returns the fms user linked to an identity, or an empty string if there isn't one
+func GetUserIdByIdentity(issuer string, subject string) (string, error) {
+	var userId string
+
+	err := dbClient.QueryRow("SELECT user_id FROM user_identity WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return userId, nil
+}
+
+func LinkIdentity(userId string, issuer string, subject string, email string) error {
+	statement, err := dbClient.Prepare("INSERT INTO user_identity (user_id, issuer, subject, email) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+
+	_, err = statement.Exec(userId, issuer, subject, nullableString(email))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("this identity is already linked to another account")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// returns the user whose verified email matches, or an empty string if there isn't one
+func GetUserIdByVerifiedEmail(email string) (string, error) {
+	var userId string
+
+	err := dbClient.QueryRow("SELECT id FROM user WHERE email = ? COLLATE NOCASE AND email_verified_at IS NOT NULL", email).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return userId, nil
+}
+
+var usernameDisallowedChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// just in time provisioning for a first sso login
+// the account has no password, an empty hash never matches so it can only sign in through its linked identity until a reset sets one
+func CreateExternalUser(preferredUsername string, email string, emailVerified bool) (string, error) {
+	username, err := generateUniqueUsername(preferredUsername)
+	if err != nil {
+		return "", err
+	}
+
+	// an email the provider hasn't verified could belong to someone else, so it isn't stored at all
+	// and a verified one that is already taken by another account is left off rather than failing the login
+	if !emailVerified {
+		email = ""
+	}
+
+	if len(email) > 0 {
+		existing, err := GetUserIdByVerifiedEmail(email)
+		if err != nil {
+			return "", err
+		}
+		if len(existing) > 0 {
+			email = ""
+		}
+	}
+
+	var verifiedAt sql.NullInt64
+	if len(email) > 0 {
+		verifiedAt = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+	}
+
+	userId := uuid.New().String()
+
+	statement, err := dbClient.Prepare("INSERT INTO user (id, username, password, email, email_verified_at) VALUES (?, ?, '', ?, ?)")
+	if err != nil {
+		return "", err
+	}
+
+	defer statement.Close()
+
+	_, err = statement.Exec(userId, username, nullableString(email), verifiedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return "", ErrEmailTaken
+		}
+		return "", err
+	}
+
+	return userId, nil
+}
+
+// usernames have to fit the same 6 to 12 character rule as sign ups
+// the preferred name is cleaned up and cut down, then a random number is added until it is free
+func generateUniqueUsername(preferred string) (string, error) {
+	base := usernameDisallowedChars.ReplaceAllString(preferred, "")
+	if len(base) > 8 {
+		base = base[:8]
+	}
+	if len(base) < 2 {
+		base = "user"
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+
+		candidate := fmt.Sprintf("%s%04d", base, suffix.Int64())
+
+		exists, err := UsernameExists(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not generate a free username")
+}
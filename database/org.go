@@ -7,9 +7,10 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func CreateOrg(userId string, orgName string) (int64, error) {
+func CreateOrg(userId string, orgName string, actor AuditActor) (int64, error) {
 
 	// do a case insensitive lookup for the org name to see if its taken or not (Org and ORG go through the unique constraint)
 	statement, err := dbClient.Prepare("SELECT EXISTS(SELECT name FROM organisation WHERE name LIKE ? COLLATE NOCASE)")
@@ -17,6 +18,8 @@ func CreateOrg(userId string, orgName string) (int64, error) {
 		return 0, err
 	}
 
+	defer statement.Close()
+
 	var exists bool
 
 	err = statement.QueryRow(orgName).Scan(&exists)
@@ -28,31 +31,14 @@ func CreateOrg(userId string, orgName string) (int64, error) {
 		return 0, fmt.Errorf("organisation with this name already exists")
 	}
 
-	// verify that the user does not already have an org created
-	statement, err = dbClient.Prepare("SELECT id FROM organisation WHERE creator_id = ?")
+	// the number of orgs a user can create depends on their plan
+	reachedLimit, err := HasReachedOwnedOrgLimit(userId)
 	if err != nil {
 		return 0, err
 	}
 
-	defer statement.Close()
-
-	var orgId string
-
-	row := statement.QueryRow(userId)
-
-	err = row.Scan(&orgId)
-
-	// sql returns an error if no rows are found
-	// server catches this error to prevent an early exit from the function
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return 0, err
-		}
-	}
-
-	// if an orgid exists, an org exists, therefore the server returns an error
-	if len(orgId) != 0 {
-		return 0, fmt.Errorf("org limit exceeded. Users are only allowed to create one Org")
+	if reachedLimit {
+		return 0, ErrOrgLimitReached
 	}
 
 	// THIS MUST BE A TRANSACTION SO IF FOLDER CREATION FAILS WE REVERT THE ORG CREATION
@@ -69,6 +55,8 @@ func CreateOrg(userId string, orgName string) (int64, error) {
 		return 0, err
 	}
 
+	defer statement.Close()
+
 	result, err := statement.Exec(orgName, userId)
 
 	if err != nil {
@@ -85,6 +73,12 @@ func CreateOrg(userId string, orgName string) (int64, error) {
 		return 0, fmt.Errorf("unknown error occured")
 	}
 
+	// the creator is the org's first owner
+	_, err = tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)", rowId, userId, RoleOwner)
+	if err != nil {
+		return 0, err
+	}
+
 	// attempt to create a directory for the org
 	err = ioOperations.CreateOrgDir(strconv.FormatInt(rowId, 10))
 
@@ -99,6 +93,17 @@ func CreateOrg(userId string, orgName string) (int64, error) {
 		return 0, err
 	}
 
+	orgId := strconv.FormatInt(rowId, 10)
+
+	// the first event in the org's chain
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "org.created",
+		TargetType: "org",
+		TargetID:   orgId,
+		After:      map[string]any{"name": orgName, "ownerId": userId},
+	})
+
 	return rowId, nil
 
 }
@@ -112,11 +117,12 @@ func GetOrgById(orgId string) *Organisation {
             o.name,
             o.creator_id,
             COALESCE(SUM(f.size), 0),
-            (SELECT COUNT(*) FROM org_members WHERE org_id = o.id)
+            (SELECT COUNT(*) FROM org_members WHERE org_id = o.id),
+            o.discoverable
         FROM organisation o
         LEFT JOIN file f ON o.id = f.org_id
         WHERE o.id = ?
-        GROUP BY o.id, o.name, o.creator_id;
+        GROUP BY o.id, o.name, o.creator_id, o.discoverable;
     `)
 	if err != nil {
 		return nil
@@ -129,6 +135,7 @@ func GetOrgById(orgId string) *Organisation {
 		&organisation.Creator_id,
 		&organisation.Storage_used,
 		&organisation.MemberCount,
+		&organisation.Discoverable,
 	)
 
 	if err != nil {
@@ -139,40 +146,32 @@ func GetOrgById(orgId string) *Organisation {
 
 }
 
-func CanViewOrg(userId string, orgId string) (bool, string, error) {
-	statement, err := dbClient.Prepare("SELECT o.creator_id, m.role FROM organisation o LEFT JOIN org_members m ON m.org_id = o.id AND m.user_id = ? WHERE o.id = ?")
-
+// every org the user is an owner of
+// every org the user is a member of, whatever their role
+func GetUserOrgIds(userId string) ([]string, error) {
+	rows, err := dbClient.Query("SELECT org_id FROM org_members WHERE user_id = ?", userId)
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
 
-	var memberRole sql.NullString
-	var creatorId string
+	defer rows.Close()
 
-	defer statement.Close()
+	var orgIds []string
 
-	err = statement.QueryRow(userId, orgId).Scan(&creatorId, &memberRole)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, "", nil
+	for rows.Next() {
+		var orgId string
+		err := rows.Scan(&orgId)
+		if err != nil {
+			return nil, err
 		}
-		return false, "", err
-	}
-
-	if creatorId == userId {
-		return true, "owner", nil
-	}
-
-	if memberRole.Valid {
-		return true, memberRole.String, nil
+		orgIds = append(orgIds, orgId)
 	}
 
-	return false, "", nil
-
+	return orgIds, rows.Err()
 }
 
-func GetUserOrg(userId string) *Organisation {
-	var organisation Organisation
+func GetOwnedOrgs(userId string) []*Organisation {
+	var organisations []*Organisation
 
 	// using coalesce here on size so if the org is empty size is 0 not null
 	statement, err := dbClient.Prepare(`
@@ -183,31 +182,63 @@ func GetUserOrg(userId string) *Organisation {
 		COALESCE(SUM(f.size), 0),
 		(SELECT COUNT(*) FROM org_members WHERE org_id = o.id)
 		FROM organisation o
+		JOIN org_members m ON m.org_id = o.id AND m.user_id = ? AND m.role = 'Owner'
 		LEFT JOIN file f ON o.id = f.org_id
-		WHERE o.creator_id = ?
-		GROUP BY o.id, o.name, o.creator_id;
+		GROUP BY o.id, o.name, o.creator_id
+		ORDER BY o.id;
 	`)
 	if err != nil {
 		return nil
 	}
 	defer statement.Close()
 
-	err = statement.QueryRow(userId).Scan(&organisation.ID, &organisation.Name, &organisation.Creator_id, &organisation.Storage_used, &organisation.MemberCount)
-
+	rows, err := statement.Query(userId)
 	if err != nil {
 		return nil
 	}
 
-	return &organisation
+	defer rows.Close()
+
+	for rows.Next() {
+		var organisation Organisation
+		err := rows.Scan(&organisation.ID, &organisation.Name, &organisation.Creator_id, &organisation.Storage_used, &organisation.MemberCount)
+		if err != nil {
+			continue
+		}
+		organisations = append(organisations, &organisation)
+	}
+
+	return organisations
 }
 
-func InviteUserToOrg(username string, ownerId string, orgId string) error {
+// the caller must already hold member.invite in the org, anyone with it can invite so the org is no longer looked up through its creator
+// an expired invite for the same user is replaced, a pending one is left alone and ErrAlreadyInvited is returned
+// role is what the invitee joins as, the caller has already checked they are allowed to hand it out
+func InviteUserToOrg(username string, inviterId string, orgId string, role string, actor AuditActor) error {
+	now := time.Now()
+
+	isMember, err := isOrgMemberByUsername(orgId, username)
+	if err != nil {
+		return err
+	}
+
+	if isMember {
+		return ErrAlreadyMember
+	}
 
 	statement, err := dbClient.Prepare(`
-		INSERT INTO org_invites (org_id, user_id) 
-		SELECT organisation.id, user.id 
+		INSERT INTO org_invites (org_id, user_id, invited_by, role, expires_at, last_sent_at) 
+		SELECT organisation.id, user.id, ?, ?, ?, ?
 		FROM organisation, user  
-		WHERE organisation.creator_id = ? AND user.username = ?
+		WHERE organisation.id = ? AND user.username = ?
+		ON CONFLICT(org_id, user_id) DO UPDATE SET
+			status = 'pending',
+			invited_at = CURRENT_TIMESTAMP,
+			invited_by = excluded.invited_by,
+			role = excluded.role,
+			expires_at = excluded.expires_at,
+			last_sent_at = excluded.last_sent_at
+		WHERE org_invites.expires_at <= ?
 	`)
 
 	if err != nil {
@@ -216,7 +247,7 @@ func InviteUserToOrg(username string, ownerId string, orgId string) error {
 
 	defer statement.Close()
 
-	result, err := statement.Exec(ownerId, username)
+	result, err := statement.Exec(inviterId, role, now.Add(orgInviteTTL).Unix(), now.Unix(), orgId, username, now.Unix())
 
 	if err != nil {
 		return err
@@ -228,39 +259,47 @@ func InviteUserToOrg(username string, ownerId string, orgId string) error {
 		return err
 	}
 
+	// either the username doesn't exist or they already have an invite that hasn't expired
 	if rowsAffected == 0 {
-		return fmt.Errorf("operation failed. Please try again later")
+		return ErrAlreadyInvited
 	}
 
-	rowId, err := result.LastInsertId()
-
-	// don't want the upload function to error out if we are unable to send out a notification because the operation itself worked
+	// the upsert doesn't give back a usable row id when it updates an expired invite, so the invitee is looked up instead
+	var inviteeId string
+	err = dbClient.QueryRow("SELECT id FROM user WHERE username = ?", username).Scan(&inviteeId)
 	if err != nil {
-		log.Printf("error: could not read file ID: %v", err.Error())
+		log.Printf("error: could not read invitee id: %v", err.Error())
 	}
 
-	// convert the id to a string
-	payloadID := strconv.FormatInt(rowId, 10)
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite.created",
+		TargetType: "member",
+		TargetID:   inviteeId,
+		After:      map[string]any{"username": username, "role": role, "expiresAt": now.Add(orgInviteTTL).Unix()},
+	})
 
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, ownerId, "invite", "Has been invited to join", payloadID, username)
+	err = SendNotificationToOrgMembers(orgId, inviterId, EventMemberInvited, "Has been invited to join", EventPayload{UserID: inviteeId, Username: username, Role: role})
 	if err != nil {
 		log.Printf("error: could not send out notification to join org: %v", err.Error())
 	}
 
+	notifyInvitee(orgId, inviterId, username, "Invited you to join")
+
 	return nil
 
 }
 
-func AddMemberToOrg(userId string, orgId string, username string) error {
-	statement, err := dbClient.Prepare("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, 'Editor')")
+func AddMemberToOrg(userId string, orgId string, username string, role string, actor AuditActor) error {
+	statement, err := dbClient.Prepare("INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
 
 	defer statement.Close()
 
-	result, err := statement.Exec(orgId, userId)
+	result, err := statement.Exec(orgId, userId, role)
 	if err != nil {
 		return err
 	}
@@ -274,19 +313,17 @@ func AddMemberToOrg(userId string, orgId string, username string) error {
 	if rowsAffected == 0 {
 		return fmt.Errorf("operation failed. Please try again later")
 	}
-	// get the file id of the inserted row
-	rowId, err := result.LastInsertId()
-
-	// don't want the upload function to error out if we are unable to send out a notification because the operation itself worked
-	if err != nil {
-		log.Printf("error: could not read file ID: %v", err.Error())
-	}
 
-	// convert the id to a string
-	payloadID := strconv.FormatInt(rowId, 10)
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "member.joined",
+		TargetType: "member",
+		TargetID:   userId,
+		After:      map[string]any{"username": username, "role": role},
+	})
 
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "join org", "Is now a member of", payloadID, username)
+	err = SendNotificationToOrgMembers(orgId, userId, EventMemberJoined, "Is now a member of", EventPayload{UserID: userId, Username: username})
 	if err != nil {
 		log.Printf("error: could not send out notification to join org: %v", err.Error())
 	}
@@ -342,7 +379,7 @@ func GetJoinedOrgs(userId string) []*JoinedOrganisation {
 		FROM organisation
 		JOIN org_members ON org_members.org_id = organisation.id
 		JOIN user ON user.id = organisation.creator_id
-		WHERE org_members.user_id = ?
+		WHERE org_members.user_id = ? AND org_members.role != 'Owner'
   	`)
 
 	if err != nil {
@@ -369,7 +406,14 @@ func GetJoinedOrgs(userId string) []*JoinedOrganisation {
 	return organisations
 }
 
-func ChangeOrgName(orgId string, orgName string, userId string) error {
+func ChangeOrgName(orgId string, orgName string, userId string, actor AuditActor) error {
+	// orgName is the new name here, the current one is read before it changes
+	var previousName string
+	err := dbClient.QueryRow("SELECT name FROM organisation WHERE id = ?", orgId).Scan(&previousName)
+	if err != nil {
+		return err
+	}
+
 	statement, err := dbClient.Prepare("UPDATE organisation SET name = ? WHERE id = ?")
 
 	if err != nil {
@@ -393,8 +437,17 @@ func ChangeOrgName(orgId string, orgName string, userId string) error {
 		return fmt.Errorf("unable to update name. please try again later")
 	}
 
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "org.renamed",
+		TargetType: "org",
+		TargetID:   orgId,
+		Before:     map[string]any{"name": previousName},
+		After:      map[string]any{"name": orgName},
+	})
+
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "org name", "Changed Org Name To", orgId, orgName)
+	err = SendNotificationToOrgMembers(orgId, userId, EventOrgRenamed, "Changed Org Name To", EventPayload{OrgName: orgName})
 	if err != nil {
 		log.Printf("error: could not send out notification for org name change: %v", err.Error())
 	}
@@ -402,63 +455,263 @@ func ChangeOrgName(orgId string, orgName string, userId string) error {
 	return nil
 }
 
-func ChangeOrgMemberRole(userId string, memberUsername string, newRole string) error {
-	statement, err := dbClient.Prepare("UPDATE org_members SET role = ? WHERE user_id = (SELECT id FROM user WHERE username = ?) AND org_id = (SELECT id FROM organisation WHERE creator_id = ?)")
+// whether the caller may make this change is checked by the handler with CanManageMember
+// demoting the last owner fails with ErrLastOwner
+func ChangeOrgMemberRole(orgId string, memberUsername string, newRole string, actor AuditActor) error {
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
 
+	memberId, currentRole, err := getMemberForUpdate(tx, orgId, memberUsername)
 	if err != nil {
 		return err
 	}
 
-	defer statement.Close()
+	if currentRole == RoleOwner && newRole != RoleOwner {
+		err = ensureAnotherOwner(tx, orgId, memberId)
+		if err != nil {
+			return err
+		}
+	}
 
-	result, err := statement.Exec(newRole, memberUsername, userId)
+	_, err = tx.Exec("UPDATE org_members SET role = ? WHERE user_id = ? AND org_id = ?", newRole, memberId, orgId)
+	if err != nil {
+		return err
+	}
+
+	if newRole != RoleOwner {
+		err = handOverCreator(tx, orgId, memberId)
+		if err != nil {
+			return err
+		}
+	}
 
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "member.role_changed",
+		TargetType: "member",
+		TargetID:   memberId,
+		Before:     map[string]any{"username": memberUsername, "role": currentRole},
+		After:      map[string]any{"username": memberUsername, "role": newRole},
+	})
+
+	return nil
+}
 
+// removing the last owner fails with ErrLastOwner
+func RemoveOrgMember(orgId string, memberUsername string, actor AuditActor) error {
+	tx, err := dbClient.Begin()
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("something went wrong. please try again later")
+	defer tx.Rollback()
+
+	memberId, currentRole, err := getMemberForUpdate(tx, orgId, memberUsername)
+	if err != nil {
+		return err
 	}
 
+	if currentRole == RoleOwner {
+		err = ensureAnotherOwner(tx, orgId, memberId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = removeMembership(tx, orgId, memberId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "member.removed",
+		TargetType: "member",
+		TargetID:   memberId,
+		Before:     map[string]any{"username": memberUsername, "role": currentRole},
+	})
+
 	return nil
 }
 
-func RemoveOrgMember(userId string, memberUsername string) error {
-	statement, err := dbClient.Prepare("DELETE FROM org_members WHERE user_id = (SELECT id FROM user WHERE username = ?) AND org_id = (SELECT id FROM organisation WHERE creator_id = ?)")
+// self service version of RemoveOrgMember, the last owner has to hand the org over or delete it instead
+func LeaveOrg(orgId string, userId string, username string, actor AuditActor) error {
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
 
+	defer tx.Rollback()
+
+	var role string
+
+	err = tx.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgId, userId).Scan(&role)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotOrgMember
+		}
 		return err
 	}
 
-	defer statement.Close()
+	if role == RoleOwner {
+		err = ensureAnotherOwner(tx, orgId, userId)
+		if err != nil {
+			return err
+		}
+	}
 
-	result, err := statement.Exec(memberUsername, userId)
+	err = removeMembership(tx, orgId, userId)
+	if err != nil {
+		return err
+	}
 
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "member.left",
+		TargetType: "member",
+		TargetID:   userId,
+		Before:     map[string]any{"username": username, "role": role},
+	})
+
+	// the leaver is no longer a member so they are left out of this automatically
+	err = SendNotificationToOrgMembers(orgId, userId, EventMemberLeft, "Has left", EventPayload{UserID: userId, Username: username})
+	if err != nil {
+		log.Printf("error: could not send out notification for leaving org: %v", err.Error())
+	}
+
+	return nil
+}
 
+// everything that goes when a user stops being a member, whether they left or were removed
+// files and folders they uploaded belong to the org and stay
+// group memberships, access list entries naming them and ownership transfers they are part of are dropped so they don't come back to life if the user rejoins
+// share links they made stop working since nobody in the org is answerable for them any more
+func removeMembership(tx *sql.Tx, orgId string, userId string) error {
+	_, err := tx.Exec("DELETE FROM org_members WHERE user_id = ? AND org_id = ?", userId, orgId)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("something went wrong. please try again later")
+	_, err = tx.Exec(`
+		DELETE FROM folder_acl
+		WHERE principal_type = 'user' AND principal_id = ?
+		AND folder_id IN (SELECT id FROM folder WHERE org_id = ?)
+	`, userId, orgId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM org_group_member WHERE user_id = ? AND group_id IN (SELECT id FROM org_group WHERE org_id = ?)", userId, orgId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE share_link SET revoked_at = CAST(strftime('%s', 'now') AS INTEGER) WHERE org_id = ? AND created_by = ? AND revoked_at IS NULL", orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE file_request_link SET revoked_at = CAST(strftime('%s', 'now') AS INTEGER) WHERE org_id = ? AND created_by = ? AND revoked_at IS NULL", orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM resource_grant WHERE org_id = ? AND granted_by = ?", orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM notification_preference WHERE org_id = ? AND user_id = ?", orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM notification_folder_mute WHERE user_id = ? AND folder_id IN (SELECT id FROM folder WHERE org_id = ?)", userId, orgId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM org_ownership_transfer WHERE org_id = ? AND (from_user_id = ? OR to_user_id = ?)", orgId, userId, userId)
+	if err != nil {
+		return err
+	}
+
+	return handOverCreator(tx, orgId, userId)
+}
+
+func getMemberForUpdate(tx *sql.Tx, orgId string, username string) (string, string, error) {
+	var memberId string
+	var role string
+
+	err := tx.QueryRow(`
+		SELECT org_members.user_id, org_members.role FROM org_members
+		JOIN user ON user.id = org_members.user_id
+		WHERE org_members.org_id = ? AND user.username = ?
+	`, orgId, username).Scan(&memberId, &role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", ErrNotOrgMember
+		}
+		return "", "", err
+	}
+
+	return memberId, role, nil
+}
+
+func ensureAnotherOwner(tx *sql.Tx, orgId string, userId string) error {
+	var owners int
+
+	err := tx.QueryRow("SELECT COUNT(id) FROM org_members WHERE org_id = ? AND role = 'Owner' AND user_id != ?", orgId, userId).Scan(&owners)
+	if err != nil {
+		return err
+	}
+
+	if owners == 0 {
+		return ErrLastOwner
 	}
 
 	return nil
 }
 
-func DeleteOrg(orgId string) error {
+// creator_id is the owner the org counts against for plan limits, and deleting that user deletes the org
+// when they stop being an owner it moves to the longest serving remaining owner
+func handOverCreator(tx *sql.Tx, orgId string, userId string) error {
+	_, err := tx.Exec(`
+		UPDATE organisation SET creator_id = (
+			SELECT user_id FROM org_members
+			WHERE org_id = organisation.id AND role = 'Owner' AND user_id != ?
+			ORDER BY joined_at, id
+			LIMIT 1
+		)
+		WHERE id = ? AND creator_id = ?
+		AND EXISTS (SELECT 1 FROM org_members WHERE org_id = organisation.id AND role = 'Owner' AND user_id != ?)
+	`, userId, orgId, userId, userId)
+
+	return err
+}
+
+// the audit log is kept, it isn't tied to the org's row so it outlives it
+func DeleteOrg(orgId string, actor AuditActor) error {
+	name := orgName(orgId)
 
 	statement, err := dbClient.Prepare("DELETE FROM organisation WHERE id = ?")
 
@@ -484,6 +737,14 @@ func DeleteOrg(orgId string) error {
 		return fmt.Errorf("organisation not found or already deleted")
 	}
 
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "org.deleted",
+		TargetType: "org",
+		TargetID:   orgId,
+		Before:     map[string]any{"name": name},
+	})
+
 	// attempt to remove the org's directory
 	err = ioOperations.DeleteOrgDir(orgId)
 	if err != nil {
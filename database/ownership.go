@@ -0,0 +1,320 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// how long the nominated member has to accept before the owner has to ask again
+const ownershipTransferTTL = 7 * 24 * time.Hour
+
+var (
+	ErrNotOrgMember          = errors.New("user is not a member of this organisation")
+	ErrAlreadyOwner          = errors.New("user is already an owner of this organisation")
+	ErrTransferNotFound      = errors.New("ownership transfer not found or expired")
+	ErrOwnsOrgWithMembers    = errors.New("transfer ownership of your organisations that still have members before deleting your account")
+	ErrTransferLimitExceeded = errors.New("accepting would take you over the organisation limit for your plan")
+)
+
+// an owner handing their own ownership to a member who isn't an owner yet
+// starting a transfer replaces any transfer the org already has pending
+// owners who just want to share ownership can change the member's role instead
+func NominateOwner(orgId string, ownerId string, username string, actor AuditActor) error {
+	var memberId string
+	var role string
+
+	err := dbClient.QueryRow(`
+		SELECT user.id, org_members.role FROM org_members
+		JOIN user ON user.id = org_members.user_id
+		WHERE org_members.org_id = ? AND user.username = ?
+	`, orgId, username).Scan(&memberId, &role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotOrgMember
+		}
+		return err
+	}
+
+	if role == RoleOwner {
+		return ErrAlreadyOwner
+	}
+
+	now := time.Now()
+
+	_, err = dbClient.Exec(`
+		INSERT INTO org_ownership_transfer (org_id, from_user_id, to_user_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(org_id) DO UPDATE SET
+			from_user_id = excluded.from_user_id,
+			to_user_id = excluded.to_user_id,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at
+	`, orgId, ownerId, memberId, now.Unix(), now.Add(ownershipTransferTTL).Unix())
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "ownership_transfer.requested",
+		TargetType: "member",
+		TargetID:   memberId,
+		After:      map[string]any{"fromUserId": ownerId, "toUsername": username, "expiresAt": now.Add(ownershipTransferTTL).Unix()},
+	})
+
+	err = SendNotificationToUser(memberId, ownerId, EventOwnershipTransferSent, "Wants to make you the owner of", EventPayload{OrgID: orgId})
+	if err != nil {
+		log.Printf("error: could not send out ownership transfer notification: %v", err.Error())
+	}
+
+	return nil
+}
+
+func CancelOwnershipTransfer(orgId string, actor AuditActor) error {
+	var toUserId string
+	err := dbClient.QueryRow("SELECT to_user_id FROM org_ownership_transfer WHERE org_id = ?", orgId).Scan(&toUserId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTransferNotFound
+		}
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM org_ownership_transfer WHERE org_id = ?", orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTransferNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "ownership_transfer.cancelled",
+		TargetType: "member",
+		TargetID:   toUserId,
+		Before:     map[string]any{"toUserId": toUserId},
+	})
+
+	return nil
+}
+
+// pending transfers the user has been nominated for
+func GetIncomingOwnershipTransfers(userId string) ([]OwnershipTransfer, error) {
+	transfers := []OwnershipTransfer{}
+
+	rows, err := dbClient.Query(`
+		SELECT t.id, t.org_id, o.name, u.username, t.created_at, t.expires_at
+		FROM org_ownership_transfer t
+		JOIN organisation o ON o.id = t.org_id
+		JOIN user u ON u.id = t.from_user_id
+		WHERE t.to_user_id = ? AND t.expires_at > ?
+		ORDER BY t.created_at DESC
+	`, userId, time.Now().Unix())
+	if err != nil {
+		return transfers, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var transfer OwnershipTransfer
+		err := rows.Scan(&transfer.ID, &transfer.OrgID, &transfer.OrgName, &transfer.FromUsername, &transfer.CreatedAt, &transfer.ExpiresAt)
+		if err != nil {
+			continue
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
+
+// swaps the two users' roles in one transaction, the nominee becomes an owner and the previous owner takes the nominee's old role
+// if the previous owner was the one the org counts against for plan limits, that moves to the nominee too
+// the previous owner's membership limit isn't checked, they were already part of the org
+func AcceptOwnershipTransfer(transferId string, userId string, actor AuditActor) error {
+	var orgId string
+	var fromUserId string
+	var creatorId string
+
+	err := dbClient.QueryRow(`
+		SELECT t.org_id, t.from_user_id, o.creator_id FROM org_ownership_transfer t
+		JOIN organisation o ON o.id = t.org_id
+		WHERE t.id = ? AND t.to_user_id = ? AND t.expires_at > ?
+	`, transferId, userId, time.Now().Unix()).Scan(&orgId, &fromUserId, &creatorId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTransferNotFound
+		}
+		return err
+	}
+
+	if creatorId == fromUserId {
+		reachedLimit, err := HasReachedOwnedOrgLimit(userId)
+		if err != nil {
+			return err
+		}
+
+		if reachedLimit {
+			return ErrTransferLimitExceeded
+		}
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// the nominating owner may have been demoted or removed since
+	var fromRole string
+
+	err = tx.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgId, fromUserId).Scan(&fromRole)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if fromRole != RoleOwner {
+		return ErrTransferNotFound
+	}
+
+	var role string
+
+	err = tx.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgId, userId).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotOrgMember
+		}
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE org_members SET role = ? WHERE org_id = ? AND user_id = ?", RoleOwner, orgId, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE org_members SET role = ? WHERE org_id = ? AND user_id = ?", role, orgId, fromUserId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE organisation SET creator_id = ? WHERE id = ? AND creator_id = ?", userId, orgId, fromUserId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM org_ownership_transfer WHERE id = ?", transferId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "ownership_transfer.accepted",
+		TargetType: "member",
+		TargetID:   userId,
+		Before:     map[string]any{"ownerId": fromUserId, "role": role},
+		After:      map[string]any{"ownerId": userId, "previousOwnerRole": role},
+	})
+
+	newOwner, err := GetUsernameById(userId)
+	if err != nil {
+		log.Printf("error: could not read new owner's username: %v", err.Error())
+	}
+
+	err = SendNotificationToOrgMembers(orgId, userId, EventOwnershipTransferred, "Is now the owner of", EventPayload{UserID: userId, Username: newOwner})
+	if err != nil {
+		log.Printf("error: could not send out ownership transfer notification: %v", err.Error())
+	}
+
+	return nil
+}
+
+func DeclineOwnershipTransfer(transferId string, userId string, actor AuditActor) error {
+	var orgId string
+	var fromUserId string
+
+	err := dbClient.QueryRow("SELECT org_id, from_user_id FROM org_ownership_transfer WHERE id = ? AND to_user_id = ?", transferId, userId).Scan(&orgId, &fromUserId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTransferNotFound
+		}
+		return err
+	}
+
+	_, err = dbClient.Exec("DELETE FROM org_ownership_transfer WHERE id = ?", transferId)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "ownership_transfer.declined",
+		TargetType: "member",
+		TargetID:   userId,
+		Before:     map[string]any{"fromUserId": fromUserId, "toUserId": userId},
+	})
+
+	err = SendNotificationToUser(fromUserId, userId, EventOwnershipTransferDeclined, "Declined ownership of", EventPayload{OrgID: orgId})
+	if err != nil {
+		log.Printf("error: could not send out ownership transfer notification: %v", err.Error())
+	}
+
+	return nil
+}
+
+// orgs where the user is the only owner and other people are still members
+// deleting the account would leave them without an owner, or delete them outright if the user is also the creator
+func GetOwnedOrgsWithMembers(userId string) ([]string, error) {
+	names := []string{}
+
+	rows, err := dbClient.Query(`
+		SELECT o.name FROM organisation o
+		JOIN org_members self ON self.org_id = o.id AND self.user_id = ? AND self.role = 'Owner'
+		WHERE NOT EXISTS (SELECT 1 FROM org_members m WHERE m.org_id = o.id AND m.role = 'Owner' AND m.user_id != self.user_id)
+		AND EXISTS (SELECT 1 FROM org_members m WHERE m.org_id = o.id AND m.user_id != self.user_id)
+		ORDER BY o.name
+	`, userId)
+	if err != nil {
+		return names, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// best effort, only used for notification text
+func orgName(orgId string) string {
+	var name string
+
+	err := dbClient.QueryRow("SELECT name FROM organisation WHERE id = ?", orgId).Scan(&name)
+	if err != nil {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,599 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// everything a member can do inside an org is one of these
+// routes ask for a capability, never for a role, so custom roles work without touching the handlers
+const (
+	CapOrgView      = "org.view"
+	CapFileUpload   = "file.upload"
+	CapFileDelete   = "file.delete"
+	CapFolderCreate = "folder.create"
+	CapMemberInvite = "member.invite"
+	CapMemberManage = "member.manage"
+	CapOrgSettings  = "org.settings"
+	CapOrgDelete    = "org.delete"
+	// hand the org to another member, only ever held by the owner
+	CapOrgTransfer = "org.transfer"
+	CapShareCreate = "share.create"
+	// edit folder access lists, and see past them
+	CapFolderManage = "folder.manage"
+	// read and export the org's audit log, only ever held by the owner
+	CapAuditView = "audit.view"
+)
+
+// in the order they are shown to the client
+var AllCapabilities = []string{
+	CapOrgView,
+	CapFileUpload,
+	CapFileDelete,
+	CapFolderCreate,
+	CapMemberInvite,
+	CapMemberManage,
+	CapOrgSettings,
+	CapOrgDelete,
+	CapOrgTransfer,
+	CapShareCreate,
+	CapFolderManage,
+	CapAuditView,
+}
+
+// every role, built-in or custom, is stored in org_members
+// organisation.creator_id is only the owner whose plan the org counts against, it grants nothing by itself
+const (
+	RoleOwner  = "Owner"
+	RoleAdmin  = "Admin"
+	RoleEditor = "Editor"
+	RoleViewer = "Viewer"
+)
+
+// the role new members get when they accept an invite
+const DefaultMemberRole = RoleEditor
+
+// capabilities that stay with the owner and can't be put into a custom role
+var ownerOnlyCapabilities = []string{CapOrgTransfer, CapAuditView}
+
+var builtInRoles = map[string][]string{
+	RoleOwner:  AllCapabilities,
+	RoleAdmin:  {CapOrgView, CapFileUpload, CapFileDelete, CapFolderCreate, CapMemberInvite, CapMemberManage, CapShareCreate, CapFolderManage},
+	RoleEditor: {CapOrgView, CapFileUpload, CapFileDelete, CapFolderCreate, CapShareCreate},
+	RoleViewer: {CapOrgView},
+}
+
+var (
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrRoleNameTaken     = errors.New("a role with this name already exists")
+	ErrRoleInUse         = errors.New("role is still assigned to members")
+	ErrUnknownCapability = errors.New("unknown capability")
+	ErrLastOwner         = errors.New("an organisation must always have at least one owner")
+)
+
+const (
+	ResourceFile   = "file"
+	ResourceFolder = "folder"
+)
+
+// a single item inside an org that a capability is being checked against
+type Resource struct {
+	Type string
+	ID   string
+}
+
+// what the caller is allowed to do in one org
+type OrgAccess struct {
+	Role         string   `json:"role"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (a *OrgAccess) Has(capability string) bool {
+	return slices.Contains(a.Capabilities, capability)
+}
+
+type OrgRole struct {
+	ID           *int64   `json:"id"`
+	Name         string   `json:"name"`
+	BuiltIn      bool     `json:"builtIn"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// the one permission check, everything that used to compare role names goes through here
+// resource is optional, when it is set the item must belong to the org as well so ids from another org are rejected
+func Can(userId string, orgId string, capability string, resource *Resource) (bool, error) {
+	access, err := GetOrgAccess(userId, orgId)
+	if err != nil {
+		return false, err
+	}
+
+	if access == nil || !access.Has(capability) {
+		return false, nil
+	}
+
+	if resource == nil {
+		return true, nil
+	}
+
+	return ResourceInOrg(resource, orgId)
+}
+
+// returns nil when the user is not part of the org
+// the capabilities are the member's own role plus the roles of any groups they are in, the role reported is always their own
+func GetOrgAccess(userId string, orgId string) (*OrgAccess, error) {
+	statement, err := dbClient.Prepare("SELECT role FROM org_members WHERE user_id = ? AND org_id = ?")
+	if err != nil {
+		return nil, err
+	}
+
+	defer statement.Close()
+
+	var role string
+
+	err = statement.QueryRow(userId, orgId).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	groupRoles, err := getGroupRoles(userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := []string{}
+
+	for _, r := range append([]string{role}, groupRoles...) {
+		roleCapabilities, err := getRoleCapabilities(orgId, r)
+		if err != nil {
+			// a member whose custom role has since been removed keeps membership but gets nothing from it
+			if err == ErrRoleNotFound {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, capability := range roleCapabilities {
+			if !slices.Contains(capabilities, capability) {
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+
+	return &OrgAccess{Role: role, Capabilities: capabilities}, nil
+}
+
+// ids of the members whose role or one of whose groups grants the capability, used to notify only the people who can act on something
+func GetMembersWithCapability(orgId string, capability string) ([]string, error) {
+	rows, err := dbClient.Query(`
+		SELECT user_id, role FROM org_members WHERE org_id = ?
+		UNION
+		SELECT gm.user_id, g.role FROM org_group_member gm
+		JOIN org_group g ON g.id = gm.group_id
+		WHERE g.org_id = ? AND g.role IS NOT NULL
+	`, orgId, orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	// looked up once per role rather than once per member
+	roleHas := map[string]bool{}
+	var userIds []string
+
+	for rows.Next() {
+		var userId, role string
+		err := rows.Scan(&userId, &role)
+		if err != nil {
+			return nil, err
+		}
+
+		has, seen := roleHas[role]
+		if !seen {
+			capabilities, err := getRoleCapabilities(orgId, role)
+			if err != nil && err != ErrRoleNotFound {
+				return nil, err
+			}
+			has = slices.Contains(capabilities, capability)
+			roleHas[role] = has
+		}
+
+		if has && !slices.Contains(userIds, userId) {
+			userIds = append(userIds, userId)
+		}
+	}
+
+	return userIds, rows.Err()
+}
+
+func ResourceInOrg(resource *Resource, orgId string) (bool, error) {
+	var query string
+
+	switch resource.Type {
+	case ResourceFile:
+		query = "SELECT EXISTS(SELECT 1 FROM file WHERE id = ? AND org_id = ?)"
+	case ResourceFolder:
+		query = "SELECT EXISTS(SELECT 1 FROM folder WHERE id = ? AND org_id = ?)"
+	default:
+		return false, fmt.Errorf("unknown resource type %q", resource.Type)
+	}
+
+	var exists bool
+
+	err := dbClient.QueryRow(query, resource.ID, orgId).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// built-in roles first, then the org's custom roles by name
+func GetOrgRoles(orgId string) ([]OrgRole, error) {
+	roles := []OrgRole{
+		{Name: RoleOwner, BuiltIn: true, Capabilities: builtInRoles[RoleOwner]},
+		{Name: RoleAdmin, BuiltIn: true, Capabilities: builtInRoles[RoleAdmin]},
+		{Name: RoleEditor, BuiltIn: true, Capabilities: builtInRoles[RoleEditor]},
+		{Name: RoleViewer, BuiltIn: true, Capabilities: builtInRoles[RoleViewer]},
+	}
+
+	statement, err := dbClient.Prepare(`
+		SELECT r.id, r.name, COALESCE(GROUP_CONCAT(c.capability), '')
+		FROM org_role r
+		LEFT JOIN org_role_capability c ON c.role_id = r.id
+		WHERE r.org_id = ?
+		GROUP BY r.id, r.name
+		ORDER BY r.name COLLATE NOCASE
+	`)
+	if err != nil {
+		return roles, err
+	}
+
+	defer statement.Close()
+
+	rows, err := statement.Query(orgId)
+	if err != nil {
+		return roles, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var role OrgRole
+		var capabilities string
+		err := rows.Scan(&role.ID, &role.Name, &capabilities)
+		if err != nil {
+			continue
+		}
+		role.Capabilities = splitCapabilities(capabilities)
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func CreateOrgRole(orgId string, name string, capabilities []string, actor AuditActor) (int64, error) {
+	if isBuiltInRole(name) {
+		return 0, ErrRoleNameTaken
+	}
+
+	err := validateCapabilities(capabilities)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO org_role (org_id, name) VALUES (?, ?)", orgId, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return 0, ErrRoleNameTaken
+		}
+		return 0, err
+	}
+
+	roleId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertRoleCapabilities(tx, roleId, capabilities)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "role.created",
+		TargetType: "role",
+		TargetID:   strconv.FormatInt(roleId, 10),
+		After:      map[string]any{"name": name, "capabilities": capabilities},
+	})
+
+	return roleId, nil
+}
+
+// replaces the role's capabilities, members holding the role pick the change up on their next request
+func UpdateOrgRole(orgId string, roleId string, capabilities []string, actor AuditActor) error {
+	err := validateCapabilities(capabilities)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var id int64
+	var name string
+
+	err = tx.QueryRow("SELECT id, name FROM org_role WHERE id = ? AND org_id = ?", roleId, orgId).Scan(&id, &name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+
+	var previous sql.NullString
+	err = tx.QueryRow("SELECT GROUP_CONCAT(capability) FROM org_role_capability WHERE role_id = ?", id).Scan(&previous)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM org_role_capability WHERE role_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	err = insertRoleCapabilities(tx, id, capabilities)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "role.updated",
+		TargetType: "role",
+		TargetID:   roleId,
+		Before:     map[string]any{"name": name, "capabilities": splitCapabilities(previous.String)},
+		After:      map[string]any{"name": name, "capabilities": capabilities},
+	})
+
+	return nil
+}
+
+// members and groups have to be moved to another role first, otherwise they would silently lose every capability
+func DeleteOrgRole(orgId string, roleId string, actor AuditActor) error {
+	var name string
+
+	err := dbClient.QueryRow("SELECT name FROM org_role WHERE id = ? AND org_id = ?", roleId, orgId).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrRoleNotFound
+		}
+		return err
+	}
+
+	var inUse bool
+
+	err = dbClient.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM org_members WHERE org_id = ? AND role = ? COLLATE NOCASE)
+		OR EXISTS(SELECT 1 FROM org_group WHERE org_id = ? AND role = ? COLLATE NOCASE)
+	`, orgId, name, orgId, name).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+
+	if inUse {
+		return ErrRoleInUse
+	}
+
+	capabilities, err := getRoleCapabilities(orgId, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbClient.Exec("DELETE FROM org_role WHERE id = ? AND org_id = ?", roleId, orgId)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "role.deleted",
+		TargetType: "role",
+		TargetID:   roleId,
+		Before:     map[string]any{"name": name, "capabilities": capabilities},
+	})
+
+	return nil
+}
+
+// the canonical spelling of a role that can be given to a member of the org
+// whether the caller may hand it out is decided by CanManageMember
+func ResolveAssignableRole(orgId string, name string) (string, error) {
+	for builtIn := range builtInRoles {
+		if strings.EqualFold(name, builtIn) {
+			return builtIn, nil
+		}
+	}
+
+	var canonical string
+
+	err := dbClient.QueryRow("SELECT name FROM org_role WHERE org_id = ? AND name = ? COLLATE NOCASE", orgId, name).Scan(&canonical)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrRoleNotFound
+		}
+		return "", err
+	}
+
+	return canonical, nil
+}
+
+// owners and admins run the org, anything at or above admin is privileged
+func isPrivilegedRole(role string) bool {
+	return strings.EqualFold(role, RoleOwner) || strings.EqualFold(role, RoleAdmin)
+}
+
+// the rules for one member changing another member's role or removing them
+// owners can do anything, the last owner check happens when the change is written
+// everyone else with member.manage (admins and custom roles) can only move members between non privileged roles
+// newRole is empty when the member is being removed
+func CanManageMember(actorRole string, targetRole string, newRole string) bool {
+	if strings.EqualFold(actorRole, RoleOwner) {
+		return true
+	}
+
+	if isPrivilegedRole(targetRole) {
+		return false
+	}
+
+	return len(newRole) == 0 || !isPrivilegedRole(newRole)
+}
+
+// nobody but an owner can hand out a role that can do something they can't
+// otherwise a member.manage holder could make a custom role with more than they have and give it to a friend
+func RoleWithinAccess(orgId string, access *OrgAccess, role string) (bool, error) {
+	if strings.EqualFold(access.Role, RoleOwner) {
+		return true, nil
+	}
+
+	capabilities, err := getRoleCapabilities(orgId, role)
+	if err != nil {
+		return false, err
+	}
+
+	for _, capability := range capabilities {
+		if !access.Has(capability) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// returns ErrNotOrgMember when the username isn't in the org
+func GetMemberRole(orgId string, username string) (string, error) {
+	var role string
+
+	err := dbClient.QueryRow(`
+		SELECT org_members.role FROM org_members
+		JOIN user ON user.id = org_members.user_id
+		WHERE org_members.org_id = ? AND user.username = ?
+	`, orgId, username).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNotOrgMember
+		}
+		return "", err
+	}
+
+	return role, nil
+}
+
+func getRoleCapabilities(orgId string, role string) ([]string, error) {
+	for builtIn, capabilities := range builtInRoles {
+		if strings.EqualFold(role, builtIn) {
+			return capabilities, nil
+		}
+	}
+
+	var capabilities sql.NullString
+
+	err := dbClient.QueryRow(`
+		SELECT GROUP_CONCAT(c.capability)
+		FROM org_role r
+		LEFT JOIN org_role_capability c ON c.role_id = r.id
+		WHERE r.org_id = ? AND r.name = ? COLLATE NOCASE
+		GROUP BY r.id
+	`, orgId, role).Scan(&capabilities)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrRoleNotFound
+		}
+		return nil, err
+	}
+
+	return splitCapabilities(capabilities.String), nil
+}
+
+func insertRoleCapabilities(tx *sql.Tx, roleId int64, capabilities []string) error {
+	for _, capability := range capabilities {
+		_, err := tx.Exec("INSERT OR IGNORE INTO org_role_capability (role_id, capability) VALUES (?, ?)", roleId, capability)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the capabilities a custom role can be given
+func GrantableCapabilities() []string {
+	var grantable []string
+
+	for _, capability := range AllCapabilities {
+		if !slices.Contains(ownerOnlyCapabilities, capability) {
+			grantable = append(grantable, capability)
+		}
+	}
+
+	return grantable
+}
+
+func validateCapabilities(capabilities []string) error {
+	grantable := GrantableCapabilities()
+
+	for _, capability := range capabilities {
+		if !slices.Contains(grantable, capability) {
+			return fmt.Errorf("%w: %s", ErrUnknownCapability, capability)
+		}
+	}
+
+	return nil
+}
+
+func isBuiltInRole(name string) bool {
+	for builtIn := range builtInRoles {
+		if strings.EqualFold(name, builtIn) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitCapabilities(capabilities string) []string {
+	if len(capabilities) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(capabilities, ",")
+}
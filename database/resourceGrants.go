@@ -0,0 +1,330 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+var ErrGrantNotFound = errors.New("shared item not found")
+
+// a grant as the org sees it
+type ResourceGrant struct {
+	ID           int64  `json:"id"`
+	ResourceType string `json:"resourceType"`
+	ResourceID   int64  `json:"resourceId"`
+	ResourceName string `json:"resourceName"`
+	Username     string `json:"username"`
+	Permission   string `json:"permission"`
+	GrantedBy    string `json:"grantedBy"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// a grant as the user it was given to sees it, in their "shared with me" list
+type SharedWithMe struct {
+	ID           int64  `json:"id"`
+	OrgName      string `json:"orgName"`
+	ResourceType string `json:"resourceType"`
+	ResourceID   int64  `json:"resourceId"`
+	ResourceName string `json:"resourceName"`
+	Permission   string `json:"permission"`
+	SharedBy     string `json:"sharedBy"`
+	CreatedAt    int64  `json:"createdAt"`
+}
+
+// what the routes for shared items need to check a request
+type ResourceGrantAccess struct {
+	ID           int64
+	OrgID        string
+	ResourceType string
+	ResourceID   string
+	ResourceName string
+	Permission   string
+	GrantedBy    string
+}
+
+// sharing the same item with the same user again replaces the permission
+// members of the org get folder access entries instead, so they are turned away here
+func GrantResourceAccess(orgId string, grantedBy string, resource Resource, username string, permission string, actor AuditActor) error {
+	var userId string
+	err := dbClient.QueryRow("SELECT id FROM user WHERE username = ?", username).Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		return err
+	}
+
+	access, err := GetOrgAccess(userId, orgId)
+	if err != nil {
+		return err
+	}
+
+	if access != nil {
+		return ErrAlreadyMember
+	}
+
+	inOrg, err := ResourceInOrg(&resource, orgId)
+	if err != nil {
+		return err
+	}
+
+	if !inOrg {
+		return ErrShareTargetNotFound
+	}
+
+	// re-sharing replaces the permission, the log keeps what it was
+	var previous sql.NullString
+	column := "file_id"
+	if resource.Type == ResourceFolder {
+		column = "folder_id"
+	}
+
+	err = dbClient.QueryRow("SELECT permission FROM resource_grant WHERE user_id = ? AND "+column+" = ?", userId, resource.ID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	query := `
+		INSERT INTO resource_grant (org_id, file_id, user_id, permission, granted_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, file_id) DO UPDATE SET permission = excluded.permission, granted_by = excluded.granted_by
+	`
+	if resource.Type == ResourceFolder {
+		query = `
+			INSERT INTO resource_grant (org_id, folder_id, user_id, permission, granted_by, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, folder_id) DO UPDATE SET permission = excluded.permission, granted_by = excluded.granted_by
+		`
+	}
+
+	_, err = dbClient.Exec(query, orgId, resource.ID, userId, permission, grantedBy, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	var before any
+	if previous.Valid {
+		before = map[string]any{"permission": previous.String}
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "grant.created",
+		TargetType: resource.Type,
+		TargetID:   resource.ID,
+		Before:     before,
+		After:      map[string]any{"userId": userId, "username": username, "permission": permission},
+	})
+
+	var name string
+	if resource.Type == ResourceFolder {
+		name, err = GetFolderNameById(resource.ID, orgId)
+	} else {
+		err = dbClient.QueryRow("SELECT name FROM file WHERE id = ?", resource.ID).Scan(&name)
+	}
+	if err != nil {
+		log.Printf("error: could not read shared item name: %v", err.Error())
+	}
+
+	err = SendNotificationToUser(userId, grantedBy, EventShareReceived, "Shared with you", EventPayload{OrgID: orgId, ResourceType: resource.Type, ResourceID: resource.ID, ResourceName: name})
+	if err != nil {
+		log.Printf("error: could not send out notification to share: %v", err.Error())
+	}
+
+	return nil
+}
+
+// every grant in the org, or only the ones one member made when grantedBy is set
+func GetResourceGrants(orgId string, grantedBy string) ([]ResourceGrant, error) {
+	grants := []ResourceGrant{}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			g.id,
+			CASE WHEN g.file_id IS NOT NULL THEN 'file' ELSE 'folder' END,
+			COALESCE(g.file_id, g.folder_id),
+			COALESCE(file.name, folder.name, ''),
+			grantee.username,
+			g.permission,
+			COALESCE(granter.username, ''),
+			g.created_at
+		FROM resource_grant g
+		JOIN user grantee ON grantee.id = g.user_id
+		LEFT JOIN user granter ON granter.id = g.granted_by
+		LEFT JOIN file ON file.id = g.file_id
+		LEFT JOIN folder ON folder.id = g.folder_id
+		WHERE g.org_id = ? AND (? = '' OR g.granted_by = ?)
+		ORDER BY g.created_at DESC
+	`, orgId, grantedBy, grantedBy)
+	if err != nil {
+		return grants, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var grant ResourceGrant
+		err := rows.Scan(&grant.ID, &grant.ResourceType, &grant.ResourceID, &grant.ResourceName, &grant.Username, &grant.Permission, &grant.GrantedBy, &grant.CreatedAt)
+		if err != nil {
+			continue
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+// grantedBy limits the revoke to the member's own grants, empty for members who can manage every grant
+func RevokeResourceGrant(orgId string, grantId string, grantedBy string, actor AuditActor) error {
+	_, grant, err := grantAuditValues(grantId)
+	if err != nil {
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM resource_grant WHERE id = ? AND org_id = ? AND (? = '' OR granted_by = ?)", grantId, orgId, grantedBy, grantedBy)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrGrantNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "grant.revoked",
+		TargetType: "grant",
+		TargetID:   grantId,
+		Before:     grant,
+	})
+
+	return nil
+}
+
+// the user the item was shared with can take it off their own list
+func RemoveSharedWithMe(grantId string, userId string, actor AuditActor) error {
+	orgId, grant, err := grantAuditValues(grantId)
+	if err != nil {
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM resource_grant WHERE id = ? AND user_id = ?", grantId, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrGrantNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "grant.removed",
+		TargetType: "grant",
+		TargetID:   grantId,
+		Before:     grant,
+	})
+
+	return nil
+}
+
+// the grant's org and what it gave, read before it is deleted
+func grantAuditValues(grantId string) (string, map[string]any, error) {
+	var orgId, resourceType, resourceId, userId, permission string
+
+	err := dbClient.QueryRow(`
+		SELECT org_id, CASE WHEN file_id IS NOT NULL THEN 'file' ELSE 'folder' END, COALESCE(file_id, folder_id), user_id, permission
+		FROM resource_grant WHERE id = ?
+	`, grantId).Scan(&orgId, &resourceType, &resourceId, &userId, &permission)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil, ErrGrantNotFound
+		}
+		return "", nil, err
+	}
+
+	return orgId, map[string]any{"resourceType": resourceType, "resourceId": resourceId, "userId": userId, "permission": permission}, nil
+}
+
+func GetSharedWithMe(userId string) ([]SharedWithMe, error) {
+	items := []SharedWithMe{}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			g.id,
+			organisation.name,
+			CASE WHEN g.file_id IS NOT NULL THEN 'file' ELSE 'folder' END,
+			COALESCE(g.file_id, g.folder_id),
+			COALESCE(file.name, folder.name, ''),
+			g.permission,
+			COALESCE(granter.username, ''),
+			g.created_at
+		FROM resource_grant g
+		JOIN organisation ON organisation.id = g.org_id
+		LEFT JOIN user granter ON granter.id = g.granted_by
+		LEFT JOIN file ON file.id = g.file_id
+		LEFT JOIN folder ON folder.id = g.folder_id
+		WHERE g.user_id = ?
+		ORDER BY g.created_at DESC
+	`, userId)
+	if err != nil {
+		return items, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var item SharedWithMe
+		err := rows.Scan(&item.ID, &item.OrgName, &item.ResourceType, &item.ResourceID, &item.ResourceName, &item.Permission, &item.SharedBy, &item.CreatedAt)
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// ErrGrantNotFound unless the grant was given to this user
+func GetResourceGrant(grantId string, userId string) (*ResourceGrantAccess, error) {
+	var grant ResourceGrantAccess
+	var resourceId int64
+
+	err := dbClient.QueryRow(`
+		SELECT
+			g.id,
+			g.org_id,
+			CASE WHEN g.file_id IS NOT NULL THEN 'file' ELSE 'folder' END,
+			COALESCE(g.file_id, g.folder_id),
+			COALESCE(file.name, folder.name, ''),
+			g.permission,
+			g.granted_by
+		FROM resource_grant g
+		LEFT JOIN file ON file.id = g.file_id
+		LEFT JOIN folder ON folder.id = g.folder_id
+		WHERE g.id = ? AND g.user_id = ?
+	`, grantId, userId).Scan(&grant.ID, &grant.OrgID, &grant.ResourceType, &resourceId, &grant.ResourceName, &grant.Permission, &grant.GrantedBy)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrGrantNotFound
+		}
+		return nil, err
+	}
+
+	grant.ResourceID = strconv.FormatInt(resourceId, 10)
+
+	return &grant, nil
+}
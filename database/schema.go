@@ -67,7 +67,7 @@ func RunSchema() {
 	CREATE TABLE IF NOT EXISTS notification(
 		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
-		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		org_id INTEGER REFERENCES organisation(id) ON DELETE CASCADE,
 		actor_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
 		type TEXT NOT NULL,
 		message TEXT NOT NULL,
@@ -77,6 +77,292 @@ func RunSchema() {
 		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
 	);
 
+	-- one row per (scope, key) where scope is either "ip" or "username"
+	-- failures resets once the window has passed without a new failure
+	CREATE TABLE IF NOT EXISTS login_throttle(
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(scope, key)
+	);
+
+	-- single use tokens for email verification and password resets
+	-- only the sha256 of the token is stored so a leaked database can't be used to reset passwords
+	CREATE TABLE IF NOT EXISTS user_token(
+		id TEXT NOT NULL PRIMARY KEY,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		purpose TEXT NOT NULL,
+		email TEXT,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used_at INTEGER
+	);
+
+	-- accounts at external identity providers linked to an fms user
+	CREATE TABLE IF NOT EXISTS user_identity(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email TEXT,
+		linked_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(issuer, subject)
+	);
+
+	-- in flight sso logins, keyed by the sha256 of the state parameter
+	CREATE TABLE IF NOT EXISTS oidc_login_state(
+		id TEXT NOT NULL PRIMARY KEY,
+		provider TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		link_user_id TEXT REFERENCES user(id) ON DELETE CASCADE,
+		redirect_to TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	-- roles an org defines on top of the built-in owner, editor and viewer
+	-- org_members.role holds the role name, so names are unique per org regardless of case
+	CREATE TABLE IF NOT EXISTS org_role(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		name TEXT NOT NULL COLLATE NOCASE,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(org_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS org_role_capability(
+		role_id INTEGER NOT NULL REFERENCES org_role(id) ON DELETE CASCADE,
+		capability TEXT NOT NULL,
+		PRIMARY KEY(role_id, capability)
+	);
+
+	-- per folder grants and denials, they apply to the folder and everything below it until a closer entry overrides them
+	-- permission is "view" or "edit", effect is "allow" or "deny", principal_type is "user" or "group"
+	CREATE TABLE IF NOT EXISTS folder_acl(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		folder_id INTEGER NOT NULL REFERENCES folder(id) ON DELETE CASCADE,
+		principal_type TEXT NOT NULL,
+		principal_id TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		effect TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(folder_id, principal_type, principal_id, permission)
+	);
+
+	-- an owner's nomination of a member to take over the org, one pending transfer per org
+	CREATE TABLE IF NOT EXISTS org_ownership_transfer(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL UNIQUE REFERENCES organisation(id) ON DELETE CASCADE,
+		from_user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		to_user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	-- invite links that anyone holding the token can use to join, and invites emailed to people who may not have an account
+	-- emailed invites have the address set and a single use, only the sha256 of the token is stored
+	-- max_uses and expires_at are optional, null means no limit
+	CREATE TABLE IF NOT EXISTS org_invite_link(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		created_by TEXT REFERENCES user(id) ON DELETE SET NULL,
+		role TEXT NOT NULL,
+		email TEXT,
+		max_uses INTEGER,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at INTEGER,
+		revoked_at INTEGER,
+		created_at INTEGER NOT NULL
+	);
+
+	-- someone outside a discoverable org asking to be let in, anyone who can invite members can approve or deny it
+	-- approved requests are removed once the member is added, denied ones are kept for a while so the same user can't ask again straight away
+	CREATE TABLE IF NOT EXISTS org_join_request(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		message TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'denied')),
+		created_at INTEGER NOT NULL,
+		decided_by TEXT REFERENCES user(id) ON DELETE SET NULL,
+		decided_at INTEGER,
+		UNIQUE(org_id, user_id)
+	);
+
+	-- named sets of members inside an org, used to hand out a role, folder access or notifications to many members at once
+	-- role is optional and adds to the capabilities each member already has from their own role
+	CREATE TABLE IF NOT EXISTS org_group(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		name TEXT NOT NULL COLLATE NOCASE,
+		role TEXT,
+		created_at INTEGER NOT NULL,
+		UNIQUE(org_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS org_group_member(
+		group_id INTEGER NOT NULL REFERENCES org_group(id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		PRIMARY KEY(group_id, user_id)
+	);
+
+	-- links that give anyone holding the token access to one file or folder without signing in
+	-- exactly one of file_id and folder_id is set so the link goes away with the item it points to
+	-- the password is an argon2 hash like user passwords, null when the link has none
+	CREATE TABLE IF NOT EXISTS share_link(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		file_id INTEGER REFERENCES file(id) ON DELETE CASCADE,
+		folder_id INTEGER REFERENCES folder(id) ON DELETE CASCADE,
+		created_by TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		mode TEXT NOT NULL CHECK (mode IN ('view', 'download')),
+		password_hash BLOB,
+		expires_at INTEGER,
+		max_downloads INTEGER,
+		download_count INTEGER NOT NULL DEFAULT 0,
+		view_count INTEGER NOT NULL DEFAULT 0,
+		last_accessed_at INTEGER,
+		revoked_at INTEGER,
+		created_at INTEGER NOT NULL,
+		CHECK ((file_id IS NULL) != (folder_id IS NULL))
+	);
+
+	-- upload only links into one folder, allowed_types is a comma separated list of extensions and null for every type uploads accept
+	CREATE TABLE IF NOT EXISTS file_request_link(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT NOT NULL UNIQUE,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		folder_id INTEGER NOT NULL REFERENCES folder(id) ON DELETE CASCADE,
+		created_by TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		message TEXT NOT NULL DEFAULT '',
+		max_file_size INTEGER NOT NULL,
+		allowed_types TEXT,
+		max_uploads INTEGER,
+		upload_count INTEGER NOT NULL DEFAULT 0,
+		require_uploader INTEGER NOT NULL DEFAULT 0,
+		expires_at INTEGER,
+		revoked_at INTEGER,
+		created_at INTEGER NOT NULL
+	);
+
+	-- a single file or folder shared with a registered user who isn't in the org
+	CREATE TABLE IF NOT EXISTS resource_grant(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		file_id INTEGER REFERENCES file(id) ON DELETE CASCADE,
+		folder_id INTEGER REFERENCES folder(id) ON DELETE CASCADE,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		permission TEXT NOT NULL CHECK (permission IN ('view', 'edit')),
+		granted_by TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		CHECK ((file_id IS NULL) != (folder_id IS NULL)),
+		UNIQUE(user_id, file_id),
+		UNIQUE(user_id, folder_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS file_request_upload(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		link_id INTEGER NOT NULL REFERENCES file_request_link(id) ON DELETE CASCADE,
+		file_id INTEGER NOT NULL REFERENCES file(id) ON DELETE CASCADE,
+		uploader_name TEXT,
+		uploader_email TEXT,
+		created_at INTEGER NOT NULL
+	);
+
+	-- how a user wants to hear about one type of notification in one org, an empty type covers every type in the org
+	CREATE TABLE IF NOT EXISTS notification_preference(
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		channel TEXT NOT NULL CHECK (channel IN ('in_app', 'email_digest', 'off')),
+		PRIMARY KEY (user_id, org_id, type)
+	);
+
+	-- no notifications about anything in the folder or below it
+	CREATE TABLE IF NOT EXISTS notification_folder_mute(
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		folder_id INTEGER NOT NULL REFERENCES folder(id) ON DELETE CASCADE,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, folder_id)
+	);
+
+	-- an address outside fms that is told about activity in the org
+	-- the secret signs every delivery so the receiver can check it came from us, it has to be kept as is to sign with
+	CREATE TABLE IF NOT EXISTS webhook(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL REFERENCES organisation(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		-- comma separated event names, null for every event
+		events TEXT,
+		active INTEGER NOT NULL DEFAULT 1,
+		created_by TEXT REFERENCES user(id) ON DELETE SET NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	-- the queue of events waiting to go out and the log of what happened to them, one row per webhook per event
+	CREATE TABLE IF NOT EXISTS webhook_delivery(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL REFERENCES webhook(id) ON DELETE CASCADE,
+		event_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_attempt_at INTEGER,
+		response_status INTEGER,
+		response_body TEXT,
+		error TEXT,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_delivery_due ON webhook_delivery(next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_delivery_log ON webhook_delivery(webhook_id, id);
+
+	-- every change made to an org, append only
+	-- org and actor aren't foreign keys so the log outlives both, the actor's username is kept as it was at the time
+	-- each event's hash covers the one before it in the same org, seq numbers them so a gap or a second chain can't slip in
+	CREATE TABLE IF NOT EXISTS audit_event(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		actor_id TEXT,
+		actor_username TEXT,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT,
+		ip TEXT,
+		user_agent TEXT,
+		-- json, null when there was nothing before (a create) or nothing after (a delete)
+		before TEXT,
+		after TEXT,
+		created_at INTEGER NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		UNIQUE(org_id, seq)
+	);
+
+	CREATE INDEX IF NOT EXISTS audit_event_action ON audit_event(org_id, action, seq);
+
+	CREATE TRIGGER IF NOT EXISTS audit_event_no_update BEFORE UPDATE ON audit_event
+	BEGIN
+		SELECT RAISE(ABORT, 'audit events are append only');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS audit_event_no_delete BEFORE DELETE ON audit_event
+	BEGIN
+		SELECT RAISE(ABORT, 'audit events are append only');
+	END;
+
+	CREATE TABLE IF NOT EXISTS schema_migration(
+		id INTEGER NOT NULL PRIMARY KEY,
+		applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
 
 	`
 	_, err := dbClient.Exec(schema)
@@ -86,4 +372,153 @@ func RunSchema() {
 		log.Fatalf("Error running schema: %s\n", err.Error())
 	}
 
+	runMigrations()
+}
+
+// create table if not exists does nothing for tables that already exist in a deployed database
+// any change to an existing table goes in here instead, the index of each migration is its id so never reorder or remove entries
+// a new database will run every migration once right after the schema above, so they must also work against the fresh tables
+var migrations = []string{
+	// 1: notifications that don't belong to an org (account security alerts etc) need a nullable org_id
+	// sqlite can't drop a NOT NULL constraint so the table gets rebuilt
+	`
+	CREATE TABLE notification_new(
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		org_id INTEGER REFERENCES organisation(id) ON DELETE CASCADE,
+		actor_id TEXT NOT NULL REFERENCES user(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		message TEXT NOT NULL,
+		payload_id TEXT NOT NULL,
+		payload_name TEXT NOT NULL,
+		is_read INTEGER NOT NULL DEFAULT (0),
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO notification_new SELECT id, user_id, org_id, actor_id, type, message, payload_id, payload_name, is_read, created_at FROM notification;
+	DROP TABLE notification;
+	ALTER TABLE notification_new RENAME TO notification;
+	`,
+	// 2: optional email address for account recovery, unverified until email_verified_at is set
+	`
+	ALTER TABLE user ADD COLUMN email TEXT;
+	ALTER TABLE user ADD COLUMN email_verified_at INTEGER;
+	CREATE UNIQUE INDEX user_email_unique ON user(email COLLATE NOCASE);
+	`,
+	// 3: restricted folders are hidden from everyone without an explicit grant in folder_acl
+	`
+	ALTER TABLE folder ADD COLUMN restricted INTEGER NOT NULL DEFAULT 0;
+	`,
+	// 4: the plan decides how many orgs a user can own and join, null uses the deployment defaults
+	`
+	ALTER TABLE user ADD COLUMN plan TEXT;
+	`,
+	// 5: owners are stored in org_members like every other role instead of being read from creator_id
+	// a custom role already called admin would clash with the new built-in one so it gets renamed along with its members
+	`
+	UPDATE org_members SET role = 'Admin (custom)'
+	WHERE role = 'Admin' COLLATE NOCASE AND org_id IN (SELECT org_id FROM org_role WHERE name = 'Admin');
+	UPDATE org_role SET name = 'Admin (custom)' WHERE name = 'Admin';
+	INSERT INTO org_members (org_id, user_id, role)
+	SELECT id, creator_id, 'Owner' FROM organisation WHERE true
+	ON CONFLICT(org_id, user_id) DO UPDATE SET role = 'Owner';
+	`,
+	// 6: invites expire, and remember who sent them so the org can list, revoke and resend them
+	// invites already in the table get a fresh week from the day this runs
+	`
+	ALTER TABLE org_invites ADD COLUMN invited_by TEXT REFERENCES user(id) ON DELETE SET NULL;
+	ALTER TABLE org_invites ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE org_invites ADD COLUMN last_sent_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE org_invites SET expires_at = CAST(strftime('%s', 'now') AS INTEGER) + 604800, last_sent_at = CAST(strftime('%s', 'now') AS INTEGER);
+	`,
+	// 7: invites carry the role the invitee joins as, null for older invites which fall back to the default member role
+	// discoverable orgs show up in search for people outside them, who can then ask to join
+	`
+	ALTER TABLE org_invites ADD COLUMN role TEXT;
+	ALTER TABLE organisation ADD COLUMN discoverable INTEGER NOT NULL DEFAULT 0;
+	`,
+	// 8: notifications are paged newest first per user, and pruned by age
+	`
+	CREATE INDEX IF NOT EXISTS notification_user_page ON notification(user_id, id);
+	CREATE INDEX IF NOT EXISTS notification_created_at ON notification(created_at);
+	`,
+	// 9: notifications a user asked to get by email wait for their digest instead of showing in the app
+	`
+	ALTER TABLE notification ADD COLUMN delivery TEXT NOT NULL DEFAULT 'in_app' CHECK (delivery IN ('in_app', 'email_digest'));
+	`,
+	// 10: unread notifications are emailed to each user daily or weekly, digested_at keeps a notification from going out twice
+	`
+	ALTER TABLE user ADD COLUMN digest_frequency TEXT NOT NULL DEFAULT 'daily' CHECK (digest_frequency IN ('daily', 'weekly', 'off'));
+	ALTER TABLE user ADD COLUMN digest_sent_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notification ADD COLUMN digested_at INTEGER;
+	CREATE INDEX IF NOT EXISTS notification_digest_pending ON notification(user_id) WHERE digested_at IS NULL AND is_read = 0;
+	`,
+	// 11: notifications record which catalogue event they are and a typed json payload for it
+	// older notifications get their event from their type but have no payload, the type of a "join" through an invite link is now "join org" like every other join
+	`
+	ALTER TABLE notification ADD COLUMN event TEXT;
+	ALTER TABLE notification ADD COLUMN payload TEXT;
+	UPDATE notification SET type = 'join org' WHERE type = 'join';
+	UPDATE notification SET event = CASE type
+		WHEN 'file upload' THEN 'file.uploaded'
+		WHEN 'file delete' THEN 'file.deleted'
+		WHEN 'folder upload' THEN 'folder.created'
+		WHEN 'folder delete' THEN 'folder.deleted'
+		WHEN 'file request upload' THEN 'file_request.uploaded'
+		WHEN 'invite' THEN CASE WHEN org_id IS NULL THEN 'invite.received' ELSE 'member.invited' END
+		WHEN 'join org' THEN 'member.joined'
+		WHEN 'decline invite' THEN 'invite.declined'
+		WHEN 'leave org' THEN 'member.left'
+		WHEN 'org name' THEN 'org.renamed'
+		WHEN 'ownership transfer' THEN CASE WHEN org_id IS NULL THEN 'ownership_transfer.requested' ELSE 'org.ownership_transferred' END
+		WHEN 'ownership transfer declined' THEN 'ownership_transfer.declined'
+		WHEN 'join request' THEN 'join_request.created'
+		WHEN 'join request approved' THEN 'join_request.approved'
+		WHEN 'join request denied' THEN 'join_request.denied'
+		WHEN 'share' THEN 'share.received'
+		WHEN 'account locked' THEN 'account.locked'
+	END;
+	UPDATE OR IGNORE notification_preference SET type = 'join org' WHERE type = 'join';
+	DELETE FROM notification_preference WHERE type = 'join';
+	`,
+	// 12: digest_frequency defaulted everyone to daily, so on its own it isn't consent to have every unread notification emailed
+	// until a user picks a frequency themselves their digest only carries the types they asked to get by email
+	`
+	ALTER TABLE user ADD COLUMN digest_opted_in INTEGER NOT NULL DEFAULT 0;
+	`,
+}
+
+func runMigrations() {
+	var applied int
+
+	err := dbClient.QueryRow("SELECT COALESCE(MAX(id), 0) FROM schema_migration").Scan(&applied)
+	if err != nil {
+		log.Fatalf("Error reading schema migrations: %s\n", err.Error())
+	}
+
+	for i := applied; i < len(migrations); i++ {
+		id := i + 1
+
+		// each migration and its bookkeeping row go through together so a failed migration is retried on the next boot
+		tx, err := dbClient.Begin()
+		if err != nil {
+			log.Fatalf("Error starting migration %d: %s\n", id, err.Error())
+		}
+
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			tx.Rollback()
+			log.Fatalf("Error running migration %d: %s\n", id, err.Error())
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migration (id) VALUES (?)", id)
+		if err != nil {
+			tx.Rollback()
+			log.Fatalf("Error recording migration %d: %s\n", id, err.Error())
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Fatalf("Error committing migration %d: %s\n", id, err.Error())
+		}
+	}
 }
@@ -1,14 +1,20 @@
 package database
 
+import "encoding/json"
+
 type User struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
 }
 
 // validate required tag is important for the library that makes sure the request body has all fields
+// email is optional and only used when registering
 type UserCredentials struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	Email    string `json:"email" validate:"omitempty,email"`
 }
 
 type UserSession struct {
@@ -28,6 +34,7 @@ type Organisation struct {
 	Creator_id   string `json:"creatorId"`
 	Storage_used int    `json:"storageUsed"`
 	MemberCount  int    `json:"memberCount"`
+	Discoverable bool   `json:"discoverable"`
 }
 
 type JoinedOrganisation struct {
@@ -51,6 +58,7 @@ type FolderData struct {
 	ParentFolderId *int64 `json:"parentFolderId" `
 	CreatedAt      string `json:"createdAt"`
 	Size           int64  `json:"size"`
+	Restricted     bool   `json:"restricted"`
 }
 
 type FileData struct {
@@ -70,15 +78,80 @@ type OrgInvite struct {
 	OrgOwner  string `json:"orgOwner"`
 	OrgName   string `json:"orgName"`
 	InvitedAt string `json:"invitedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Role      string `json:"role"`
 }
 
 type Notification struct {
 	ID            int    `json:"id"`
+	OrgID         string `json:"orgId"`
 	OrgName       string `json:"orgName"`
 	ActorUsername string `json:"actorName"`
 	Message       string `json:"message"`
 	NotifType     string `json:"notifType"`
 	Payload_name  string `json:"payloadName"`
-	IsRead        bool   `json:"isRead"`
+	// the catalogue event and its typed payload, what clients build localized messages and links from
+	// empty and null for notifications from before events were recorded
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	IsRead    bool            `json:"isRead"`
+	CreatedAt string          `json:"createdAt"`
+}
+
+type FolderACLEntry struct {
+	ID            int64  `json:"id"`
+	FolderID      int64  `json:"folderId"`
+	PrincipalType string `json:"principalType"`
+	PrincipalName string `json:"principalName"`
+	Permission    string `json:"permission"`
+	Effect        string `json:"effect"`
 	CreatedAt     string `json:"createdAt"`
 }
+
+type OwnershipTransfer struct {
+	ID           int64  `json:"id"`
+	OrgID        int64  `json:"orgId"`
+	OrgName      string `json:"orgName"`
+	FromUsername string `json:"fromUsername"`
+	CreatedAt    int64  `json:"createdAt"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+// an invite as the org sees it
+type PendingOrgInvite struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	InvitedBy string `json:"invitedBy"`
+	Role      string `json:"role"`
+	InvitedAt string `json:"invitedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Expired   bool   `json:"expired"`
+}
+
+type OrgInviteLink struct {
+	ID        int64  `json:"id"`
+	CreatedBy string `json:"createdBy"`
+	Role      string `json:"role"`
+	Email     string `json:"email"`
+	MaxUses   *int64 `json:"maxUses"`
+	Uses      int64  `json:"uses"`
+	ExpiresAt *int64 `json:"expiresAt"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// a discoverable org as someone outside it sees it when searching
+type DiscoverableOrg struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	MemberCount int    `json:"memberCount"`
+	Requested   bool   `json:"requested"`
+}
+
+type JoinRequest struct {
+	ID        int64  `json:"id"`
+	OrgID     int64  `json:"orgId"`
+	OrgName   string `json:"orgName"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	CreatedAt int64  `json:"createdAt"`
+}
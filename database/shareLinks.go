@@ -0,0 +1,349 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// view links have the browser show the file and download links have it save the file
+// neither can stop someone keeping a copy, so max_downloads counts every time a file is sent whatever the mode
+const (
+	ShareModeView     = "view"
+	ShareModeDownload = "download"
+)
+
+var (
+	ErrShareTargetNotFound = errors.New("file or folder not found")
+	ErrShareLinkNotFound   = errors.New("share link not found")
+	ErrShareLinkExhausted  = errors.New("this link has reached its download limit")
+)
+
+// a share link as the org sees it, the password itself is never returned
+type ShareLink struct {
+	ID             int64  `json:"id"`
+	ResourceType   string `json:"resourceType"`
+	ResourceID     int64  `json:"resourceId"`
+	ResourceName   string `json:"resourceName"`
+	CreatedBy      string `json:"createdBy"`
+	Mode           string `json:"mode"`
+	HasPassword    bool   `json:"hasPassword"`
+	ExpiresAt      *int64 `json:"expiresAt"`
+	MaxDownloads   *int64 `json:"maxDownloads"`
+	DownloadCount  int64  `json:"downloadCount"`
+	ViewCount      int64  `json:"viewCount"`
+	LastAccessedAt *int64 `json:"lastAccessedAt"`
+	CreatedAt      int64  `json:"createdAt"`
+}
+
+// what the public routes need to serve a link, only returned for links that are still live
+type ShareLinkAccess struct {
+	ID            int64
+	OrgID         string
+	ResourceType  string
+	ResourceID    string
+	ResourceName  string
+	CreatedBy     string
+	Mode          string
+	PasswordHash  []byte
+	ExpiresAt     *int64
+	MaxDownloads  *int64
+	DownloadCount int64
+}
+
+// the hash is made by the caller so this package doesn't need to know about argon2
+// ttl and maxDownloads of 0 mean no limit
+func CreateShareLink(orgId string, createdBy string, resource Resource, mode string, passwordHash []byte, ttl time.Duration, maxDownloads int64, actor AuditActor) (string, int64, error) {
+	inOrg, err := ResourceInOrg(&resource, orgId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !inOrg {
+		return "", 0, ErrShareTargetNotFound
+	}
+
+	now := time.Now()
+
+	token, err := GenerateToken()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var fileId, folderId, expiresAt, limit any
+	if resource.Type == ResourceFile {
+		fileId = resource.ID
+	} else {
+		folderId = resource.ID
+	}
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+	if maxDownloads > 0 {
+		limit = maxDownloads
+	}
+
+	var password any
+	if len(passwordHash) > 0 {
+		password = passwordHash
+	}
+
+	result, err := dbClient.Exec(`
+		INSERT INTO share_link (token_hash, org_id, file_id, folder_id, created_by, mode, password_hash, expires_at, max_downloads, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, HashToken(token), orgId, fileId, folderId, createdBy, mode, password, expiresAt, limit, now.Unix())
+	if err != nil {
+		return "", 0, err
+	}
+
+	linkId, err := result.LastInsertId()
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the token and password never go in the log, only whether there is one
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "share_link.created",
+		TargetType: "share_link",
+		TargetID:   strconv.FormatInt(linkId, 10),
+		After: map[string]any{
+			"resourceType": resource.Type, "resourceId": resource.ID, "mode": mode,
+			"passwordProtected": len(passwordHash) > 0, "expiresAt": expiresAt, "maxDownloads": limit,
+		},
+	})
+
+	return token, linkId, nil
+}
+
+// every live link in the org, or only the ones one member made when createdBy is set
+func GetShareLinks(orgId string, createdBy string) ([]ShareLink, error) {
+	links := []ShareLink{}
+
+	rows, err := dbClient.Query(`
+		SELECT
+			s.id,
+			CASE WHEN s.file_id IS NOT NULL THEN 'file' ELSE 'folder' END,
+			COALESCE(s.file_id, s.folder_id),
+			COALESCE(file.name, folder.name, ''),
+			COALESCE(user.username, ''),
+			s.mode,
+			s.password_hash IS NOT NULL,
+			s.expires_at,
+			s.max_downloads,
+			s.download_count,
+			s.view_count,
+			s.last_accessed_at,
+			s.created_at
+		FROM share_link s
+		LEFT JOIN file ON file.id = s.file_id
+		LEFT JOIN folder ON folder.id = s.folder_id
+		LEFT JOIN user ON user.id = s.created_by
+		WHERE s.org_id = ? AND s.revoked_at IS NULL AND (? = '' OR s.created_by = ?)
+		ORDER BY s.created_at DESC
+	`, orgId, createdBy, createdBy)
+	if err != nil {
+		return links, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var link ShareLink
+		var expiresAt, maxDownloads, lastAccessedAt sql.NullInt64
+		err := rows.Scan(
+			&link.ID,
+			&link.ResourceType,
+			&link.ResourceID,
+			&link.ResourceName,
+			&link.CreatedBy,
+			&link.Mode,
+			&link.HasPassword,
+			&expiresAt,
+			&maxDownloads,
+			&link.DownloadCount,
+			&link.ViewCount,
+			&lastAccessedAt,
+			&link.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		link.ExpiresAt = nullableInt(expiresAt)
+		link.MaxDownloads = nullableInt(maxDownloads)
+		link.LastAccessedAt = nullableInt(lastAccessedAt)
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// createdBy limits the revoke to the member's own links, empty for members who can manage every link
+func RevokeShareLink(orgId string, linkId string, createdBy string, actor AuditActor) error {
+	result, err := dbClient.Exec(`
+		UPDATE share_link SET revoked_at = ?
+		WHERE id = ? AND org_id = ? AND revoked_at IS NULL AND (? = '' OR created_by = ?)
+	`, time.Now().Unix(), linkId, orgId, createdBy, createdBy)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrShareLinkNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "share_link.revoked",
+		TargetType: "share_link",
+		TargetID:   linkId,
+	})
+
+	return nil
+}
+
+// ErrInvalidToken for links that are unknown, revoked or expired
+// links that have used up their downloads are still returned so the contents can be listed, ConsumeShareLinkDownload enforces the limit
+func GetShareLinkByToken(token string) (*ShareLinkAccess, error) {
+	var link ShareLinkAccess
+	var createdBy sql.NullString
+	var expiresAt, maxDownloads sql.NullInt64
+
+	err := dbClient.QueryRow(`
+		SELECT
+			s.id,
+			s.org_id,
+			CASE WHEN s.file_id IS NOT NULL THEN 'file' ELSE 'folder' END,
+			COALESCE(s.file_id, s.folder_id),
+			COALESCE(file.name, folder.name, ''),
+			s.created_by,
+			s.mode,
+			s.password_hash,
+			s.expires_at,
+			s.max_downloads,
+			s.download_count
+		FROM share_link s
+		LEFT JOIN file ON file.id = s.file_id
+		LEFT JOIN folder ON folder.id = s.folder_id
+		WHERE s.token_hash = ? AND s.revoked_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > ?)
+	`, HashToken(token), time.Now().Unix()).Scan(
+		&link.ID,
+		&link.OrgID,
+		&link.ResourceType,
+		&link.ResourceID,
+		&link.ResourceName,
+		&createdBy,
+		&link.Mode,
+		&link.PasswordHash,
+		&expiresAt,
+		&maxDownloads,
+		&link.DownloadCount,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	link.CreatedBy = createdBy.String
+	link.ExpiresAt = nullableInt(expiresAt)
+	link.MaxDownloads = nullableInt(maxDownloads)
+
+	return &link, nil
+}
+
+func RecordShareLinkView(linkId int64) error {
+	_, err := dbClient.Exec("UPDATE share_link SET view_count = view_count + 1, last_accessed_at = ? WHERE id = ?", time.Now().Unix(), linkId)
+	return err
+}
+
+// counts a download against the link's limit, guarded in the update so parallel downloads can't go over it
+func ConsumeShareLinkDownload(linkId int64) error {
+	result, err := dbClient.Exec(`
+		UPDATE share_link SET download_count = download_count + 1, last_accessed_at = ?
+		WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)
+	`, time.Now().Unix(), linkId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrShareLinkExhausted
+	}
+
+	return nil
+}
+
+// wrong passwords are throttled per link the same way logins are throttled per username
+func ShareLinkLockedUntil(linkId int64) (int64, error) {
+	var lockedUntil int64
+
+	err := dbClient.QueryRow("SELECT COALESCE(MAX(locked_until), 0) FROM login_throttle WHERE scope = 'share' AND key = ?", strconv.FormatInt(linkId, 10)).Scan(&lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+
+	if lockedUntil <= time.Now().Unix() {
+		return 0, nil
+	}
+
+	return lockedUntil, nil
+}
+
+func RecordFailedSharePassword(linkId int64) error {
+	_, _, err := recordThrottleFailure("share", strconv.FormatInt(linkId, 10))
+	return err
+}
+
+// true when the folder is the ancestor itself or anywhere below it
+func FolderIsWithin(folderId string, ancestorId string) (bool, error) {
+	var within bool
+
+	err := dbClient.QueryRow(`
+		WITH RECURSIVE ancestors(id, parent_id) AS (
+			SELECT id, parent_folder_id FROM folder WHERE id = ?
+			UNION ALL
+			SELECT folder.id, folder.parent_folder_id FROM folder JOIN ancestors ON folder.id = ancestors.parent_id
+		)
+		SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = ?)
+	`, folderId, ancestorId).Scan(&within)
+	if err != nil {
+		return false, err
+	}
+
+	return within, nil
+}
+
+func GetFolderNameById(folderId string, orgId string) (string, error) {
+	var name string
+
+	err := dbClient.QueryRow("SELECT name FROM folder WHERE id = ? AND org_id = ?", folderId, orgId).Scan(&name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrFolderNotFound
+		}
+		return "", err
+	}
+
+	return name, nil
+}
+
+func nullableInt(value sql.NullInt64) *int64 {
+	if !value.Valid {
+		return nil
+	}
+
+	return &value.Int64
+}
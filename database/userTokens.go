@@ -0,0 +1,135 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// returned when a token is unknown, expired, already used or for a different purpose
+// the caller can't and shouldn't be able to tell which one it was
+var ErrInvalidToken = errors.New("this link is invalid or has expired")
+
+// returned when a token of the same purpose was issued too recently, stops the forgot password form being used to spam someone's inbox
+var ErrTokenRateLimited = errors.New("a link was sent recently. please wait a few minutes before requesting another")
+
+const tokenResendCooldown = 2 * time.Minute
+
+// creates a single use token and returns the raw value to be emailed to the user
+// any older unused token for the same purpose is removed so only the newest link works
+func CreateUserToken(userId string, purpose string, email string, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	var lastCreatedAt int64
+	err = tx.QueryRow("SELECT COALESCE(MAX(created_at), 0) FROM user_token WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userId, purpose).Scan(&lastCreatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	if now.Unix()-lastCreatedAt < int64(tokenResendCooldown.Seconds()) {
+		return "", ErrTokenRateLimited
+	}
+
+	_, err = tx.Exec("DELETE FROM user_token WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userId, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO user_token (id, user_id, purpose, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		HashToken(token), userId, purpose, email, now.Unix(), now.Add(ttl).Unix(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// marks a token as used and returns the user and email it was issued for
+// the update is guarded on used_at so two requests racing with the same token can't both succeed
+func ConsumeUserToken(token string, purpose string) (string, string, error) {
+	now := time.Now().Unix()
+	tokenHash := HashToken(token)
+
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return "", "", err
+	}
+
+	defer tx.Rollback()
+
+	var userId string
+	var email sql.NullString
+
+	err = tx.QueryRow("SELECT user_id, email FROM user_token WHERE id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", tokenHash, purpose, now).Scan(&userId, &email)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", ErrInvalidToken
+		}
+		return "", "", err
+	}
+
+	result, err := tx.Exec("UPDATE user_token SET used_at = ? WHERE id = ? AND used_at IS NULL", now, tokenHash)
+	if err != nil {
+		return "", "", err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", "", err
+	}
+
+	if rowsAffected == 0 {
+		return "", "", ErrInvalidToken
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", "", err
+	}
+
+	return userId, email.String, nil
+}
+
+// 32 random bytes, url safe so it can go straight into a link
+func GenerateToken() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// tokens are high entropy so a plain sha256 is enough, no need for a slow password hash
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
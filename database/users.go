@@ -1,9 +1,9 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
-	"strconv"
 	"time"
 )
 
@@ -27,11 +27,11 @@ func AuthenticateCookie(cookie string) (*UserWithSession, error) {
 	return &userWithSession, nil
 }
 
-func SearchUsers(username string, userId string) ([]string, error) {
+func SearchUsers(username string, userId string, orgId string) ([]string, error) {
 	var users []string
 	// this function searches for users who are not equal to the user who is searching
-	// and are not members of the user who is searching's organisation
-	// and have not been invited already by the organisation that the user created
+	// and are not already a member of the org they are searching for
+	// and have not been invited to that org already
 	statement, err := dbClient.Prepare(`
 		SELECT u.username 
 		FROM user u
@@ -40,14 +40,12 @@ func SearchUsers(username string, userId string) ([]string, error) {
 		AND u.id NOT IN (
 			SELECT om.user_id 
 			FROM org_members om
-			JOIN organisation o ON om.org_id = o.id
-			WHERE o.creator_id = ?
+			WHERE om.org_id = ?
 		)
 		AND u.id NOT IN (
 			SELECT oi.user_id
 			FROM org_invites oi
-			JOIN organisation o ON oi.org_id = o.id
-			WHERE o.creator_id = ?
+			WHERE oi.org_id = ?
 		)
 	`)
 	if err != nil {
@@ -57,7 +55,7 @@ func SearchUsers(username string, userId string) ([]string, error) {
 	defer statement.Close()
 
 	queryString := fmt.Sprint(username, "%")
-	rows, err := statement.Query(queryString, userId, userId, userId)
+	rows, err := statement.Query(queryString, userId, orgId, orgId)
 
 	if err != nil {
 		return users, err
@@ -82,11 +80,13 @@ func GetUserInvites(userId string) ([]OrgInvite, error) {
 		u.username as creator_username,
 		i.invited_at,
 		i.id,
-		o.id as org_id
+		o.id as org_id,
+		i.expires_at,
+		COALESCE(i.role, ?)
 		FROM organisation o
 		JOIN user u ON o.creator_id = u.id
 		JOIN org_invites i ON o.id = i.org_id
-		WHERE i.user_id = ? AND i.status = 'pending';
+		WHERE i.user_id = ? AND i.status = 'pending' AND i.expires_at > ?;
 
 	`)
 	if err != nil {
@@ -95,7 +95,7 @@ func GetUserInvites(userId string) ([]OrgInvite, error) {
 
 	defer statement.Close()
 
-	rows, err := statement.Query(userId)
+	rows, err := statement.Query(DefaultMemberRole, userId, time.Now().Unix())
 
 	if err != nil {
 		return []OrgInvite{}, err
@@ -105,7 +105,7 @@ func GetUserInvites(userId string) ([]OrgInvite, error) {
 
 	for rows.Next() {
 		var invite OrgInvite
-		err := rows.Scan(&invite.OrgName, &invite.OrgOwner, &invite.InvitedAt, &invite.Id, &invite.OrgId)
+		err := rows.Scan(&invite.OrgName, &invite.OrgOwner, &invite.InvitedAt, &invite.Id, &invite.OrgId, &invite.ExpiresAt, &invite.Role)
 		if err != nil {
 			fmt.Print(err.Error())
 			continue
@@ -117,15 +117,32 @@ func GetUserInvites(userId string) ([]OrgInvite, error) {
 	return invites, nil
 }
 
-func AcceptOrgInvite(userId string, orgId string, username string) error {
-	statement, err := dbClient.Prepare("DELETE FROM org_invites WHERE org_id = ? AND user_id = ?")
+// expired invites can't be accepted, the org has to send a new one
+// the member joins with the role the invite was sent with, or the default if that custom role has been deleted since
+func AcceptOrgInvite(userId string, orgId string, username string, actor AuditActor) error {
+	var role sql.NullString
+
+	err := dbClient.QueryRow("SELECT role FROM org_invites WHERE org_id = ? AND user_id = ? AND expires_at > ?", orgId, userId, time.Now().Unix()).Scan(&role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	memberRole, err := roleOrDefault(dbClient, orgId, role.String)
+	if err != nil {
+		return err
+	}
+
+	statement, err := dbClient.Prepare("DELETE FROM org_invites WHERE org_id = ? AND user_id = ? AND expires_at > ?")
 	if err != nil {
 		return err
 	}
 
 	defer statement.Close()
 
-	result, err := statement.Exec(orgId, userId)
+	result, err := statement.Exec(orgId, userId, time.Now().Unix())
 
 	if err != nil {
 		return err
@@ -141,7 +158,7 @@ func AcceptOrgInvite(userId string, orgId string, username string) error {
 		return fmt.Errorf("operation failed. Please try again later")
 	}
 
-	err = AddMemberToOrg(userId, orgId, username)
+	err = AddMemberToOrg(userId, orgId, username, memberRole, actor)
 
 	if err != nil {
 		return err
@@ -150,7 +167,7 @@ func AcceptOrgInvite(userId string, orgId string, username string) error {
 	return nil
 }
 
-func DeclineOrgInvite(userId string, orgId string, username string) error {
+func DeclineOrgInvite(userId string, orgId string, username string, actor AuditActor) error {
 	statement, err := dbClient.Prepare("DELETE FROM org_invites WHERE org_id = ? AND user_id = ?")
 	if err != nil {
 		return err
@@ -174,41 +191,18 @@ func DeclineOrgInvite(userId string, orgId string, username string) error {
 		return fmt.Errorf("operation failed. Please try again later")
 	}
 
-	rowId, err := result.LastInsertId()
-
-	// don't want the upload function to error out if we are unable to send out a notification because the operation itself worked
-	if err != nil {
-		log.Printf("error: could not read file ID: %v", err.Error())
-	}
-
-	// convert the id to a string
-	payloadID := strconv.FormatInt(rowId, 10)
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "invite.declined",
+		TargetType: "member",
+		TargetID:   userId,
+		Before:     map[string]any{"username": username},
+	})
 
 	// send notification to all org members + org owner if applicable
-	err = SendNotificationToOrgMembers(orgId, userId, "decline invite", "Declined Invite to join", payloadID, username)
+	err = SendNotificationToOrgMembers(orgId, userId, EventInviteDeclined, "Declined Invite to join", EventPayload{UserID: userId, Username: username})
 	if err != nil {
 		log.Printf("error: could not send out notification to decline invite: %v", err.Error())
 	}
 	return nil
 }
-
-func HasExceededLimit(userId string) (bool, error) {
-	statement, err := dbClient.Prepare("SELECT COUNT(id) FROM org_members WHERE user_id = ?")
-
-	if err != nil {
-		return true, err
-	}
-
-	defer statement.Close()
-
-	var count int
-
-	err = statement.QueryRow(userId).Scan(&count)
-
-	if err != nil {
-		return true, err
-	}
-
-	return count >= 3, nil
-
-}
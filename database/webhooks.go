@@ -0,0 +1,563 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrUnknownWebhookEvent     = errors.New("unknown webhook event")
+)
+
+// sent on its own when a webhook is tested, never part of a subscription
+const WebhookEventPing = "ping"
+
+// every event a webhook can subscribe to, the org events in the catalogue in the order they are shown to the client
+var WebhookEvents = orgEvents()
+
+func orgEvents() []string {
+	events := []string{}
+	for _, eventType := range EventCatalogue {
+		if eventType.Scope == EventScopeOrg {
+			events = append(events, eventType.Name)
+		}
+	}
+	return events
+}
+
+// a webhook as the org sees it, the secret is only ever returned when the webhook is made
+type Webhook struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	CreatedBy string   `json:"createdBy"`
+	CreatedAt int64    `json:"createdAt"`
+}
+
+// one event going to one webhook, and how the last attempt at it went
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhookId"`
+	EventID        string          `json:"eventId"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int64           `json:"attempts"`
+	NextAttemptAt  *int64          `json:"nextAttemptAt"`
+	LastAttemptAt  *int64          `json:"lastAttemptAt"`
+	ResponseStatus *int64          `json:"responseStatus"`
+	ResponseBody   string          `json:"responseBody"`
+	Error          string          `json:"error"`
+	CreatedAt      int64           `json:"createdAt"`
+}
+
+// what the worker needs to send a delivery
+type QueuedWebhookDelivery struct {
+	ID       int64
+	URL      string
+	Secret   string
+	EventID  string
+	Event    string
+	Payload  string
+	Attempts int64
+}
+
+// the outcome of one attempt, status code 0 when no response came back
+type WebhookAttempt struct {
+	StatusCode   int
+	ResponseBody string
+	Error        string
+	Succeeded    bool
+	// when to try again, nil once the delivery has succeeded or run out of attempts
+	NextAttemptAt *time.Time
+}
+
+// the body every delivery is sent with
+type webhookPayload struct {
+	ID        string        `json:"id"`
+	Event     string        `json:"event"`
+	CreatedAt int64         `json:"createdAt"`
+	OrgID     string        `json:"orgId"`
+	Actor     *webhookActor `json:"actor"`
+	// the event's payload as described by its schema in the catalogue
+	Data any `json:"data"`
+}
+
+type webhookActor struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// events are checked against WebhookEvents, an empty list subscribes to every event including ones added later
+func CreateWebhook(orgId string, createdBy string, url string, events []string, actor AuditActor) (int64, string, error) {
+	err := checkWebhookEvents(events)
+	if err != nil {
+		return 0, "", err
+	}
+
+	secret, err := GenerateToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	result, err := dbClient.Exec(
+		"INSERT INTO webhook (org_id, url, secret, events, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		orgId, url, secret, nullIfEmpty(strings.Join(events, ",")), createdBy, time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	webhookId, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// the secret is only ever shown to the member who made the webhook
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "webhook.created",
+		TargetType: "webhook",
+		TargetID:   strconv.FormatInt(webhookId, 10),
+		After:      map[string]any{"url": url, "events": events, "active": true},
+	})
+
+	return webhookId, secret, nil
+}
+
+func GetWebhooks(orgId string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+
+	rows, err := dbClient.Query(`
+		SELECT w.id, w.url, COALESCE(w.events, ''), w.active, COALESCE(user.username, ''), w.created_at
+		FROM webhook w
+		LEFT JOIN user ON user.id = w.created_by
+		WHERE w.org_id = ?
+		ORDER BY w.created_at DESC
+	`, orgId)
+	if err != nil {
+		return webhooks, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		err := rows.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Active, &webhook.CreatedBy, &webhook.CreatedAt)
+		if err != nil {
+			continue
+		}
+		webhook.Events = splitList(events)
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// pausing a webhook keeps its pending deliveries queued, they go out once it is turned back on
+// a nil active leaves it as it is
+func UpdateWebhook(orgId string, webhookId string, url string, events []string, active *bool, actor AuditActor) error {
+	err := checkWebhookEvents(events)
+	if err != nil {
+		return err
+	}
+
+	before, err := webhookAuditValues(orgId, webhookId)
+	if err != nil {
+		return err
+	}
+
+	result, err := dbClient.Exec(
+		"UPDATE webhook SET url = ?, events = ?, active = COALESCE(?, active) WHERE id = ? AND org_id = ?",
+		url, nullIfEmpty(strings.Join(events, ",")), active, webhookId, orgId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+
+	after, err := webhookAuditValues(orgId, webhookId)
+	if err != nil {
+		log.Printf("error: could not read updated webhook: %v", err.Error())
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "webhook.updated",
+		TargetType: "webhook",
+		TargetID:   webhookId,
+		Before:     before,
+		After:      after,
+	})
+
+	return nil
+}
+
+// the delivery log goes with it
+func DeleteWebhook(orgId string, webhookId string, actor AuditActor) error {
+	before, err := webhookAuditValues(orgId, webhookId)
+	if err != nil {
+		return err
+	}
+
+	result, err := dbClient.Exec("DELETE FROM webhook WHERE id = ? AND org_id = ?", webhookId, orgId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "webhook.deleted",
+		TargetType: "webhook",
+		TargetID:   webhookId,
+		Before:     before,
+	})
+
+	return nil
+}
+
+// what the log keeps of a webhook, never the secret
+func webhookAuditValues(orgId string, webhookId string) (map[string]any, error) {
+	var url, events string
+	var active bool
+
+	err := dbClient.QueryRow("SELECT url, COALESCE(events, ''), active FROM webhook WHERE id = ? AND org_id = ?", webhookId, orgId).Scan(&url, &events, &active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+
+	return map[string]any{"url": url, "events": splitList(events), "active": active}, nil
+}
+
+// newest first, paged by id the same way as notifications
+func GetWebhookDeliveries(orgId string, webhookId string, before int64, limit int) ([]WebhookDelivery, *int64, error) {
+	deliveries := []WebhookDelivery{}
+
+	var exists bool
+	err := dbClient.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook WHERE id = ? AND org_id = ?)", webhookId, orgId).Scan(&exists)
+	if err != nil {
+		return deliveries, nil, err
+	}
+
+	if !exists {
+		return deliveries, nil, ErrWebhookNotFound
+	}
+
+	rows, err := dbClient.Query(`
+		SELECT id, webhook_id, event_id, event, payload, status, attempts, next_attempt_at, last_attempt_at, response_status, COALESCE(response_body, ''), COALESCE(error, ''), created_at
+		FROM webhook_delivery
+		WHERE webhook_id = ? AND (? = 0 OR id < ?)
+		ORDER BY id DESC
+		LIMIT ?
+	`, webhookId, before, before, limit+1)
+	if err != nil {
+		return deliveries, nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		var nextAttemptAt, lastAttemptAt, responseStatus sql.NullInt64
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.Event,
+			&payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&nextAttemptAt,
+			&lastAttemptAt,
+			&responseStatus,
+			&delivery.ResponseBody,
+			&delivery.Error,
+			&delivery.CreatedAt,
+		)
+		if err != nil {
+			return deliveries, nil, err
+		}
+		delivery.Payload = json.RawMessage(payload)
+		delivery.LastAttemptAt = nullableInt(lastAttemptAt)
+		delivery.ResponseStatus = nullableInt(responseStatus)
+		// only pending deliveries are waiting on a next attempt
+		if delivery.Status == "pending" {
+			delivery.NextAttemptAt = nullableInt(nextAttemptAt)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return deliveries, nil, err
+	}
+
+	if len(deliveries) <= limit {
+		return deliveries, nil, nil
+	}
+
+	deliveries = deliveries[:limit]
+	next := deliveries[len(deliveries)-1].ID
+
+	return deliveries, &next, nil
+}
+
+// queues the same event again as a new delivery so the log keeps every attempt
+// the event id stays the same so the receiver can tell it is a repeat
+func RedeliverWebhook(orgId string, deliveryId string, actor AuditActor) (int64, error) {
+	var newId int64
+	err := dbClient.QueryRow(`
+		INSERT INTO webhook_delivery (webhook_id, event_id, event, payload, next_attempt_at, created_at)
+		SELECT d.webhook_id, d.event_id, d.event, d.payload, ?, ?
+		FROM webhook_delivery d
+		JOIN webhook w ON w.id = d.webhook_id
+		WHERE d.id = ? AND w.org_id = ?
+		RETURNING id
+	`, time.Now().Unix(), time.Now().Unix(), deliveryId, orgId).Scan(&newId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrWebhookDeliveryNotFound
+		}
+		return 0, err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "webhook.redelivered",
+		TargetType: "webhook_delivery",
+		TargetID:   deliveryId,
+		After:      map[string]any{"deliveryId": newId},
+	})
+
+	return newId, nil
+}
+
+// queues a ping for the webhook alone, whatever it is subscribed to
+func PingWebhook(orgId string, webhookId string, actor AuditActor) (int64, error) {
+	var exists bool
+	err := dbClient.QueryRow("SELECT EXISTS(SELECT 1 FROM webhook WHERE id = ? AND org_id = ?)", webhookId, orgId).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+
+	if !exists {
+		return 0, ErrWebhookNotFound
+	}
+
+	eventId, payload, err := buildWebhookPayload(orgId, actor.UserID, WebhookEventPing, map[string]any{"webhookId": webhookId})
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+
+	var deliveryId int64
+	err = dbClient.QueryRow(`
+		INSERT INTO webhook_delivery (webhook_id, event_id, event, payload, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, webhookId, eventId, WebhookEventPing, payload, now, now).Scan(&deliveryId)
+	if err != nil {
+		return 0, err
+	}
+
+	recordAudit(actor, auditEntry{
+		OrgID:      orgId,
+		Action:     "webhook.pinged",
+		TargetType: "webhook",
+		TargetID:   webhookId,
+		After:      map[string]any{"deliveryId": deliveryId},
+	})
+
+	return deliveryId, nil
+}
+
+// takes up to limit due deliveries off the queue
+// they are pushed back by the lease first so a delivery still being sent isn't picked up again, a worker that dies mid send leaves it to be retried after the lease
+func ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]QueuedWebhookDelivery, error) {
+	deliveries := []QueuedWebhookDelivery{}
+
+	rows, err := dbClient.Query(`
+		UPDATE webhook_delivery SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT d.id FROM webhook_delivery d
+			JOIN webhook w ON w.id = d.webhook_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= ? AND w.active = 1
+			ORDER BY d.next_attempt_at
+			LIMIT ?
+		)
+		RETURNING id
+	`, now.Add(lease).Unix(), now.Unix(), limit)
+	if err != nil {
+		return deliveries, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return deliveries, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return deliveries, rows.Err()
+	}
+
+	claimed, err := json.Marshal(ids)
+	if err != nil {
+		return deliveries, err
+	}
+
+	rows, err = dbClient.Query(`
+		SELECT d.id, w.url, w.secret, d.event_id, d.event, d.payload, d.attempts
+		FROM webhook_delivery d
+		JOIN webhook w ON w.id = d.webhook_id
+		WHERE d.id IN (SELECT value FROM json_each(?))
+	`, string(claimed))
+	if err != nil {
+		return deliveries, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var delivery QueuedWebhookDelivery
+		err := rows.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.EventID, &delivery.Event, &delivery.Payload, &delivery.Attempts)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func RecordWebhookAttempt(deliveryId int64, attempt WebhookAttempt, attemptedAt time.Time) error {
+	status := "failed"
+	nextAttemptAt := attemptedAt.Unix()
+	if attempt.Succeeded {
+		status = "succeeded"
+	} else if attempt.NextAttemptAt != nil {
+		status = "pending"
+		nextAttemptAt = attempt.NextAttemptAt.Unix()
+	}
+
+	var responseStatus any
+	if attempt.StatusCode > 0 {
+		responseStatus = attempt.StatusCode
+	}
+
+	_, err := dbClient.Exec(`
+		UPDATE webhook_delivery
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_attempt_at = ?, response_status = ?, response_body = ?, error = ?
+		WHERE id = ?
+	`, status, nextAttemptAt, attemptedAt.Unix(), responseStatus, nullIfEmpty(attempt.ResponseBody), nullIfEmpty(attempt.Error), deliveryId)
+	return err
+}
+
+// queues the notification's event for every webhook in the org subscribed to it, with the payload it was stored with
+func enqueueWebhookEvent(n Notify, data string) error {
+	event := n.Event
+
+	// most orgs have no webhooks, so don't build a payload nobody will get
+	var subscribed bool
+	err := dbClient.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM webhook
+			WHERE org_id = ? AND (events IS NULL OR ',' || events || ',' LIKE '%,' || ? || ',%')
+		)
+	`, n.OrgID, event).Scan(&subscribed)
+	if err != nil || !subscribed {
+		return err
+	}
+
+	eventId, payload, err := buildWebhookPayload(n.OrgID, n.ActorID, event, json.RawMessage(data))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	// paused webhooks still get the delivery queued, it goes out when they are turned back on
+	_, err = dbClient.Exec(`
+		INSERT INTO webhook_delivery (webhook_id, event_id, event, payload, next_attempt_at, created_at)
+		SELECT id, ?, ?, ?, ?, ?
+		FROM webhook
+		WHERE org_id = ? AND (events IS NULL OR ',' || events || ',' LIKE '%,' || ? || ',%')
+	`, eventId, event, payload, now, now, n.OrgID, event)
+	return err
+}
+
+func buildWebhookPayload(orgId string, actorId string, event string, data any) (string, string, error) {
+	eventId := uuid.New().String()
+
+	var actor *webhookActor
+	if len(actorId) > 0 {
+		username, err := GetUsernameById(actorId)
+		if err == nil {
+			actor = &webhookActor{ID: actorId, Username: username}
+		}
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		ID:        eventId,
+		Event:     event,
+		CreatedAt: time.Now().Unix(),
+		OrgID:     orgId,
+		Actor:     actor,
+		Data:      data,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return eventId, string(payload), nil
+}
+
+func checkWebhookEvents(events []string) error {
+	for _, event := range events {
+		if !slices.Contains(WebhookEvents, event) {
+			return ErrUnknownWebhookEvent
+		}
+	}
+
+	return nil
+}
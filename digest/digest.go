@@ -0,0 +1,217 @@
+package digest
+
+import (
+	"bytes"
+	"embed"
+	"fms/database"
+	"fms/mailer"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// only the newest few of each type are listed, the rest are counted
+const maxItemsPerType = 5
+
+//go:embed templates
+var templates embed.FS
+
+var (
+	textTemplate = texttemplate.Must(texttemplate.ParseFS(templates, "templates/digest.txt"))
+	htmlTemplate = htmltemplate.Must(htmltemplate.ParseFS(templates, "templates/digest.html"))
+)
+
+type Config struct {
+	// base url of the web client, for the links in the email body
+	AppURL string
+	// base url of this api, empty leaves out one click unsubscribe since the header has to point straight at the api
+	APIURL string
+}
+
+var current = Config{AppURL: "http://localhost:5173"}
+
+func Configure(cfg Config) {
+	current = cfg
+}
+
+type digestData struct {
+	Username       string
+	Frequency      string
+	Total          int
+	Orgs           []orgGroup
+	AppURL         string
+	SettingsURL    string
+	UnsubscribeURL string
+}
+
+type orgGroup struct {
+	Name  string
+	Types []typeGroup
+}
+
+type typeGroup struct {
+	Label string
+	Count int
+	Items []item
+	More  int
+}
+
+type item struct {
+	Actor       string
+	Message     string
+	PayloadName string
+}
+
+// checks for due digests straight away and then every interval for as long as the server is up
+// a digest that fails to send is left pending and tried again on the next run
+func Start(interval time.Duration) {
+	go func() {
+		for {
+			sent, err := SendDue(time.Now())
+			if err != nil {
+				log.Printf("error: could not send notification digests: %v", err.Error())
+			} else if sent > 0 {
+				log.Printf("digest: sent %d notification digests", sent)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// sends every digest that is due and returns how many went out
+func SendDue(now time.Time) (int, error) {
+	err := database.PruneUnsubscribeTokens(now)
+	if err != nil {
+		log.Printf("error: could not prune unsubscribe tokens: %v", err.Error())
+	}
+
+	recipients, err := database.GetDueDigestRecipients(now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, recipient := range recipients {
+		// one bad address or template shouldn't hold up everyone else's digest
+		err := send(recipient, now)
+		if err != nil {
+			log.Printf("error: could not send digest to user %s: %v", recipient.UserID, err.Error())
+			continue
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+func send(recipient database.DigestRecipient, now time.Time) error {
+	notifications, err := database.GetPendingDigestNotifications(recipient.UserID, now)
+	if err != nil {
+		return err
+	}
+
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	token, err := database.CreateUnsubscribeToken(recipient.UserID, recipient.Email)
+	if err != nil {
+		return err
+	}
+
+	data := digestData{
+		Username:       recipient.Username,
+		Frequency:      recipient.Frequency,
+		Total:          len(notifications),
+		Orgs:           group(notifications),
+		AppURL:         current.AppURL,
+		SettingsURL:    current.AppURL + "/settings",
+		UnsubscribeURL: fmt.Sprintf("%s/unsubscribe?token=%s", current.AppURL, url.QueryEscape(token)),
+	}
+
+	var text, html bytes.Buffer
+
+	err = textTemplate.Execute(&text, data)
+	if err != nil {
+		return err
+	}
+
+	err = htmlTemplate.Execute(&html, data)
+	if err != nil {
+		return err
+	}
+
+	// mail clients show their own unsubscribe button from this header
+	// with the api's address they can unsubscribe in one click, without it the button opens the same page as the link in the email
+	headers := map[string]string{
+		"List-Unsubscribe": "<" + data.UnsubscribeURL + ">",
+	}
+	if len(current.APIURL) > 0 {
+		headers["List-Unsubscribe"] = fmt.Sprintf("<%s/unsubscribe?token=%s>", current.APIURL, url.QueryEscape(token))
+		headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	}
+
+	subject := fmt.Sprintf("Your %s FMS digest: %d unread notifications", recipient.Frequency, len(notifications))
+	if len(notifications) == 1 {
+		subject = fmt.Sprintf("Your %s FMS digest: 1 unread notification", recipient.Frequency)
+	}
+
+	err = mailer.Send(mailer.Message{
+		To:      recipient.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, len(notifications))
+	for i, notif := range notifications {
+		ids[i] = notif.ID
+	}
+
+	return database.MarkDigestSent(recipient.UserID, ids, now)
+}
+
+// the notifications come sorted by org and then type, so a new group starts whenever either changes
+func group(notifications []database.DigestNotification) []orgGroup {
+	orgs := []orgGroup{}
+
+	for _, notif := range notifications {
+		if len(orgs) == 0 || orgs[len(orgs)-1].Name != notif.OrgName {
+			orgs = append(orgs, orgGroup{Name: notif.OrgName})
+		}
+		org := &orgs[len(orgs)-1]
+
+		label := typeLabel(notif.NotifType)
+		if len(org.Types) == 0 || org.Types[len(org.Types)-1].Label != label {
+			org.Types = append(org.Types, typeGroup{Label: label})
+		}
+		types := &org.Types[len(org.Types)-1]
+
+		types.Count++
+		if len(types.Items) < maxItemsPerType {
+			types.Items = append(types.Items, item{Actor: notif.ActorUsername, Message: notif.Message, PayloadName: notif.PayloadName})
+		} else {
+			types.More++
+		}
+	}
+
+	return orgs
+}
+
+// "file upload" reads as "File upload"
+func typeLabel(notifType string) string {
+	if len(notifType) == 0 {
+		return "Other"
+	}
+
+	return strings.ToUpper(notifType[:1]) + notifType[1:]
+}
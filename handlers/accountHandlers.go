@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fms/auth"
+	"fms/database"
+	"fms/mailer"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+const verifyEmailTokenTTL = 24 * time.Hour
+const resetPasswordTokenTTL = time.Hour
+
+// base url of the web client, links in emails point here and the client calls back into the api with the token
+var appURL = "https://fmsatiya.live"
+
+func SetAppURL(baseURL string) {
+	appURL = strings.TrimRight(baseURL, "/")
+}
+
+func HandleChangeEmail(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	email := strings.TrimSpace(c.FormValue("email"))
+
+	err := validator.New().Var(email, "required,email")
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Please enter a valid email address",
+		})
+	}
+
+	err = database.SetUserEmail(user.ID, email)
+	if err != nil {
+		if errors.Is(err, database.ErrEmailTaken) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// the email is saved either way, the user can ask for another link if this one didn't go out
+	err = sendVerificationEmail(user.ID, user.Username, email)
+	if err != nil {
+		log.Printf("error: could not send verification email: %v", err.Error())
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleResendVerification(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	if len(user.Email) == 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "There is no email address on this account",
+		})
+	}
+
+	if user.EmailVerified {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+
+	err := sendVerificationEmail(user.ID, user.Username, user.Email)
+	if err != nil {
+		if errors.Is(err, database.ErrTokenRateLimited) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// doesn't need a session, the token itself proves the user can read the inbox
+func HandleVerifyEmail(c fiber.Ctx) error {
+	token := c.FormValue("token")
+
+	if len(token) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	userId, email, err := database.ConsumeUserToken(token, database.TokenPurposeVerifyEmail)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.MarkEmailVerified(userId, email)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// always responds the same way whether or not an account was found
+// otherwise the form could be used to check which usernames and emails are registered
+func HandleForgotPassword(c fiber.Ctx) error {
+	identifier := strings.TrimSpace(c.FormValue("identifier"))
+
+	if len(identifier) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	// the lookup and the mail go out in the background so the response time doesn't give away whether the account exists either
+	go func() {
+		user, err := database.GetUserForRecovery(identifier)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("error: could not look up account for password reset: %v", err.Error())
+			}
+			return
+		}
+
+		err = sendPasswordResetEmail(user)
+		if err != nil && !errors.Is(err, database.ErrTokenRateLimited) {
+			log.Printf("error: could not send password reset email: %v", err.Error())
+		}
+	}()
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If an account with a verified email matches, a reset link has been sent to it",
+	})
+}
+
+func HandleResetPassword(c fiber.Ctx) error {
+	token := c.FormValue("token")
+	newPassword := c.FormValue("new-password")
+	confirmNewPassword := c.FormValue("confirm-new-password")
+
+	if len(token) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if newPassword != confirmNewPassword {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Passwords don't match",
+		})
+	}
+
+	// validate before consuming the token so a rejected password doesn't burn the link
+	err := auth.ValidatePassword(newPassword)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	userId, _, err := database.ConsumeUserToken(token, database.TokenPurposeResetPassword)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.ChangePassword(userId, newPassword)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// whoever had the old password shouldn't keep their session
+	err = database.InvalidateUserSessions(userId)
+	if err != nil {
+		log.Printf("error: could not invalidate sessions after password reset: %v", err.Error())
+	}
+
+	// the user just proved they can read this inbox so a lockout from the attempts that led here shouldn't keep them out
+	user, err := database.GetUser(userId)
+	if err == nil {
+		err = database.ClearFailedLogins(user.Username)
+		if err != nil {
+			log.Printf("error: could not clear failed logins after password reset: %v", err.Error())
+		}
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func sendVerificationEmail(userId string, username string, email string) error {
+	token, err := database.CreateUserToken(userId, database.TokenPurposeVerifyEmail, email, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", appURL, url.QueryEscape(token))
+
+	return mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Text: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm this is your email address by opening the link below. It expires in 24 hours.\n\n%s\n\nIf you didn't add this address to an FMS account you can ignore this email.\n",
+			username, link,
+		),
+	})
+}
+
+func sendPasswordResetEmail(user database.User) error {
+	token, err := database.CreateUserToken(user.ID, database.TokenPurposeResetPassword, user.Email, resetPasswordTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", appURL, url.QueryEscape(token))
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password for your FMS account. Open the link below to choose a new one. It expires in 1 hour and can only be used once.\n\n%s\n\nIf this wasn't you, you can ignore this email and your password will stay the same.\n",
+			user.Username, link,
+		),
+	})
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"errors"
+	"fms/database"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+// the caller's folder access in the org of the request, only meaningful behind RequireCapability
+// members who manage folders skip the access lists entirely
+func currentFolderAccess(c fiber.Ctx) (*database.FolderAccess, error) {
+	membership := CurrentMembership(c)
+
+	if membership.Access.Has(database.CapFolderManage) {
+		return database.UnrestrictedFolderAccess(), nil
+	}
+
+	return database.LoadFolderAccess(CurrentUser(c).ID, membership.OrgID)
+}
+
+// checks one folder, an empty folder id is the root of the org
+func canAccessFolder(c fiber.Ctx, folderId string, permission string) (bool, error) {
+	access, err := currentFolderAccess(c)
+	if err != nil {
+		return false, err
+	}
+
+	return access.Allows(folderId, permission), nil
+}
+
+func HandleGetFolderACL(c fiber.Ctx) error {
+	folderId := c.Query("folder-id")
+
+	if len(folderId) == 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing URL params.",
+		})
+	}
+
+	entries, err := database.GetFolderACL(CurrentMembership(c).OrgID, folderId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"entries": entries,
+	})
+}
+
+func HandleSetFolderACL(c fiber.Ctx) error {
+	type setACLStruct struct {
+		Org_id         string `json:"org_id" validate:"required"`
+		Folder_id      string `json:"folder_id" validate:"required"`
+		Principal_type string `json:"principal_type" validate:"required"`
+		Principal      string `json:"principal" validate:"required"`
+		Permission     string `json:"permission" validate:"required"`
+		Effect         string `json:"effect" validate:"required"`
+	}
+
+	var setACLData setACLStruct
+
+	err := c.Bind().Body(&setACLData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	validate := validator.New()
+
+	err = validate.Struct(setACLData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if !database.IsValidFolderPermission(setACLData.Permission) || !database.IsValidACLEffect(setACLData.Effect) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Permission must be view or edit and effect must be allow or deny",
+		})
+	}
+
+	err = database.SetFolderACLEntry(CurrentMembership(c).OrgID, setACLData.Folder_id, setACLData.Principal_type, setACLData.Principal, setACLData.Permission, setACLData.Effect, auditActor(c))
+	if err != nil {
+		return aclError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDeleteFolderACL(c fiber.Ctx) error {
+	entryId := c.Query("entry_id")
+
+	if len(entryId) == 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing URL params.",
+		})
+	}
+
+	err := database.DeleteFolderACLEntry(CurrentMembership(c).OrgID, entryId, auditActor(c))
+	if err != nil {
+		return aclError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleRestrictFolder(c fiber.Ctx) error {
+	folderId := c.Query("folder-id")
+	restricted := c.Query("restricted")
+
+	if len(folderId) == 0 || (restricted != "true" && restricted != "false") {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing URL params.",
+		})
+	}
+
+	err := database.SetFolderRestricted(CurrentMembership(c).OrgID, folderId, restricted == "true", auditActor(c))
+	if err != nil {
+		return aclError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func aclError(c fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, database.ErrFolderNotFound), errors.Is(err, database.ErrACLEntryNotFound):
+		return c.SendStatus(fiber.StatusNotFound)
+	case errors.Is(err, database.ErrPrincipalNotFound):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fms/database"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+func HandleGetAuditLog(c fiber.Ctx) error {
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	filter.Limit, err = strconv.Atoi(c.Query("limit", strconv.Itoa(defaultAuditPageSize)))
+	if err != nil || filter.Limit < 1 || filter.Limit > maxAuditPageSize {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("Limit must be between 1 and %d", maxAuditPageSize),
+		})
+	}
+
+	cursor := c.Query("cursor")
+	if len(cursor) > 0 {
+		filter.Before, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || filter.Before < 1 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+	}
+
+	events, next, err := database.GetAuditEvents(CurrentMembership(c).OrgID, filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not read the audit log",
+		})
+	}
+
+	var nextCursor *string
+	if next != nil {
+		value := strconv.FormatInt(*next, 10)
+		nextCursor = &value
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"events":     events,
+		"nextCursor": nextCursor,
+	})
+}
+
+// the whole matching log oldest first as a download, json by default or csv
+// an unfiltered export carries every hash, so it can be checked against the chain without this server
+func HandleExportAuditLog(c fiber.Ctx) error {
+	format := c.Query("format", "json")
+
+	if format != "json" && format != "csv" {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Format must be json or csv",
+		})
+	}
+
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	orgId := CurrentMembership(c).OrgID
+
+	events, err := database.ExportAuditEvents(orgId, filter)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not read the audit log",
+		})
+	}
+
+	var body []byte
+	if format == "csv" {
+		body, err = auditCSV(events)
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		body, err = json.Marshal(events)
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not export the audit log",
+		})
+	}
+
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%s.%s"`, orgId, format))
+	return c.Status(fiber.StatusOK).Send(body)
+}
+
+func HandleVerifyAuditLog(c fiber.Ctx) error {
+	verification, err := database.VerifyAuditChain(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not verify the audit log",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(verification)
+}
+
+// the filters both the log and the export take, since and until are unix times
+func auditFilter(c fiber.Ctx) (database.AuditFilter, error) {
+	filter := database.AuditFilter{
+		Action:     c.Query("action"),
+		ActorID:    c.Query("actor_id"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+	}
+
+	var err error
+
+	since := c.Query("since")
+	if len(since) > 0 {
+		filter.Since, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || filter.Since < 0 {
+			return filter, errors.New("Invalid since")
+		}
+	}
+
+	until := c.Query("until")
+	if len(until) > 0 {
+		filter.Until, err = strconv.ParseInt(until, 10, 64)
+		if err != nil || filter.Until < 0 {
+			return filter, errors.New("Invalid until")
+		}
+	}
+
+	return filter, nil
+}
+
+// one row per event, before and after stay as their json text
+func auditCSV(events []database.AuditEvent) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	err := writer.Write([]string{
+		"seq", "created_at", "actor_id", "actor_username", "action", "target_type", "target_id",
+		"ip", "user_agent", "before", "after", "prev_hash", "hash",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		err := writer.Write([]string{
+			strconv.FormatInt(event.Seq, 10), strconv.FormatInt(event.CreatedAt, 10), event.ActorID, event.ActorUsername,
+			event.Action, event.TargetType, event.TargetID, event.IP, event.UserAgent,
+			string(event.Before), string(event.After), event.PrevHash, event.Hash,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
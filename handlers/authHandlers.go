@@ -1,15 +1,19 @@
 package handlers
 
 import (
+	"errors"
+	"fms/auth"
 	"fms/database"
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/csrf"
 )
 
-var passwordLengthMin = 6
-var passwordLengthMax = 12
-
 var usernameLengthMin = 6
 var usernameLengthMax = 12
 
@@ -42,14 +46,15 @@ func HandleRegister(c fiber.Ctx) error {
 		})
 	}
 
-	if len(registerData.Password) < passwordLengthMin || len(registerData.Password) > passwordLengthMax {
+	err = auth.ValidatePassword(registerData.Password)
+	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": "Password length must be between 6 and 12 characters",
+			"error": err.Error(),
 		})
 	}
 
 	// attemps to create a user and return a session ID if successful
-	userId, err := database.CreateUser(registerData.Username, registerData.Password)
+	userId, err := database.CreateUser(registerData.Username, registerData.Password, registerData.Email)
 
 	// user creation failed
 	if err != nil {
@@ -58,6 +63,14 @@ func HandleRegister(c fiber.Ctx) error {
 		})
 	}
 
+	// email is optional at sign up, when given it needs verifying before it can be used for recovery
+	if len(registerData.Email) > 0 {
+		err = sendVerificationEmail(userId, registerData.Username, registerData.Email)
+		if err != nil {
+			log.Printf("error: could not send verification email: %v", err.Error())
+		}
+	}
+
 	session, err := database.CreateSession(userId)
 
 	// session creation failed
@@ -96,16 +109,34 @@ func HandleLogin(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusUnauthorized)
 	}
 
-	// validate length of input
+	// every credential failure gets the same message so the response can't be used to find out which usernames exist
+	invalidCredentials := fiber.Map{
+		"error": database.ErrInvalidCredentials.Error(),
+	}
+
+	// usernames outside the allowed lengths can never match an account
 	if len(loginData.Username) < usernameLengthMin || len(loginData.Username) > usernameLengthMax {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": "Username length must be between 6 and 12 characters",
-		})
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(invalidCredentials)
 	}
 
-	if len(loginData.Password) < passwordLengthMin || len(loginData.Password) > passwordLengthMax {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": "Password length must be between 6 and 12 characters",
+	// only the max length is checked for passwords, accounts created under an older policy may have shorter ones
+	// the max still matters because hashing an arbitrarily long input is an easy way to burn server cpu
+	if len(loginData.Password) == 0 || utf8.RuneCountInString(loginData.Password) > auth.PasswordMaxLength() {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(invalidCredentials)
+	}
+
+	ip := c.IP()
+
+	// refuse the attempt before checking the password if either the ip or the username is locked out
+	lockedUntil, err := database.LoginLockedUntil(ip, loginData.Username)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if lockedUntil > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(lockedUntil-time.Now().Unix(), 10))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many failed login attempts. Please try again later.",
 		})
 	}
 
@@ -114,9 +145,19 @@ func HandleLogin(c fiber.Ctx) error {
 
 	// if credentials don't match
 	if err != nil {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		if errors.Is(err, database.ErrInvalidCredentials) {
+			err = database.RecordFailedLogin(ip, loginData.Username)
+			if err != nil {
+				log.Printf("error: could not record failed login: %v", err.Error())
+			}
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(invalidCredentials)
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	err = database.ClearFailedLogins(loginData.Username)
+	if err != nil {
+		log.Printf("error: could not clear failed logins: %v", err.Error())
 	}
 
 	// attempt to create a session for the user after successfully matching credentials
@@ -136,33 +177,27 @@ func HandleLogin(c fiber.Ctx) error {
 
 }
 
-// function to be called on every request
-// attemps to parse session_token cookie and passes into a function that authenticates the cookie
-// if the cookie is valid we return the user if not we return nil
+// lets the client check whether its session is still valid
+// RequireAuth has already rejected the request if it isn't, so all that is left is returning the user
 func AuthRequest(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
 		"error": nil,
-		"user":  userWithSession.User,
+		"user":  user,
 	})
 
 }
 
 func HandleLogout(c fiber.Ctx) error {
-	// attempt to read in the session cookie
-	cookie := c.Cookies("session_token")
-	if len(cookie) == 0 {
-		// if the cookie doesn't exist this endpoint shouldn't be computed
-		c.Status(fiber.StatusUnauthorized)
-	}
-
-	// delete session from the database
-	database.InvalidateSession(cookie)
+	// delete whichever session the request was authenticated with, cookie or bearer token
+	database.InvalidateSession(CurrentPrincipal(c).Session.ID)
 
 	return c.SendStatus(fiber.StatusOK)
 }
+
+func HandleGetCSRFToken(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"csrfToken": csrf.TokenFromContext(c),
+	})
+}
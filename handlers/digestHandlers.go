@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"fms/database"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+func HandleGetDigestSettings(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	frequency, optedIn, err := database.GetDigestFrequency(user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// digests only go to a verified address, the client uses this to explain why none are arriving
+	// optedIn tells the client whether everything unread is included or only what the user sends to email
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"frequency":     frequency,
+		"optedIn":       optedIn,
+		"emailVerified": user.EmailVerified,
+	})
+}
+
+func HandleSetDigestSettings(c fiber.Ctx) error {
+	type digestSettingsStruct struct {
+		Frequency string `json:"frequency" validate:"required"`
+	}
+
+	var settingsData digestSettingsStruct
+
+	err := c.Bind().Body(&settingsData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(settingsData)
+	if err != nil || !database.IsDigestFrequency(settingsData.Frequency) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Frequency must be daily, weekly or off",
+		})
+	}
+
+	err = database.SetDigestFrequency(CurrentUser(c).ID, settingsData.Frequency)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// public, the token from a digest email turns digests off without signing in
+// mail clients doing a one click unsubscribe post straight to the link in the List-Unsubscribe header, so the token can be in the query or the form
+func HandleUnsubscribe(c fiber.Ctx) error {
+	token := c.Query("token", c.FormValue("token"))
+
+	if len(token) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.UnsubscribeFromDigest(token)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fms/database"
+	"fms/realtime"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// a comment line is sent this often so proxies don't close a quiet stream and a closed connection is noticed
+const eventHeartbeatInterval = 25 * time.Second
+
+// folder access is reloaded at most this often per org while a stream is open
+const eventAccessTTL = 30 * time.Second
+
+type streamFolderAccess struct {
+	access   *database.FolderAccess
+	loadedAt time.Time
+}
+
+// a server-sent events stream of new notifications and folder changes in the user's orgs
+// orgs joined after connecting only show up once the client reconnects, orgs left stop sending straight away
+func HandleEvents(c fiber.Ctx) error {
+	userId := CurrentUser(c).ID
+
+	orgIds, err := database.GetUserOrgIds(userId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	// stops nginx style proxies from buffering the stream
+	c.Set("X-Accel-Buffering", "no")
+
+	sub := realtime.Subscribe(userId, orgIds)
+
+	// the writer runs after the handler has returned, so nothing from c can be used in here
+	return c.SendStreamWriter(func(w *bufio.Writer) {
+		defer sub.Close()
+
+		heartbeat := time.NewTicker(eventHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		folderAccess := map[string]*streamFolderAccess{}
+
+		fmt.Fprint(w, "retry: 5000\n\n")
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-sub.Events():
+				if !ok {
+					return
+				}
+
+				if !canReceiveEvent(userId, event, folderAccess) {
+					continue
+				}
+
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("error: could not encode %s event: %v", event.Type, err.Error())
+					continue
+				}
+
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+
+			// a failed flush means the client has gone
+			if w.Flush() != nil {
+				return
+			}
+		}
+	})
+}
+
+// events for the user are always theirs, folder events go through the same access checks as listing the folder
+func canReceiveEvent(userId string, event realtime.Event, cache map[string]*streamFolderAccess) bool {
+	if len(event.UserID) > 0 {
+		return event.UserID == userId
+	}
+
+	cached, ok := cache[event.OrgID]
+	if !ok || time.Since(cached.loadedAt) > eventAccessTTL {
+		access, err := database.LoadMemberFolderAccess(userId, event.OrgID)
+		if err != nil && err != database.ErrNotOrgMember {
+			log.Printf("error: could not load folder access for event stream: %v", err.Error())
+			return false
+		}
+
+		// a nil access is cached as well so someone who left the org isn't checked again on every event
+		cached = &streamFolderAccess{access: access, loadedAt: time.Now()}
+		cache[event.OrgID] = cached
+	}
+
+	if cached.access == nil || !cached.access.Allows(event.FolderID, database.FolderPermissionView) {
+		return false
+	}
+
+	// a restricted subfolder is left out of its parent's listing, so it's left out of the parent's events too
+	change, ok := event.Data.(realtime.FolderChange)
+	if ok && (change.Action == "folder.added" || change.Action == "folder.deleted") {
+		// a deleted folder's row and rules are gone, so access loaded after the delete would let anyone see it
+		// only members whose access still had the folder in it hear about it, the rest see it go on their next listing
+		if change.Action == "folder.deleted" && !cached.access.Knows(change.ID) {
+			return false
+		}
+
+		return cached.access.Allows(change.ID, database.FolderPermissionView)
+	}
+
+	return true
+}
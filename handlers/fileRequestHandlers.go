@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"fms/database"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	maxFileRequestMessageLength = 500
+	maxUploaderNameLength       = 100
+)
+
+func HandleCreateFileRequest(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	type createFileRequestStruct struct {
+		Org_id           string   `json:"org_id" validate:"required"`
+		Folder_id        string   `json:"folder_id" validate:"required"`
+		Message          string   `json:"message"`
+		Max_file_size_mb int64    `json:"max_file_size_mb" validate:"gte=0"`
+		Allowed_types    []string `json:"allowed_types"`
+		Max_uploads      int64    `json:"max_uploads" validate:"gte=0"`
+		Require_uploader bool     `json:"require_uploader"`
+		Expires_in_hours int      `json:"expires_in_hours" validate:"gte=0"`
+	}
+
+	var requestData createFileRequestStruct
+
+	err := c.Bind().Body(&requestData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(requestData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	message := strings.TrimSpace(requestData.Message)
+	if len(message) > maxFileRequestMessageLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("The message can be at most %d characters", maxFileRequestMessageLength),
+		})
+	}
+
+	// a file request can only tighten the limits every upload has, never loosen them
+	maxFileSize := maxUploadSize
+	if requestData.Max_file_size_mb > 0 {
+		maxFileSize = requestData.Max_file_size_mb * 1024 * 1024
+		if maxFileSize > maxUploadSize {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Maximum file size is 10MB",
+			})
+		}
+	}
+
+	allowedTypes := []string{}
+	for _, fileType := range requestData.Allowed_types {
+		fileType = strings.ToLower(strings.TrimSpace(fileType))
+		if !strings.HasPrefix(fileType, ".") {
+			fileType = "." + fileType
+		}
+
+		if _, ok := uploadContentTypes[fileType]; !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "File type not supported. Please pick from PDF, DOC, DOCX, JPG, or PNG",
+			})
+		}
+
+		if !slices.Contains(allowedTypes, fileType) {
+			allowedTypes = append(allowedTypes, fileType)
+		}
+	}
+
+	// uploads land in the folder, so the member has to be able to upload there themselves
+	allowed, err := canAccessFolder(c, requestData.Folder_id, database.FolderPermissionEdit)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if !allowed {
+		return forbidden(c)
+	}
+
+	ttl := time.Duration(requestData.Expires_in_hours) * time.Hour
+
+	token, linkId, err := database.CreateFileRequestLink(membership.OrgID, user.ID, requestData.Folder_id, message, maxFileSize, allowedTypes, requestData.Max_uploads, requestData.Require_uploader, ttl, auditActor(c))
+	if err != nil {
+		return fileRequestError(c, err)
+	}
+
+	// the token is only ever shown here, the database keeps its hash
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":    linkId,
+		"token": token,
+		"link":  fmt.Sprintf("%s/r/%s", appURL, url.PathEscape(token)),
+	})
+}
+
+// members who manage folders see every file request in the org, everyone else sees the ones they made
+func HandleGetFileRequests(c fiber.Ctx) error {
+	links, err := database.GetFileRequestLinks(CurrentMembership(c).OrgID, shareLinkOwnerScope(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"requests": links,
+	})
+}
+
+func HandleRevokeFileRequest(c fiber.Ctx) error {
+	linkId := c.Query("link_id")
+
+	if len(linkId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RevokeFileRequestLink(CurrentMembership(c).OrgID, linkId, shareLinkOwnerScope(c), auditActor(c))
+	if err != nil {
+		return fileRequestError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleGetFileRequestUploads(c fiber.Ctx) error {
+	linkId := c.Query("link_id")
+
+	if len(linkId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	uploads, err := database.GetFileRequestUploads(CurrentMembership(c).OrgID, linkId, shareLinkOwnerScope(c))
+	if err != nil {
+		return fileRequestError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"uploads": uploads,
+	})
+}
+
+// public, what the uploader needs to know before sending anything
+// nothing about what is already in the folder is returned
+func HandleViewFileRequest(c fiber.Ctx) error {
+	link, ok := openFileRequest(c)
+	if !ok {
+		return nil
+	}
+
+	var remaining *int64
+	if link.MaxUploads != nil {
+		left := max(*link.MaxUploads-link.UploadCount, 0)
+		remaining = &left
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"folderName":       link.FolderName,
+		"message":          link.Message,
+		"maxFileSize":      link.MaxFileSize,
+		"allowedTypes":     link.AllowedTypes,
+		"remainingUploads": remaining,
+		"requireUploader":  link.RequireUploader,
+		"expiresAt":        link.ExpiresAt,
+	})
+}
+
+// public, takes one file in the file form field with optional uploader_name and uploader_email fields
+func HandleUploadToFileRequest(c fiber.Ctx) error {
+	link, ok := openFileRequest(c)
+	if !ok {
+		return nil
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to get file: " + err.Error(),
+		})
+	}
+
+	uploaderName := strings.TrimSpace(c.FormValue("uploader_name"))
+	uploaderEmail := strings.TrimSpace(c.FormValue("uploader_email"))
+
+	if link.RequireUploader && (len(uploaderName) == 0 || len(uploaderEmail) == 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please enter your name and email",
+		})
+	}
+
+	if len(uploaderName) > maxUploaderNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Name can be at most %d characters", maxUploaderNameLength),
+		})
+	}
+
+	if len(uploaderEmail) > 0 && validator.New().Var(uploaderEmail, "email") != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Please enter a valid email",
+		})
+	}
+
+	if !checkUploadedFile(c, file) {
+		return nil
+	}
+
+	if len(link.AllowedTypes) > 0 && !slices.Contains(link.AllowedTypes, strings.ToLower(filepath.Ext(file.Filename))) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "File type not accepted. Please upload " + strings.ToUpper(strings.ReplaceAll(strings.Join(link.AllowedTypes, ", "), ".", "")) + " files",
+		})
+	}
+
+	if file.Size > link.MaxFileSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Upload limit exceeded. Maximum file size is %dMB", link.MaxFileSize/(1024*1024)),
+		})
+	}
+
+	// name clashes are sorted out by renaming the upload, anything else that goes wrong gets the same answer
+	// so the uploader can't learn what is already in a folder they can't see
+	err = database.UploadToFileRequest(link, file, uploaderName, uploaderEmail, auditActor(c))
+	if err != nil {
+		switch err {
+		case database.ErrFileRequestNotFound, database.ErrFolderNotFound, database.ErrInvalidToken, database.ErrFileRequestFull:
+			return fileRequestError(c, err)
+		}
+
+		log.Printf("error: could not save file request upload: %v", err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Could not save your file, please try again later",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// looks up the token and makes sure the member who made the link can still upload into the folder
+// writes the response and returns false when the link can't be used
+func openFileRequest(c fiber.Ctx) (*database.FileRequestAccess, bool) {
+	link, err := database.GetFileRequestLinkByToken(c.Params("token"))
+	if err != nil {
+		fileRequestError(c, err)
+		return nil, false
+	}
+
+	access, err := database.GetOrgAccess(link.CreatedBy, link.OrgID)
+	if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return nil, false
+	}
+
+	if access == nil || !access.Has(database.CapFileUpload) {
+		fileRequestError(c, database.ErrInvalidToken)
+		return nil, false
+	}
+
+	folderAccess, err := database.LoadMemberFolderAccess(link.CreatedBy, link.OrgID)
+	if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !folderAccess.Allows(link.FolderID, database.FolderPermissionEdit) {
+		fileRequestError(c, database.ErrInvalidToken)
+		return nil, false
+	}
+
+	return link, true
+}
+
+func fileRequestError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrFileRequestNotFound, database.ErrFolderNotFound:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrInvalidToken, database.ErrFileRequestFull:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
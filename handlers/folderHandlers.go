@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/url"
 	"path/filepath"
 	"regexp"
@@ -15,14 +16,22 @@ import (
 	"github.com/gofiber/fiber/v3"
 )
 
+// 10 (mb) * 1024 * 1024
+const maxUploadSize = int64(10 * 1024 * 1024)
+
+// map common extensions to MIME types, only these can be uploaded
+var uploadContentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
 func HandleCreateFolder(c fiber.Ctx) error {
 
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	type addFolderStruct struct {
 		Name   string `json:"name" validate:"required"`
@@ -31,7 +40,7 @@ func HandleCreateFolder(c fiber.Ctx) error {
 
 	var addFolderData addFolderStruct
 
-	err = c.Bind().Body(&addFolderData)
+	err := c.Bind().Body(&addFolderData)
 	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
 			"error": "Internal server error.",
@@ -90,22 +99,24 @@ func HandleCreateFolder(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusConflict)
 	}
 
-	_, role, err := database.CanViewOrg(userWithSession.User.ID, addFolderData.Org_id)
+	orgId := CurrentMembership(c).OrgID
 
+	allowed, err := canEditFolderByName(c, parentFolderName, orgId)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	if strings.ToLower(role) != "owner" && strings.ToLower(role) != "editor" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "You do not have permissions to carry out this operation",
-		})
+	if !allowed {
+		return forbidden(c)
+	}
+
+	notifyGroupId, ok := notifyGroupFromRequest(c)
+	if !ok {
+		return nil
 	}
 
 	if parentFolderName == "root" {
-		err = database.CreateFolder(userWithSession.User.ID, addFolderData.Name, addFolderData.Org_id)
+		err = database.CreateFolder(user.ID, addFolderData.Name, orgId, notifyGroupId, auditActor(c))
 		if err != nil {
 			if strings.Contains(err.Error(), "exists") {
 				return c.SendStatus(fiber.StatusConflict)
@@ -115,7 +126,7 @@ func HandleCreateFolder(c fiber.Ctx) error {
 			})
 		}
 	} else {
-		err = database.CreateFolderAsChild(userWithSession.User.ID, addFolderData.Name, addFolderData.Org_id, parentFolderName)
+		err = database.CreateFolderAsChild(user.ID, addFolderData.Name, orgId, parentFolderName, notifyGroupId, auditActor(c))
 		if err != nil {
 			if strings.Contains(err.Error(), "exists") {
 				return c.SendStatus(fiber.StatusConflict)
@@ -131,35 +142,20 @@ func HandleCreateFolder(c fiber.Ctx) error {
 }
 
 func HandleViewFolderChildren(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
 	// grab the data from the url search queries
 	folderName := c.Query("folder_name")
-	orgId := c.Query("org_id")
+	orgId := CurrentMembership(c).OrgID
 
 	// validate that the data exists
-	if len(folderName) == 0 || len(orgId) == 0 {
+	if len(folderName) == 0 {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
 			"error": "Missing URL data",
 		})
 	}
 
-	// check if the user has permission to view this org's content
-	// the middle variable is user role which is irrelevent in this context
-	canView, _, err := database.CanViewOrg(userWithSession.User.ID, orgId)
+	access, err := currentFolderAccess(c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	if !canView {
-		return c.SendStatus(fiber.StatusForbidden)
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	// variables to hold the folders and files belonging to an org
@@ -172,10 +168,25 @@ func HandleViewFolderChildren(c fiber.Ctx) error {
 		folderChildren = database.GetRootFolderOfOrg(orgId)
 		fileChildren = database.GetRootFilesOfOrg(orgId)
 	} else {
+		folderId, err := database.GetFolderIdByName(folderName, orgId)
+		if err != nil {
+			if err == database.ErrFolderNotFound {
+				return c.SendStatus(fiber.StatusNotFound)
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		// the files in a folder go with the folder, there is no access list per file
+		if !access.Allows(folderId, database.FolderPermissionView) {
+			return forbidden(c)
+		}
+
 		folderChildren = database.GetFolderChildren(folderName, orgId)
 		fileChildren = database.GetFolderFiles(folderName, orgId)
 	}
 
+	folderChildren = access.FilterFolders(folderChildren)
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"folders": folderChildren,
 		"files":   fileChildren,
@@ -183,11 +194,7 @@ func HandleViewFolderChildren(c fiber.Ctx) error {
 }
 
 func HandleUploadFile(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -196,82 +203,35 @@ func HandleUploadFile(c fiber.Ctx) error {
 		})
 	}
 
-	orgId := c.FormValue("orgId")
+	orgId := CurrentMembership(c).OrgID
 	parentFolderName := c.FormValue("parentFolderName")
 
-	if file == nil || orgId == "" || parentFolderName == "" {
+	if file == nil || parentFolderName == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Missing required form data",
 		})
 	}
 
-	// map that holds allowed file types
-	allowedFileTypes := map[string]bool{
-		"application/pdf":    true,
-		"application/msword": true,
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true,
-		"image/jpeg": true,
-		"image/png":  true,
-	}
-	// get file extension and check if it's allowed
-	fileExt := filepath.Ext(file.Filename)
-	contentType := ""
-
-	// map common extensions to MIME types
-	switch strings.ToLower(fileExt) {
-	case ".pdf":
-		contentType = "application/pdf"
-	case ".doc":
-		contentType = "application/msword"
-	case ".docx":
-		contentType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
-	case ".jpg", ".jpeg":
-		contentType = "image/jpeg"
-	case ".png":
-		contentType = "image/png"
-	}
-
-	if !allowedFileTypes[contentType] {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "File type not supported. Please upload PDF, DOC, DOCX, JPG, or PNG files",
-		})
+	if !checkUploadedFile(c, file) {
+		return nil
 	}
 
-	// file size validation
-	// 10 (mb) * 1024 * 1024
-	maxFileSize := int64(10 * 1024 * 1024)
-	if file.Size > maxFileSize {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Upload limit exceeded. Maximum file size is 10MB",
-		})
-	}
-
-	// file name validation
-	invalidChars := regexp.MustCompile(`[<>:"/\\|?*]`)
-	if invalidChars.MatchString(file.Filename) {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "File name contains invalid characters",
-		})
+	allowed, err := canEditFolderByName(c, parentFolderName, orgId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	_, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   true,
-			"message": err.Error(),
-		})
+	if !allowed {
+		return forbidden(c)
 	}
 
-	if strings.ToLower(role) != "owner" && strings.ToLower(role) != "editor" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error":   true,
-			"message": "You do not have permissions to carry out this operation",
-		})
+	notifyGroupId, ok := notifyGroupFromRequest(c)
+	if !ok {
+		return nil
 	}
 
 	if parentFolderName == "root" {
-		err := database.UploadFileToRoot(file, orgId, userWithSession.User.ID)
+		err := database.UploadFileToRoot(file, orgId, user.ID, notifyGroupId, auditActor(c))
 		if err != nil {
 			if strings.Contains(err.Error(), "exists") {
 				return c.SendStatus(fiber.StatusConflict)
@@ -281,7 +241,7 @@ func HandleUploadFile(c fiber.Ctx) error {
 			})
 		}
 	} else {
-		err := database.UploadFileToFolder(file, orgId, parentFolderName, userWithSession.User.ID)
+		err := database.UploadFileToFolder(file, orgId, parentFolderName, user.ID, notifyGroupId, auditActor(c))
 		if err != nil {
 			if strings.Contains(err.Error(), "exists") {
 				return c.SendStatus(fiber.StatusConflict)
@@ -297,39 +257,28 @@ func HandleUploadFile(c fiber.Ctx) error {
 }
 
 func HandleDeleteFile(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
-	orgId := c.Query("org-id")
+	orgId := CurrentMembership(c).OrgID
 	fileId := c.Query("file-id")
 	fileName := c.Query("file-name")
 
-	if len(orgId) == 0 || len(fileId) == 0 || len(fileName) == 0 {
+	if len(fileId) == 0 || len(fileName) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Missing required form data",
 		})
 	}
 
-	_, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
+	allowed, err := canAccessFileFolder(c, fileId, database.FolderPermissionEdit)
 	if err != nil {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error":   true,
-			"message": err.Error(),
-		})
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	if strings.ToLower(role) != "owner" && strings.ToLower(role) != "editor" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error":   true,
-			"message": "You do not have permissions to carry out this operation",
-		})
+	if !allowed {
+		return forbidden(c)
 	}
 
-	err = database.DeleteFile(fileId, orgId, userWithSession.User.ID, fileName)
+	err = database.DeleteFile(fileId, orgId, user.ID, fileName, auditActor(c))
 
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -339,39 +288,28 @@ func HandleDeleteFile(c fiber.Ctx) error {
 }
 
 func HandleDeleteFolder(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+	user := CurrentUser(c)
 
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	orgId := c.Query("org-id")
+	orgId := CurrentMembership(c).OrgID
 	folderId := c.Query("folder-id")
 	folderName := c.Query("folder-name")
 
-	if len(orgId) == 0 || len(folderId) == 0 || len(folderName) == 0 {
+	if len(folderId) == 0 || len(folderName) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Missing required form data",
 		})
 	}
 
-	_, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
+	allowed, err := canAccessFolder(c, folderId, database.FolderPermissionEdit)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error":   true,
-			"message": err.Error(),
-		})
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	if strings.ToLower(role) != "owner" && strings.ToLower(role) != "editor" {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error":   true,
-			"message": "You do not have permissions to carry out this operation",
-		})
+	if !allowed {
+		return forbidden(c)
 	}
 
-	err = database.DeleteFolder(folderId, userWithSession.User.ID, orgId, folderName)
+	err = database.DeleteFolder(folderId, user.ID, orgId, folderName, auditActor(c))
 
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -381,16 +319,9 @@ func HandleDeleteFolder(c fiber.Ctx) error {
 }
 
 func HandleDownloadFile(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	orgId := c.Query("org-id")
 	fileId := c.Query("file-id")
 	fileType := c.Query("file-type")
-	if len(orgId) == 0 || len(fileId) == 0 || len(fileType) == 0 {
+	if len(fileId) == 0 || len(fileType) == 0 {
 		return c.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
@@ -402,17 +333,27 @@ func HandleDownloadFile(c fiber.Ctx) error {
 		fileName = "download"
 	}
 
-	// verify that the user has permission to download this file
-	_, _, err = database.CanViewOrg(userWithSession.User.ID, orgId)
-
+	allowed, err := canAccessFileFolder(c, fileId, database.FolderPermissionView)
 	if err != nil {
-		return c.SendStatus(fiber.StatusForbidden)
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !allowed {
+		return forbidden(c)
 	}
 
+	return sendOrgFile(c, fileId, fileName, fileType, "attachment")
+
+}
+
+// streams a stored file back to the client, shared with the public share link routes
+// disposition is "attachment" to start a download or "inline" to let the browser show the file
+func sendOrgFile(c fiber.Ctx, fileId string, fileName string, fileType string, disposition string) error {
 	// get filepath from this function that walks the database table and collects folder-ids until it hits null which is root level
 	filePath, err := database.GetFilePath(fileId)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Printf("error: could not build path for file %s: %v", fileId, err.Error())
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	// check that the file actually exists on disk
@@ -424,11 +365,38 @@ func HandleDownloadFile(c fiber.Ctx) error {
 
 	// set the response headers to tell the browser to initiate a download operation
 	encodedFilename := mime.QEncoding.Encode("utf-8", fileName)
-	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, encodedFilename, url.PathEscape(fileName)))
+	c.Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, encodedFilename, url.PathEscape(fileName)))
 	// parse the mime type of the file based on the type
 	c.Set("Content-Type", getMimeType(fileType))
 	return c.SendFile(filePath)
+}
+
+// the client names parent folders rather than sending their ids
+func canEditFolderByName(c fiber.Ctx, folderName string, orgId string) (bool, error) {
+	if folderName == "root" {
+		return canAccessFolder(c, "", database.FolderPermissionEdit)
+	}
 
+	folderId, err := database.GetFolderIdByName(folderName, orgId)
+	if err != nil {
+		// let the database layer report the missing folder the way it always has
+		if err == database.ErrFolderNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return canAccessFolder(c, folderId, database.FolderPermissionEdit)
+}
+
+// files take their access from the folder they are in
+func canAccessFileFolder(c fiber.Ctx, fileId string, permission string) (bool, error) {
+	folderId, err := database.GetFileFolderId(fileId)
+	if err != nil {
+		return false, err
+	}
+
+	return canAccessFolder(c, folderId, permission)
 }
 
 func getMimeType(fileType string) string {
@@ -452,3 +420,36 @@ func getMimeType(fileType string) string {
 		return "application/octet-stream"
 	}
 }
+
+// the type, size and name checks every upload goes through, writes the response and returns false when the file is turned away
+func checkUploadedFile(c fiber.Ctx, file *multipart.FileHeader) bool {
+	if len(uploadContentType(file.Filename)) == 0 {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "File type not supported. Please upload PDF, DOC, DOCX, JPG, or PNG files",
+		})
+		return false
+	}
+
+	if file.Size > maxUploadSize {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload limit exceeded. Maximum file size is 10MB",
+		})
+		return false
+	}
+
+	// file name validation
+	invalidChars := regexp.MustCompile(`[<>:"/\\|?*]`)
+	if invalidChars.MatchString(file.Filename) {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "File name contains invalid characters",
+		})
+		return false
+	}
+
+	return true
+}
+
+// the mime type for the extensions uploads are accepted for, empty for anything else
+func uploadContentType(fileName string) string {
+	return uploadContentTypes[strings.ToLower(filepath.Ext(fileName))]
+}
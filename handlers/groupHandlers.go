@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"errors"
+	"fms/database"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+func HandleGetOrgGroups(c fiber.Ctx) error {
+	groups, err := database.GetOrgGroups(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"groups": groups,
+	})
+}
+
+func HandleGetGroupMembers(c fiber.Ctx) error {
+	groupId := c.Query("group_id")
+
+	if len(groupId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	membership := CurrentMembership(c)
+
+	_, err := database.GetOrgGroup(membership.OrgID, groupId)
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	members, err := database.GetOrgGroupMembers(membership.OrgID, groupId)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"members": members,
+	})
+}
+
+func HandleAddOrgGroup(c fiber.Ctx) error {
+	type addGroupStruct struct {
+		Org_id string `json:"org_id" validate:"required"`
+		Name   string `json:"name" validate:"required"`
+		Role   string `json:"role"`
+	}
+
+	var addGroupData addGroupStruct
+
+	err := c.Bind().Body(&addGroupData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(addGroupData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	name, ok := groupName(c, addGroupData.Name)
+	if !ok {
+		return nil
+	}
+
+	membership := CurrentMembership(c)
+
+	role, ok := groupRole(c, membership, addGroupData.Role)
+	if !ok {
+		return nil
+	}
+
+	groupId, err := database.CreateOrgGroup(membership.OrgID, name, role, auditActor(c))
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"id": strconv.FormatInt(groupId, 10),
+	})
+}
+
+// renames the group and replaces its role, an empty role takes the role away
+func HandleUpdateOrgGroup(c fiber.Ctx) error {
+	type updateGroupStruct struct {
+		Org_id   string `json:"org_id" validate:"required"`
+		Group_id string `json:"group_id" validate:"required"`
+		Name     string `json:"name" validate:"required"`
+		Role     string `json:"role"`
+	}
+
+	var updateGroupData updateGroupStruct
+
+	err := c.Bind().Body(&updateGroupData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(updateGroupData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	name, ok := groupName(c, updateGroupData.Name)
+	if !ok {
+		return nil
+	}
+
+	membership := CurrentMembership(c)
+
+	_, ok = manageableGroup(c, membership, updateGroupData.Group_id)
+	if !ok {
+		return nil
+	}
+
+	role, ok := groupRole(c, membership, updateGroupData.Role)
+	if !ok {
+		return nil
+	}
+
+	err = database.UpdateOrgGroup(membership.OrgID, updateGroupData.Group_id, name, role, auditActor(c))
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDeleteOrgGroup(c fiber.Ctx) error {
+	groupId := c.Query("group_id")
+
+	if len(groupId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	membership := CurrentMembership(c)
+
+	_, ok := manageableGroup(c, membership, groupId)
+	if !ok {
+		return nil
+	}
+
+	err := database.DeleteOrgGroup(membership.OrgID, groupId, auditActor(c))
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleAddGroupMember(c fiber.Ctx) error {
+	groupId := c.Query("group_id")
+	username := c.Query("username")
+
+	if len(groupId) == 0 || len(username) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	membership := CurrentMembership(c)
+
+	_, ok := manageableGroup(c, membership, groupId)
+	if !ok {
+		return nil
+	}
+
+	err := database.AddOrgGroupMember(membership.OrgID, groupId, username, auditActor(c))
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleRemoveGroupMember(c fiber.Ctx) error {
+	groupId := c.Query("group_id")
+	username := c.Query("username")
+
+	if len(groupId) == 0 || len(username) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	membership := CurrentMembership(c)
+
+	_, ok := manageableGroup(c, membership, groupId)
+	if !ok {
+		return nil
+	}
+
+	err := database.RemoveOrgGroupMember(membership.OrgID, groupId, username, auditActor(c))
+	if err != nil {
+		return groupError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// the optional notify-group param on uploads and new folders, the id of the group that should be told instead of the whole org
+// writes the response and returns false when the group isn't in the org
+func notifyGroupFromRequest(c fiber.Ctx) (string, bool) {
+	groupId := c.Query("notify-group")
+	if len(groupId) == 0 {
+		return "", true
+	}
+
+	_, err := database.GetOrgGroup(CurrentMembership(c).OrgID, groupId)
+	if err != nil {
+		if errors.Is(err, database.ErrGroupNotFound) {
+			c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+			return "", false
+		}
+		c.SendStatus(fiber.StatusInternalServerError)
+		return "", false
+	}
+
+	return groupId, true
+}
+
+func groupName(c fiber.Ctx, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+
+	if len(name) < 3 || len(name) > 30 {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Group name must be between 3 and 30 characters",
+		})
+		return "", false
+	}
+
+	return name, true
+}
+
+// a group's role is handed to everyone in it, so the caller needs to be able to give that role to a member directly
+// groups can't make anyone an owner
+func groupRole(c fiber.Ctx, membership *OrgMembership, role string) (string, bool) {
+	if len(role) == 0 {
+		return "", true
+	}
+
+	role, ok := assignableRole(c, membership, role)
+	if !ok {
+		return "", false
+	}
+
+	if role == database.RoleOwner {
+		forbidden(c)
+		return "", false
+	}
+
+	return role, true
+}
+
+// admins can't change a group that hands out admin, the same as they can't change an admin member
+// nor one whose role can do more than the caller, adding someone to it would hand that role out
+func manageableGroup(c fiber.Ctx, membership *OrgMembership, groupId string) (*database.OrgGroup, bool) {
+	group, err := database.GetOrgGroup(membership.OrgID, groupId)
+	if err != nil {
+		groupError(c, err)
+		return nil, false
+	}
+
+	if !database.CanManageMember(membership.Access.Role, group.Role, "") {
+		forbidden(c)
+		return nil, false
+	}
+
+	if len(group.Role) > 0 {
+		within, err := database.RoleWithinAccess(membership.OrgID, &membership.Access, group.Role)
+		if err != nil && err != database.ErrRoleNotFound {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return nil, false
+		}
+
+		if err == nil && !within {
+			forbidden(c)
+			return nil, false
+		}
+	}
+
+	return group, true
+}
+
+func groupError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrGroupNotFound, database.ErrNotGroupMember:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrNotOrgMember:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrGroupNameTaken:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
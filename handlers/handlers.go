@@ -1,20 +1,18 @@
 package handlers
 
 import (
+	"fms/auth"
 	"fms/database"
 	"fmt"
+	"log"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v3"
 )
 
 func HandleSearchUsers(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	searchInput := c.Query("username")
 
@@ -22,7 +20,7 @@ func HandleSearchUsers(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
-	result, err := database.SearchUsers(searchInput, userWithSession.User.ID)
+	result, err := database.SearchUsers(searchInput, user.ID, CurrentMembership(c).OrgID)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -37,41 +35,35 @@ func HandleSearchUsers(c fiber.Ctx) error {
 }
 
 func HandleInviteUser(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
+	membership := CurrentMembership(c)
 	username := c.Query("username")
-	orgId := c.Query("org-id")
 
 	if len(username) == 0 {
 		return c.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
-	// no need to permission check on this function because it passes in the requesting user's id so the invite will automatically go to their org
-	err = database.InviteUserToOrg(username, userWithSession.User.ID, orgId)
+	// the invitee joins with this role when they accept
+	role, ok := inviteRole(c, membership)
+	if !ok {
+		return nil
+	}
+
+	// the route already checked that the user can invite to this org, so the invite goes to that org and no other
+	err := database.InviteUserToOrg(username, user.ID, membership.OrgID, role, auditActor(c))
 
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return inviteError(c, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
 func HandleGetUserInvites(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
-	invites, err := database.GetUserInvites(userWithSession.User.ID)
+	invites, err := database.GetUserInvites(user.ID)
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -85,12 +77,7 @@ func HandleGetUserInvites(c fiber.Ctx) error {
 }
 
 func HandleAcceptInvite(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	orgId := c.Query("org_id")
 
@@ -100,10 +87,10 @@ func HandleAcceptInvite(c fiber.Ctx) error {
 		})
 	}
 
-	hasExceededLimit, err := database.HasExceededLimit(userWithSession.User.ID)
+	hasExceededLimit, err := database.HasExceededLimit(user.ID)
 
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Printf("error: could not check org membership limit: %v", err.Error())
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
@@ -111,24 +98,16 @@ func HandleAcceptInvite(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusConflict)
 	}
 
-	err = database.AcceptOrgInvite(userWithSession.User.ID, orgId, userWithSession.User.Username)
+	err = database.AcceptOrgInvite(user.ID, orgId, user.Username, auditActor(c))
 	if err != nil {
-		fmt.Println(err.Error())
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return inviteError(c, err)
 	}
 
 	return c.SendStatus(fiber.StatusAccepted)
 }
 
 func HandleDeclineInvite(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	orgId := c.Query("org_id")
 
@@ -138,7 +117,7 @@ func HandleDeclineInvite(c fiber.Ctx) error {
 		})
 	}
 
-	err = database.DeclineOrgInvite(userWithSession.User.ID, orgId, userWithSession.User.Username)
+	err := database.DeclineOrgInvite(user.ID, orgId, user.Username, auditActor(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
@@ -148,30 +127,143 @@ func HandleDeclineInvite(c fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusOK)
 }
 
+const (
+	defaultNotificationPageSize = 20
+	maxNotificationPageSize     = 100
+)
+
+// one page of notifications, newest first
+// takes an optional cursor from the previous page's nextCursor, a limit, and org_id, type, event and read (true or false) filters
 func HandleGetUserNotifications(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+	user := CurrentUser(c)
 
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+	filter, ok := notificationFilter(c)
+	if !ok {
+		return nil
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultNotificationPageSize)))
+	if err != nil || limit < 1 || limit > maxNotificationPageSize {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("Limit must be between 1 and %d", maxNotificationPageSize),
+		})
 	}
+	filter.Limit = limit
 
-	notifications, err := database.GetUserNotifications(userWithSession.User.ID)
+	cursor := c.Query("cursor")
+	if len(cursor) > 0 {
+		before, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || before < 1 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+		filter.Before = before
+	}
+
+	notifications, next, err := database.GetUserNotifications(user.ID, filter)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
+	var nextCursor *string
+	if next != nil {
+		value := strconv.FormatInt(*next, 10)
+		nextCursor = &value
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"notifications": notifications,
+		"nextCursor":    nextCursor,
 	})
 }
 
-func HandleMarkNotificationAsRead(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+// takes the same org_id, type and event filters as the list
+func HandleGetUnreadNotificationCount(c fiber.Ctx) error {
+	user := CurrentUser(c)
 
+	filter, ok := notificationFilter(c)
+	if !ok {
+		return nil
+	}
+
+	count, err := database.GetUnreadNotificationCount(user.ID, filter)
 	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"unread": count,
+	})
+}
+
+// every event a notification can be, with the json schema of its payload
+// clients render their own localized message and deep link from the event and payload instead of the stored message
+func HandleGetEventCatalogue(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"events":  database.EventCatalogue,
+		"schemas": database.EventSchemas(),
+	})
+}
+
+// the same id or "all" flag as marking notifications as read
+func HandleDeleteNotification(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	notifId := c.Query("id")
+	clearAll := c.Query("all")
+
+	if len(notifId) == 0 && len(clearAll) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if len(clearAll) > 0 {
+		err := database.DeleteAllNotifications(user.ID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.SendStatus(fiber.StatusOK)
+	}
+
+	err := database.DeleteNotification(notifId, user.ID)
+	if err != nil {
+		if err == database.ErrNotificationNotFound {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// writes the response and returns false when the read filter isn't true or false
+func notificationFilter(c fiber.Ctx) (database.NotificationFilter, bool) {
+	filter := database.NotificationFilter{
+		OrgID: c.Query("org_id"),
+		Type:  c.Query("type"),
+		Event: c.Query("event"),
+	}
+
+	switch c.Query("read") {
+	case "true":
+		filter.ReadState = "read"
+	case "false":
+		filter.ReadState = "unread"
+	case "":
+	default:
+		c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "read must be true or false",
+		})
+		return filter, false
+	}
+
+	return filter, true
+}
+
+func HandleMarkNotificationAsRead(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
 	notifId := c.Query("id")
 	// this endpoint optionally takes an "all" flag that lets the server know whether all notifs should be marked as read or just one
 	clearAll := c.Query("all")
@@ -181,7 +273,7 @@ func HandleMarkNotificationAsRead(c fiber.Ctx) error {
 	}
 
 	if len(clearAll) > 0 {
-		err = database.MarkAllAsRead(userWithSession.User.ID)
+		err := database.MarkAllAsRead(user.ID)
 
 		if err != nil {
 			return c.SendStatus(fiber.StatusInternalServerError)
@@ -190,7 +282,7 @@ func HandleMarkNotificationAsRead(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusOK)
 
 	} else {
-		err = database.MarkAsRead(notifId, userWithSession.User.ID)
+		err := database.MarkAsRead(notifId, user.ID)
 
 		if err != nil {
 			return c.SendStatus(fiber.StatusInternalServerError)
@@ -201,11 +293,7 @@ func HandleMarkNotificationAsRead(c fiber.Ctx) error {
 }
 
 func HandleChangePassword(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	currPassword := c.FormValue("current-password")
 	newPassword := c.FormValue("new-password")
@@ -217,9 +305,16 @@ func HandleChangePassword(c fiber.Ctx) error {
 		})
 	}
 
+	err := auth.ValidatePassword(newPassword)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	// dont care about the return value of this function other than error
 	// if there is no error user exists
-	_, err = database.UserExists(userWithSession.User.Username, currPassword)
+	_, err = database.UserExists(user.Username, currPassword)
 
 	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
@@ -227,26 +322,16 @@ func HandleChangePassword(c fiber.Ctx) error {
 		})
 	}
 
-	err = database.ChangePassword(userWithSession.User.ID, newPassword)
+	err = database.ChangePassword(user.ID, newPassword)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
-
-	// if len(registerData.Password) < passwordLengthMin || len(registerData.Password) > passwordLengthMax {
-	// 	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-	// 		"error": "Password length must be between 6 and 12 characters",
-	// 	})
-	// }
 }
 
 func HandleChangeUsername(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	username := c.FormValue("username")
 	username = strings.TrimSpace(username)
@@ -272,7 +357,7 @@ func HandleChangeUsername(c fiber.Ctx) error {
 	if exists {
 		return c.SendStatus(fiber.StatusConflict)
 	}
-	err = database.ChangeUsername(userWithSession.User.ID, username)
+	err = database.ChangeUsername(user.ID, username)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -282,15 +367,19 @@ func HandleChangeUsername(c fiber.Ctx) error {
 }
 
 func HandleDeleteAccount(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+	user := CurrentUser(c)
 
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	err = database.DeleteAccount(userWithSession.User.ID)
+	err := database.DeleteAccount(user.ID, auditActor(c))
 
 	if err != nil {
+		if err == database.ErrOwnsOrgWithMembers {
+			// tell the client which orgs need a new owner
+			orgs, _ := database.GetOwnedOrgsWithMembers(user.ID)
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+				"orgs":  orgs,
+			})
+		}
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"fms/database"
+	"fms/mailer"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+func HandleGetOrgInvites(c fiber.Ctx) error {
+	invites, err := database.GetOrgInvites(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"invites": invites,
+	})
+}
+
+func HandleRevokeInvite(c fiber.Ctx) error {
+	inviteId := c.Query("invite_id")
+
+	if len(inviteId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RevokeOrgInvite(CurrentMembership(c).OrgID, inviteId, auditActor(c))
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleResendInvite(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	inviteId := c.Query("invite_id")
+
+	if len(inviteId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.ResendOrgInvite(CurrentMembership(c).OrgID, inviteId, user.ID, auditActor(c))
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// max_uses and expires_in_hours are optional, leaving them out makes a link that works until it's revoked
+func HandleCreateInviteLink(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	role, ok := inviteRole(c, membership)
+	if !ok {
+		return nil
+	}
+
+	var maxUses int64
+	if value := c.Query("max_uses"); len(value) > 0 {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "max_uses must be a positive number",
+			})
+		}
+		maxUses = parsed
+	}
+
+	var ttl time.Duration
+	if value := c.Query("expires_in_hours"); len(value) > 0 {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 1 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "expires_in_hours must be a positive number",
+			})
+		}
+		ttl = time.Duration(hours) * time.Hour
+	}
+
+	token, err := database.CreateInviteLink(membership.OrgID, user.ID, role, maxUses, ttl, auditActor(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// the token is only ever shown here, the database keeps its hash
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token": token,
+		"link":  inviteLinkURL(token),
+	})
+}
+
+func HandleGetInviteLinks(c fiber.Ctx) error {
+	links, err := database.GetInviteLinks(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"links": links,
+	})
+}
+
+func HandleRevokeInviteLink(c fiber.Ctx) error {
+	linkId := c.Query("link_id")
+
+	if len(linkId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RevokeInviteLink(CurrentMembership(c).OrgID, linkId, auditActor(c))
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// the same response whether or not the address already has an account so this can't be used to find out who is registered
+func HandleInviteByEmail(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	email := strings.TrimSpace(c.Query("email"))
+
+	err := validator.New().Var(email, "required,email")
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Please enter a valid email address",
+		})
+	}
+
+	role, ok := inviteRole(c, membership)
+	if !ok {
+		return nil
+	}
+
+	token, err := database.CreateEmailInvite(membership.OrgID, user.ID, role, email, auditActor(c))
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	orgName := database.GetOrgById(membership.OrgID).Name
+
+	err = mailer.Send(mailer.Message{
+		To:      email,
+		Subject: fmt.Sprintf("You've been invited to join %s", orgName),
+		Text: fmt.Sprintf(
+			"Hi,\n\n%s has invited you to join %s on FMS. Open the link below to accept, you'll be asked to sign in or create an account first. The invite is for this email address, so verify it on your account before joining. It expires in 7 days.\n\n%s\n\nIf you weren't expecting this you can ignore this email.\n",
+			user.Username, orgName, inviteLinkURL(token),
+		),
+	})
+	if err != nil {
+		log.Printf("error: could not send invite email: %v", err.Error())
+
+		// nobody got the link, so it shouldn't count against the resend cooldown when they try again
+		withdrawErr := database.WithdrawEmailInvite(membership.OrgID, token, auditActor(c))
+		if withdrawErr != nil {
+			log.Printf("error: could not withdraw unsent invite: %v", withdrawErr.Error())
+		}
+
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// lets the client show which org and role a link is for before the user decides to join
+func HandleGetInviteLinkPreview(c fiber.Ctx) error {
+	token := c.Query("token")
+
+	if len(token) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	preview, err := database.GetInviteLinkPreview(token)
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(preview)
+}
+
+func HandleJoinByInviteLink(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	token := c.Query("token")
+
+	if len(token) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	hasExceededLimit, err := database.HasExceededLimit(user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if hasExceededLimit {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": database.ErrOrgLimitReached.Error(),
+		})
+	}
+
+	orgId, err := database.JoinByInviteLink(token, user.ID, user.Username, auditActor(c))
+	if err != nil {
+		return inviteError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"orgId": orgId,
+	})
+}
+
+// the role query param, defaulting to the org's default member role
+// the caller can't hand out a role they couldn't give an existing member, and ownership only moves through a transfer or a role change
+// writes the response and returns false when the role can't be used
+func inviteRole(c fiber.Ctx, membership *OrgMembership) (string, bool) {
+	role := c.Query("role")
+	if len(role) == 0 {
+		return database.DefaultMemberRole, true
+	}
+
+	role, ok := assignableRole(c, membership, role)
+	if !ok {
+		return "", false
+	}
+
+	if role == database.RoleOwner {
+		forbidden(c)
+		return "", false
+	}
+
+	return role, true
+}
+
+func inviteLinkURL(token string) string {
+	return fmt.Sprintf("%s/join?token=%s", appURL, url.QueryEscape(token))
+}
+
+func inviteError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrInviteNotFound, database.ErrUserNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrInvalidToken:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrAlreadyMember, database.ErrAlreadyInvited:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrInviteEmailMismatch:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrInviteRateLimited:
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"fms/database"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// join requests are capped so a long note can't be used to fill up the approvers' queue
+const maxJoinRequestMessageLength = 500
+
+func HandleSetOrgDiscoverable(c fiber.Ctx) error {
+	discoverable := c.Query("discoverable")
+
+	if discoverable != "true" && discoverable != "false" {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing URL params.",
+		})
+	}
+
+	err := database.SetOrgDiscoverable(CurrentMembership(c).OrgID, discoverable == "true", auditActor(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDiscoverOrgs(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	name := c.Query("name")
+
+	if len(name) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	orgs, err := database.SearchDiscoverableOrgs(name, user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"orgs": orgs,
+	})
+}
+
+func HandleRequestToJoin(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	orgId := c.Query("org_id")
+	message := c.Query("message")
+
+	if len(orgId) == 0 || len(message) > maxJoinRequestMessageLength {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	hasExceededLimit, err := database.HasExceededLimit(user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if hasExceededLimit {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": database.ErrOrgLimitReached.Error(),
+		})
+	}
+
+	err = database.RequestToJoinOrg(orgId, user.ID, user.Username, message, auditActor(c))
+	if err != nil {
+		return joinRequestError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleCancelJoinRequest(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	orgId := c.Query("org_id")
+
+	if len(orgId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.CancelJoinRequest(orgId, user.ID, auditActor(c))
+	if err != nil {
+		return joinRequestError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleGetUserJoinRequests(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	requests, err := database.GetUserJoinRequests(user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"requests": requests,
+	})
+}
+
+func HandleGetOrgJoinRequests(c fiber.Ctx) error {
+	requests, err := database.GetOrgJoinRequests(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"requests": requests,
+	})
+}
+
+// role is optional and follows the same rules as an invite
+func HandleApproveJoinRequest(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	requestId := c.Query("request_id")
+
+	if len(requestId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	role, ok := inviteRole(c, membership)
+	if !ok {
+		return nil
+	}
+
+	err := database.ApproveJoinRequest(membership.OrgID, requestId, user.ID, role, auditActor(c))
+	if err != nil {
+		return joinRequestError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDenyJoinRequest(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	requestId := c.Query("request_id")
+
+	if len(requestId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.DenyJoinRequest(CurrentMembership(c).OrgID, requestId, user.ID, auditActor(c))
+	if err != nil {
+		return joinRequestError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func joinRequestError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrOrgNotDiscoverable, database.ErrJoinRequestNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrJoinRequestExists, database.ErrJoinLimitExceeded:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// already a member or already invited
+	return inviteError(c, err)
+}
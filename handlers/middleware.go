@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fms/database"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	PrincipalAnonymous = "anonymous"
+	PrincipalSession   = "session"
+	PrincipalBearer    = "bearer"
+)
+
+// whoever is making the request, resolved once per request by ResolvePrincipal
+type Principal struct {
+	// one of the Principal* constants, says how the caller authenticated
+	Kind    string
+	User    database.User
+	Session database.UserSession
+}
+
+func (p *Principal) IsAuthenticated() bool {
+	return p.Kind != PrincipalAnonymous
+}
+
+// the caller's membership of the org a request is about, set by RequireCapability and RequireOrgMember
+type OrgMembership struct {
+	OrgID  string
+	Access database.OrgAccess
+}
+
+// unexported key type so nothing outside this package can overwrite the locals
+type localsKey int
+
+const (
+	principalKey localsKey = iota
+	membershipKey
+)
+
+// runs on every request and never rejects anything, it only works out who the caller is
+// a bearer token is a session id sent in the Authorization header, for clients that can't use cookies
+// when the header is present the cookie is ignored so a request can't mix the two (the csrf middleware relies on this)
+func ResolvePrincipal(c fiber.Ctx) error {
+	principal := &Principal{Kind: PrincipalAnonymous}
+
+	token, kind := sessionTokenFromRequest(c)
+
+	if len(token) > 0 {
+		userWithSession, err := database.AuthenticateCookie(token)
+		if err == nil {
+			principal = &Principal{
+				Kind:    kind,
+				User:    userWithSession.User,
+				Session: userWithSession.Session,
+			}
+		}
+	}
+
+	c.Locals(principalKey, principal)
+
+	return c.Next()
+}
+
+func sessionTokenFromRequest(c fiber.Ctx) (string, string) {
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if len(authorization) > 0 {
+		token, found := strings.CutPrefix(authorization, "Bearer ")
+		if !found {
+			return "", PrincipalAnonymous
+		}
+		return strings.TrimSpace(token), PrincipalBearer
+	}
+
+	return c.Cookies("session_token"), PrincipalSession
+}
+
+// requests authenticated with a bearer token can't be forged by another site, the browser never adds that header by itself
+func IsBearerRequest(c fiber.Ctx) bool {
+	return CurrentPrincipal(c).Kind == PrincipalBearer
+}
+
+func RequireAuth(c fiber.Ctx) error {
+	if !CurrentPrincipal(c).IsAuthenticated() {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	return c.Next()
+}
+
+// the caller has to be signed in and hold the capability in the org named in the request
+// when the request names a file or folder, that item has to belong to the same org
+func RequireCapability(capability string) fiber.Handler {
+	return requireOrgAccess(capability)
+}
+
+// for the few things any member can do whatever their role, like leaving the org
+func RequireOrgMember(c fiber.Ctx) error {
+	return requireOrgAccess("")(c)
+}
+
+// an empty capability only checks membership
+func requireOrgAccess(capability string) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		principal := CurrentPrincipal(c)
+
+		if !principal.IsAuthenticated() {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		orgId, ok := orgIdFromRequest(c)
+
+		if !ok {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Conflicting Org Ids",
+			})
+		}
+
+		if len(orgId) == 0 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Missing Org Id",
+			})
+		}
+
+		access, err := database.GetOrgAccess(principal.User.ID, orgId)
+
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		allowed := access != nil && (len(capability) == 0 || access.Has(capability))
+
+		if allowed {
+			if resource := resourceFromRequest(c); resource != nil {
+				allowed, err = database.ResourceInOrg(resource, orgId)
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+						"error": err.Error(),
+					})
+				}
+			}
+		}
+
+		if !allowed {
+			return forbidden(c)
+		}
+
+		c.Locals(membershipKey, &OrgMembership{OrgID: orgId, Access: *access})
+
+		return c.Next()
+	}
+}
+
+func forbidden(c fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "You do not have permissions to carry out this operation",
+	})
+}
+
+// the file or folder a request acts on, nil when it is about the org as a whole
+func resourceFromRequest(c fiber.Ctx) *database.Resource {
+	if fileId := c.Query("file-id"); len(fileId) > 0 {
+		return &database.Resource{Type: database.ResourceFile, ID: fileId}
+	}
+
+	if folderId := c.Query("folder-id"); len(folderId) > 0 {
+		return &database.Resource{Type: database.ResourceFolder, ID: folderId}
+	}
+
+	return nil
+}
+
+// the client has sent the org id under a few different names over time
+// every one of them is read, a request naming two different orgs is refused rather than checked against one and acted on in the other
+func orgIdFromRequest(c fiber.Ctx) (string, bool) {
+	ids := []string{}
+	keys := []string{"org_id", "org-id", "orgId"}
+
+	for _, key := range keys {
+		ids = append(ids, c.Query(key))
+	}
+
+	contentType := string(c.Request().Header.ContentType())
+
+	if strings.HasPrefix(contentType, fiber.MIMEApplicationForm) || strings.HasPrefix(contentType, fiber.MIMEMultipartForm) {
+		for _, key := range keys {
+			ids = append(ids, c.FormValue(key))
+		}
+	}
+
+	if strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		var body struct {
+			OrgID      string `json:"org_id"`
+			OrgIDCamel string `json:"orgId"`
+		}
+
+		// the handler binds the body again later, fiber keeps it buffered so reading it here is fine
+		if json.Unmarshal(c.Body(), &body) == nil {
+			ids = append(ids, body.OrgID, body.OrgIDCamel)
+		}
+	}
+
+	orgId := ""
+	for _, id := range ids {
+		if len(id) == 0 {
+			continue
+		}
+		if len(orgId) > 0 && id != orgId {
+			return "", false
+		}
+		orgId = id
+	}
+
+	return orgId, true
+}
+
+// always set once ResolvePrincipal has run, falls back to anonymous so handlers never see nil
+func CurrentPrincipal(c fiber.Ctx) *Principal {
+	principal, ok := c.Locals(principalKey).(*Principal)
+	if !ok {
+		return &Principal{Kind: PrincipalAnonymous}
+	}
+	return principal
+}
+
+// only meaningful behind RequireAuth
+func CurrentUser(c fiber.Ctx) database.User {
+	return CurrentPrincipal(c).User
+}
+
+// only meaningful behind RequireCapability or RequireOrgMember
+func CurrentMembership(c fiber.Ctx) *OrgMembership {
+	membership, ok := c.Locals(membershipKey).(*OrgMembership)
+	if !ok {
+		return &OrgMembership{}
+	}
+	return membership
+}
+
+// who is making a change and where the request came from, for the org's audit log
+func auditActor(c fiber.Ctx) database.AuditActor {
+	return database.AuditActor{
+		UserID:    CurrentPrincipal(c).User.ID,
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+}
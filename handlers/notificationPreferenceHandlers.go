@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fms/database"
+	"slices"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+// the caller's own preferences and mutes in the org, along with the types they can set a preference for
+func HandleGetNotificationPreferences(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	preferences, err := database.GetNotificationPreferences(user.ID, membership.OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	mutedFolders, err := database.GetMutedFolders(user.ID, membership.OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"types":        database.NotificationTypes,
+		"preferences":  preferences,
+		"mutedFolders": mutedFolders,
+	})
+}
+
+// leave type empty to set the default for every type in the org
+func HandleSetNotificationPreference(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	type notificationPreferenceStruct struct {
+		Org_id  string `json:"org_id" validate:"required"`
+		Type    string `json:"type"`
+		Channel string `json:"channel" validate:"required"`
+	}
+
+	var preferenceData notificationPreferenceStruct
+
+	err := c.Bind().Body(&preferenceData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(preferenceData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if !database.IsNotificationChannel(preferenceData.Channel) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Channel must be in_app, email_digest or off",
+		})
+	}
+
+	if len(preferenceData.Type) > 0 && !slices.Contains(database.NotificationTypes, preferenceData.Type) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Unknown notification type",
+		})
+	}
+
+	err = database.SetNotificationPreference(user.ID, membership.OrgID, preferenceData.Type, preferenceData.Channel)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleClearNotificationPreference(c fiber.Ctx) error {
+	err := database.ClearNotificationPreference(CurrentUser(c).ID, CurrentMembership(c).OrgID, c.Query("type"))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// members can only mute folders they can see
+func HandleMuteFolder(c fiber.Ctx) error {
+	folderId := c.Query("folder-id")
+
+	if len(folderId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	allowed, err := canAccessFolder(c, folderId, database.FolderPermissionView)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if !allowed {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	err = database.MuteFolder(CurrentUser(c).ID, CurrentMembership(c).OrgID, folderId)
+	if err != nil {
+		if err == database.ErrFolderNotFound {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleUnmuteFolder(c fiber.Ctx) error {
+	folderId := c.Query("folder-id")
+
+	if len(folderId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.UnmuteFolder(CurrentUser(c).ID, CurrentMembership(c).OrgID, folderId)
+	if err != nil {
+		if err == database.ErrFolderNotMuted {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
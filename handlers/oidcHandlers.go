@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fms/database"
+	"fms/oidc"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// domain the session cookie is set on after an sso login
+// the web client normally sets the cookie itself, but the sso callback is a browser redirect so the api has to do it
+var sessionCookieDomain = ""
+
+func SetSessionCookieDomain(domain string) {
+	sessionCookieDomain = domain
+}
+
+// holds a hash of the sso state for the browser that started the login, the callback only goes through in that same browser
+// otherwise someone could start a login with their own account and get a victim to open the callback, signing the victim in as them
+const oidcStateCookie = "oidc_state"
+
+// the same as the login state kept in the database, neither is any use after that
+const oidcStateCookieTTL = 10 * time.Minute
+
+func HandleListOIDCProviders(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"providers": oidc.ListProviders(),
+	})
+}
+
+// redirects the browser to the identity provider
+// a logged in user hitting this links the identity to their current account instead of signing in
+func HandleOIDCLogin(c fiber.Ctx) error {
+	provider, exists := oidc.GetProvider(c.Params("provider"))
+	if !exists {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	loginRequest, err := provider.NewLoginRequest()
+	if err != nil {
+		log.Printf("error: could not start sso login with %s: %v", provider.Name, err.Error())
+		return redirectWithSSOError(c, "provider_unavailable")
+	}
+
+	var linkUserId string
+	principal := CurrentPrincipal(c)
+	if principal.IsAuthenticated() {
+		linkUserId = principal.User.ID
+	}
+
+	err = database.SaveOIDCLoginState(loginRequest.State, database.OIDCLoginState{
+		Provider:     provider.Name,
+		Nonce:        loginRequest.Nonce,
+		CodeVerifier: loginRequest.CodeVerifier,
+		LinkUserID:   linkUserId,
+		RedirectTo:   safeRedirectPath(c.Query("redirect")),
+	})
+	if err != nil {
+		log.Printf("error: could not save sso login state: %v", err.Error())
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// lax so it still comes along on the provider's top level redirect back to the callback
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    database.HashToken(loginRequest.State),
+		Path:     "/",
+		Expires:  time.Now().Add(oidcStateCookieTTL),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect().Status(fiber.StatusFound).To(loginRequest.URL)
+}
+
+func HandleOIDCCallback(c fiber.Ctx) error {
+	provider, exists := oidc.GetProvider(c.Params("provider"))
+	if !exists {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	// the user cancelled or the provider refused, nothing to clean up since the state expires by itself
+	if len(c.Query("error")) > 0 {
+		return redirectWithSSOError(c, "access_denied")
+	}
+
+	state := c.Query("state")
+	code := c.Query("code")
+
+	if len(state) == 0 || len(code) == 0 {
+		return redirectWithSSOError(c, "invalid_request")
+	}
+
+	stateCookie := c.Cookies(oidcStateCookie)
+
+	// the state has been used or refused either way, so the cookie goes
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	if subtle.ConstantTimeCompare([]byte(stateCookie), []byte(database.HashToken(state))) != 1 {
+		return redirectWithSSOError(c, "invalid_state")
+	}
+
+	loginState, err := database.ConsumeOIDCLoginState(state, provider.Name)
+	if err != nil {
+		if !errors.Is(err, database.ErrInvalidToken) {
+			log.Printf("error: could not read sso login state: %v", err.Error())
+		}
+		return redirectWithSSOError(c, "invalid_state")
+	}
+
+	claims, err := provider.Exchange(code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Printf("error: sso code exchange with %s failed: %v", provider.Name, err.Error())
+		return redirectWithSSOError(c, "invalid_token")
+	}
+
+	userId, err := resolveSSOUser(provider, claims, loginState.LinkUserID)
+	if err != nil {
+		if errors.Is(err, errIdentityAlreadyLinked) || errors.Is(err, errNoLinkedAccount) {
+			return redirectWithSSOError(c, err.Error())
+		}
+		log.Printf("error: could not resolve sso user from %s: %v", provider.Name, err.Error())
+		return redirectWithSSOError(c, "login_failed")
+	}
+
+	session, err := database.CreateSession(userId)
+	if err != nil {
+		return redirectWithSSOError(c, "session_failed")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "session_token",
+		Value:    session.ID,
+		Domain:   sessionCookieDomain,
+		Path:     "/",
+		Expires:  time.Unix(session.ExpiresAt, 0),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect().Status(fiber.StatusFound).To(appURL + loginState.RedirectTo)
+}
+
+// short codes the client can show a specific message for, anything else is reported as login_failed
+var errIdentityAlreadyLinked = errors.New("identity_already_linked")
+var errNoLinkedAccount = errors.New("no_linked_account")
+
+// works out which fms account an id token belongs to, in order:
+// an identity that is already linked, the logged in user who started the flow, an account with the same verified email if the provider allows it, a brand new account if the provider allows sign ups
+func resolveSSOUser(provider *oidc.Provider, claims *oidc.Claims, linkUserId string) (string, error) {
+	userId, err := database.GetUserIdByIdentity(provider.Issuer, claims.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	if len(userId) > 0 {
+		// someone trying to link an identity that already belongs to a different account
+		if len(linkUserId) > 0 && linkUserId != userId {
+			return "", errIdentityAlreadyLinked
+		}
+		return userId, nil
+	}
+
+	if len(linkUserId) > 0 {
+		return linkUserId, database.LinkIdentity(linkUserId, provider.Issuer, claims.Subject, claims.Email)
+	}
+
+	if provider.LinkByEmail && claims.EmailVerified && len(claims.Email) > 0 {
+		userId, err = database.GetUserIdByVerifiedEmail(claims.Email)
+		if err != nil {
+			return "", err
+		}
+
+		if len(userId) > 0 {
+			return userId, database.LinkIdentity(userId, provider.Issuer, claims.Subject, claims.Email)
+		}
+	}
+
+	if !provider.AllowSignup {
+		return "", errNoLinkedAccount
+	}
+
+	preferred := claims.PreferredUsername
+	if len(preferred) == 0 {
+		preferred, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	userId, err = database.CreateExternalUser(preferred, claims.Email, claims.EmailVerified)
+	if err != nil {
+		return "", err
+	}
+
+	return userId, database.LinkIdentity(userId, provider.Issuer, claims.Subject, claims.Email)
+}
+
+// errors go back to the client's login page rather than showing a raw api response mid redirect
+func redirectWithSSOError(c fiber.Ctx, code string) error {
+	return c.Redirect().Status(fiber.StatusFound).To(appURL + "/login?sso_error=" + url.QueryEscape(code))
+}
+
+// only paths on the client are allowed so the login can't be turned into an open redirect
+func safeRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, `\`) {
+		return "/"
+	}
+	return path
+}
@@ -10,11 +10,7 @@ import (
 
 func HandleAddOrg(c fiber.Ctx) error {
 
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
 	// variable to hold the data submitted
 	type addOrgStruct struct {
@@ -24,7 +20,7 @@ func HandleAddOrg(c fiber.Ctx) error {
 	var addOrgData addOrgStruct
 
 	// attempt to parse request body
-	err = c.Bind().Body(&addOrgData)
+	err := c.Bind().Body(&addOrgData)
 	// if the server is unable to read the body, it returns a HTTP code 401
 	if err != nil {
 		return c.SendStatus(fiber.StatusUnauthorized)
@@ -41,8 +37,8 @@ func HandleAddOrg(c fiber.Ctx) error {
 	}
 
 	// attempt to create org in the database
-	// the create org func checks for the constraint that ensures only 1 org can be created by a user
-	_, err = database.CreateOrg(userWithSession.User.ID, addOrgData.Name)
+	// the create org func checks the user's plan for how many orgs they can create
+	_, err = database.CreateOrg(user.ID, addOrgData.Name, auditActor(c))
 	if err != nil {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
 			"error": err.Error(),
@@ -53,34 +49,18 @@ func HandleAddOrg(c fiber.Ctx) error {
 }
 
 func HandleChangeOrgName(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	user := CurrentUser(c)
 
-	orgId := c.Query("org_id")
+	orgId := CurrentMembership(c).OrgID
 	orgName := c.Query("org_name")
 
-	if len(orgId) == 0 || len(orgName) == 0 {
+	if len(orgName) == 0 {
 		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
 			"error": "Missing URL params.",
 		})
 	}
 
-	canView, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	if strings.ToLower(role) != "owner" || !canView {
-		return c.SendStatus(fiber.StatusForbidden)
-	}
-
-	err = database.ChangeOrgName(orgId, orgName, userWithSession.User.ID)
+	err := database.ChangeOrgName(orgId, orgName, user.ID, auditActor(c))
 
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE") {
@@ -97,31 +77,7 @@ func HandleChangeOrgName(c fiber.Ctx) error {
 }
 
 func HandleGetOwnedOrgDetails(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	orgId := c.Query("org_id")
-
-	if len(orgId) == 0 {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": "Missing URL params.",
-		})
-	}
-
-	canView, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	if strings.ToLower(role) != "owner" || !canView {
-		return c.SendStatus(fiber.StatusForbidden)
-	}
+	orgId := CurrentMembership(c).OrgID
 
 	org := database.GetOrgById(orgId)
 	members := database.GetOrgMembers(orgId)
@@ -133,59 +89,22 @@ func HandleGetOwnedOrgDetails(c fiber.Ctx) error {
 }
 
 func HandleViewOrg(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	orgId := c.Query("org_id")
-
-	if len(orgId) == 0 {
-		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
-			"error": "Missing URL params.",
-		})
-	}
-
-	canView, role, err := database.CanViewOrg(userWithSession.User.ID, orgId)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
-	}
-
-	if !canView {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized request. Access Denied.",
-		})
-	}
+	orgId := CurrentMembership(c).OrgID
 
 	org := database.GetOrgById(orgId)
+	membership := CurrentMembership(c)
 
+	// the client uses the capabilities to decide which actions to show
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
-		"org":  org,
-		"role": role,
+		"org":          org,
+		"role":         membership.Access.Role,
+		"capabilities": membership.Access.Capabilities,
 	})
 
 }
 
 func HandleViewOrgMembers(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	ownedOrg := database.GetUserOrg(userWithSession.User.ID)
-
-	if len(ownedOrg.ID) == 0 {
-		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
-			"org": nil,
-		})
-	}
-
-	members := database.GetOrgMembers(ownedOrg.ID)
+	members := database.GetOrgMembers(CurrentMembership(c).OrgID)
 
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
 		"members": members,
@@ -194,60 +113,56 @@ func HandleViewOrgMembers(c fiber.Ctx) error {
 }
 
 func HandleViewUserOrgs(c fiber.Ctx) error {
-	// authenticate the request
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+	user := CurrentUser(c)
 
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
-
-	// fetch the user's created org and joined orgs
+	// fetch the user's created orgs and joined orgs
 	// data that doesn't exist will return nil (null)
 
-	ownedOrg := database.GetUserOrg(userWithSession.User.ID)
-	joinedOrgs := database.GetJoinedOrgs(userWithSession.User.ID)
+	ownedOrgs := database.GetOwnedOrgs(user.ID)
+	joinedOrgs := database.GetJoinedOrgs(user.ID)
 
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
 		"joinedOrgs": joinedOrgs,
-		"ownedOrg":   ownedOrg,
+		"ownedOrgs":  ownedOrgs,
 	})
 }
 
 func HandleChangeMemberRole(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	membership := CurrentMembership(c)
 
 	memberUsername := c.Query("username")
 	newRole := c.Query("role")
 
-	if len(newRole) == 0 || (newRole != "Editor" && newRole != "Viewer") {
+	if len(newRole) == 0 || len(memberUsername) == 0 {
 		return c.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
-	if len(memberUsername) == 0 {
-		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	newRole, ok := assignableRole(c, membership, newRole)
+	if !ok {
+		return nil
+	}
+
+	targetRole, err := database.GetMemberRole(membership.OrgID, memberUsername)
+	if err != nil {
+		return memberError(c, err)
 	}
 
-	err = database.ChangeOrgMemberRole(userWithSession.User.ID, memberUsername, newRole)
+	// admins can't touch owners or other admins
+	if !database.CanManageMember(membership.Access.Role, targetRole, newRole) {
+		return forbidden(c)
+	}
+
+	err = database.ChangeOrgMemberRole(membership.OrgID, memberUsername, newRole, auditActor(c))
 
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return memberError(c, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
 func HandleRemoveMember(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
-
-	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
+	membership := CurrentMembership(c)
 
 	memberUsername := c.Query("username")
 
@@ -255,31 +170,86 @@ func HandleRemoveMember(c fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusUnprocessableEntity)
 	}
 
-	err = database.RemoveOrgMember(userWithSession.User.ID, memberUsername)
+	targetRole, err := database.GetMemberRole(membership.OrgID, memberUsername)
+	if err != nil {
+		return memberError(c, err)
+	}
+
+	if !database.CanManageMember(membership.Access.Role, targetRole, "") {
+		return forbidden(c)
+	}
+
+	err = database.RemoveOrgMember(membership.OrgID, memberUsername, auditActor(c))
 
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return memberError(c, err)
 	}
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func HandleDeleteOrg(c fiber.Ctx) error {
-	userWithSession, err := database.AuthenticateCookie(c.Cookies("session_token"))
+func HandleLeaveOrg(c fiber.Ctx) error {
+	user := CurrentUser(c)
 
+	err := database.LeaveOrg(CurrentMembership(c).OrgID, user.ID, user.Username, auditActor(c))
 	if err != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+		return memberError(c, err)
 	}
 
-	orgId := database.GetUserOrg(userWithSession.User.ID)
+	return c.SendStatus(fiber.StatusOK)
+}
 
-	if orgId == nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+// built-in roles or one of the org's custom roles, resolved to its stored name
+// the one check for every way a role gets handed out, changing a member, inviting someone or setting a group's role
+// the caller can't give out admin or above unless they own the org, or any role that can do more than they can
+// writes the response and returns false when the role can't be used
+func assignableRole(c fiber.Ctx, membership *OrgMembership, role string) (string, bool) {
+	role, err := database.ResolveAssignableRole(membership.OrgID, role)
+	if err != nil {
+		if err == database.ErrRoleNotFound {
+			c.SendStatus(fiber.StatusUnprocessableEntity)
+			return "", false
+		}
+		c.SendStatus(fiber.StatusInternalServerError)
+		return "", false
 	}
 
-	err = database.DeleteOrg(orgId.ID)
+	if !database.CanManageMember(membership.Access.Role, "", role) {
+		forbidden(c)
+		return "", false
+	}
+
+	within, err := database.RoleWithinAccess(membership.OrgID, &membership.Access, role)
+	if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return "", false
+	}
+
+	if !within {
+		forbidden(c)
+		return "", false
+	}
+
+	return role, true
+}
+
+func memberError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrNotOrgMember:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrLastOwner:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+func HandleDeleteOrg(c fiber.Ctx) error {
+	err := database.DeleteOrg(CurrentMembership(c).OrgID, auditActor(c))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
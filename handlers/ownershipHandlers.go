@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fms/database"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func HandleTransferOwnership(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	username := c.Query("username")
+
+	if len(username) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	if username == user.Username {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+
+	err := database.NominateOwner(CurrentMembership(c).OrgID, user.ID, username, auditActor(c))
+	if err != nil {
+		return ownershipError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleCancelOwnershipTransfer(c fiber.Ctx) error {
+	err := database.CancelOwnershipTransfer(CurrentMembership(c).OrgID, auditActor(c))
+	if err != nil {
+		return ownershipError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleGetOwnershipTransfers(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	transfers, err := database.GetIncomingOwnershipTransfers(user.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"transfers": transfers,
+	})
+}
+
+func HandleAcceptOwnershipTransfer(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	transferId := c.Query("transfer_id")
+
+	if len(transferId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.AcceptOwnershipTransfer(transferId, user.ID, auditActor(c))
+	if err != nil {
+		return ownershipError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDeclineOwnershipTransfer(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	transferId := c.Query("transfer_id")
+
+	if len(transferId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.DeclineOwnershipTransfer(transferId, user.ID, auditActor(c))
+	if err != nil {
+		return ownershipError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func ownershipError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrTransferNotFound:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrNotOrgMember:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrTransferLimitExceeded, database.ErrAlreadyOwner:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
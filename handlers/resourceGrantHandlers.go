@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"fms/database"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+// shares one file or folder with a registered user who isn't in the org
+// the member can only hand out access they have themselves
+func HandleShareWithUser(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	type shareWithUserStruct struct {
+		Org_id     string `json:"org_id" validate:"required"`
+		File_id    string `json:"file_id"`
+		Folder_id  string `json:"folder_id"`
+		Username   string `json:"username" validate:"required"`
+		Permission string `json:"permission"`
+	}
+
+	var shareData shareWithUserStruct
+
+	err := c.Bind().Body(&shareData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(shareData)
+	if err != nil || (len(shareData.File_id) == 0) == (len(shareData.Folder_id) == 0) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if len(shareData.Permission) == 0 {
+		shareData.Permission = database.FolderPermissionView
+	}
+
+	if shareData.Permission != database.FolderPermissionView && shareData.Permission != database.FolderPermissionEdit {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Permission must be view or edit",
+		})
+	}
+
+	resource := database.Resource{Type: database.ResourceFolder, ID: shareData.Folder_id}
+	var allowed bool
+	if len(shareData.File_id) > 0 {
+		resource = database.Resource{Type: database.ResourceFile, ID: shareData.File_id}
+		allowed, err = canAccessFileFolder(c, shareData.File_id, shareData.Permission)
+	} else {
+		allowed, err = canAccessFolder(c, shareData.Folder_id, shareData.Permission)
+	}
+
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !allowed {
+		return forbidden(c)
+	}
+
+	err = database.GrantResourceAccess(membership.OrgID, user.ID, resource, strings.TrimSpace(shareData.Username), shareData.Permission, auditActor(c))
+	if err != nil {
+		return grantError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// members who manage folders see every grant in the org, everyone else sees the ones they made
+func HandleGetResourceGrants(c fiber.Ctx) error {
+	grants, err := database.GetResourceGrants(CurrentMembership(c).OrgID, shareLinkOwnerScope(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"grants": grants,
+	})
+}
+
+func HandleRevokeResourceGrant(c fiber.Ctx) error {
+	grantId := c.Query("grant_id")
+
+	if len(grantId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RevokeResourceGrant(CurrentMembership(c).OrgID, grantId, shareLinkOwnerScope(c), auditActor(c))
+	if err != nil {
+		return grantError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleGetSharedWithMe(c fiber.Ctx) error {
+	items, err := database.GetSharedWithMe(CurrentUser(c).ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"items": items,
+	})
+}
+
+func HandleRemoveSharedWithMe(c fiber.Ctx) error {
+	grantId := c.Query("grant_id")
+
+	if len(grantId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RemoveSharedWithMe(grantId, CurrentUser(c).ID, auditActor(c))
+	if err != nil {
+		return grantError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// what a shared item holds, the optional folder-id query param opens one of the folders below a shared folder
+func HandleViewSharedItem(c fiber.Ctx) error {
+	grant, access, ok := openGrant(c, database.FolderPermissionView)
+	if !ok {
+		return nil
+	}
+
+	response := fiber.Map{
+		"type":       grant.ResourceType,
+		"name":       grant.ResourceName,
+		"permission": grant.Permission,
+	}
+
+	if grant.ResourceType == database.ResourceFile {
+		file, err := database.GetFileById(grant.ResourceID, grant.OrgID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		response["file"] = toSharedFile(*file)
+
+		return c.Status(fiber.StatusOK).JSON(response)
+	}
+
+	folderId := c.Query("folder-id", grant.ResourceID)
+
+	folderName, ok := sharedFolderInGrant(c, grant, access, folderId, database.FolderPermissionView)
+	if !ok {
+		return nil
+	}
+
+	folders, files := listSharedFolder(access, folderId, grant.OrgID)
+
+	response["folder"] = fiber.Map{"id": folderId, "name": folderName}
+	response["folders"] = folders
+	response["files"] = files
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+func HandleDownloadSharedFile(c fiber.Ctx) error {
+	grant, access, ok := openGrant(c, database.FolderPermissionView)
+	if !ok {
+		return nil
+	}
+
+	file, ok := sharedFileInGrant(c, grant, access, c.Query("file-id"), database.FolderPermissionView)
+	if !ok {
+		return nil
+	}
+
+	return sendOrgFile(c, strconv.FormatInt(*file.Id, 10), file.Name, file.Type, "attachment")
+}
+
+// edit grants on a folder can add files anywhere inside it, the org is told the same as for a member's upload
+func HandleUploadToSharedFolder(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	grant, access, ok := openGrant(c, database.FolderPermissionEdit)
+	if !ok {
+		return nil
+	}
+
+	if grant.ResourceType != database.ResourceFolder {
+		return forbidden(c)
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to get file: " + err.Error(),
+		})
+	}
+
+	if !checkUploadedFile(c, file) {
+		return nil
+	}
+
+	folderId := c.FormValue("folderId", grant.ResourceID)
+
+	_, ok = sharedFolderInGrant(c, grant, access, folderId, database.FolderPermissionEdit)
+	if !ok {
+		return nil
+	}
+
+	// by id, another folder in the org could have the same name
+	err = database.UploadFileToFolderId(file, grant.OrgID, folderId, user.ID, "", auditActor(c))
+	if err != nil {
+		if strings.Contains(err.Error(), "exists") {
+			return c.SendStatus(fiber.StatusConflict)
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// edit grants can delete the shared file, or files anywhere inside a shared folder
+func HandleDeleteSharedFile(c fiber.Ctx) error {
+	user := CurrentUser(c)
+
+	grant, access, ok := openGrant(c, database.FolderPermissionEdit)
+	if !ok {
+		return nil
+	}
+
+	file, ok := sharedFileInGrant(c, grant, access, c.Query("file-id"), database.FolderPermissionEdit)
+	if !ok {
+		return nil
+	}
+
+	err := database.DeleteFile(strconv.FormatInt(*file.Id, 10), grant.OrgID, user.ID, file.Name, auditActor(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// loads the caller's grant from the grant_id param along with the folder access of the member who made it
+// a grant only reaches what its maker can still reach, the same as a share link
+// writes the response and returns false when the grant can't be used for the permission
+func openGrant(c fiber.Ctx, permission string) (*database.ResourceGrantAccess, *database.FolderAccess, bool) {
+	grantId := c.Query("grant_id")
+	if len(grantId) == 0 {
+		c.SendStatus(fiber.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+
+	grant, err := database.GetResourceGrant(grantId, CurrentUser(c).ID)
+	if err != nil {
+		grantError(c, err)
+		return nil, nil, false
+	}
+
+	if permission == database.FolderPermissionEdit && grant.Permission != database.FolderPermissionEdit {
+		forbidden(c)
+		return nil, nil, false
+	}
+
+	access, err := database.LoadMemberFolderAccess(grant.GrantedBy, grant.OrgID)
+	if err != nil {
+		if err == database.ErrNotOrgMember {
+			grantError(c, database.ErrGrantNotFound)
+			return nil, nil, false
+		}
+		c.SendStatus(fiber.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	folderId := grant.ResourceID
+	if grant.ResourceType == database.ResourceFile {
+		folderId, err = database.GetFileFolderId(grant.ResourceID)
+		if err != nil {
+			grantError(c, database.ErrGrantNotFound)
+			return nil, nil, false
+		}
+	}
+
+	if !access.Allows(folderId, permission) {
+		forbidden(c)
+		return nil, nil, false
+	}
+
+	return grant, access, true
+}
+
+// returns the folder's name when it is the shared folder or below it
+func sharedFolderInGrant(c fiber.Ctx, grant *database.ResourceGrantAccess, access *database.FolderAccess, folderId string, permission string) (string, bool) {
+	if grant.ResourceType != database.ResourceFolder {
+		c.SendStatus(fiber.StatusNotFound)
+		return "", false
+	}
+
+	within, err := database.FolderIsWithin(folderId, grant.ResourceID)
+	if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return "", false
+	}
+
+	if !within || !access.Allows(folderId, permission) {
+		c.SendStatus(fiber.StatusNotFound)
+		return "", false
+	}
+
+	folderName, err := database.GetFolderNameById(folderId, grant.OrgID)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return "", false
+	}
+
+	return folderName, true
+}
+
+// the shared file itself, or a file anywhere inside the shared folder
+func sharedFileInGrant(c fiber.Ctx, grant *database.ResourceGrantAccess, access *database.FolderAccess, fileId string, permission string) (*database.FileData, bool) {
+	if grant.ResourceType == database.ResourceFile {
+		fileId = grant.ResourceID
+	}
+
+	if len(fileId) == 0 {
+		c.SendStatus(fiber.StatusUnprocessableEntity)
+		return nil, false
+	}
+
+	file, err := database.GetFileById(fileId, grant.OrgID)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return nil, false
+	}
+
+	if grant.ResourceType == database.ResourceFolder {
+		// files at the root of the org are never inside a shared folder
+		if file.ParentFolderId == nil {
+			c.SendStatus(fiber.StatusNotFound)
+			return nil, false
+		}
+
+		_, ok := sharedFolderInGrant(c, grant, access, strconv.FormatInt(*file.ParentFolderId, 10), permission)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return file, true
+}
+
+func grantError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrGrantNotFound, database.ErrShareTargetNotFound:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrUserNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case database.ErrAlreadyMember:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"fms/database"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+func HandleGetOrgRoles(c fiber.Ctx) error {
+	roles, err := database.GetOrgRoles(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"roles":        roles,
+		"capabilities": database.GrantableCapabilities(),
+	})
+}
+
+func HandleAddOrgRole(c fiber.Ctx) error {
+	type addRoleStruct struct {
+		Org_id       string   `json:"org_id" validate:"required"`
+		Name         string   `json:"name" validate:"required"`
+		Capabilities []string `json:"capabilities"`
+	}
+
+	var addRoleData addRoleStruct
+
+	err := c.Bind().Body(&addRoleData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	validate := validator.New()
+
+	err = validate.Struct(addRoleData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	addRoleData.Name = strings.TrimSpace(addRoleData.Name)
+
+	if len(addRoleData.Name) < 3 || len(addRoleData.Name) > 20 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role name must be between 3 and 20 characters",
+		})
+	}
+
+	roleId, err := database.CreateOrgRole(CurrentMembership(c).OrgID, addRoleData.Name, addRoleData.Capabilities, auditActor(c))
+	if err != nil {
+		return roleError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"id": strconv.FormatInt(roleId, 10),
+	})
+}
+
+func HandleUpdateOrgRole(c fiber.Ctx) error {
+	type updateRoleStruct struct {
+		Org_id       string   `json:"org_id" validate:"required"`
+		Role_id      string   `json:"role_id" validate:"required"`
+		Capabilities []string `json:"capabilities"`
+	}
+
+	var updateRoleData updateRoleStruct
+
+	err := c.Bind().Body(&updateRoleData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	validate := validator.New()
+
+	err = validate.Struct(updateRoleData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	err = database.UpdateOrgRole(CurrentMembership(c).OrgID, updateRoleData.Role_id, updateRoleData.Capabilities, auditActor(c))
+	if err != nil {
+		return roleError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDeleteOrgRole(c fiber.Ctx) error {
+	roleId := c.Query("role_id")
+
+	if len(roleId) == 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing URL params.",
+		})
+	}
+
+	err := database.DeleteOrgRole(CurrentMembership(c).OrgID, roleId, auditActor(c))
+	if err != nil {
+		return roleError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func roleError(c fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, database.ErrRoleNotFound):
+		return c.SendStatus(fiber.StatusNotFound)
+	case errors.Is(err, database.ErrRoleNameTaken), errors.Is(err, database.ErrRoleInUse):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, database.ErrUnknownCapability):
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
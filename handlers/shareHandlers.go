@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"fms/auth"
+	"fms/database"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+// the password for a protected link travels in a header so it doesn't end up in access logs with the url
+const sharePasswordHeader = "X-Share-Password"
+
+const minSharePasswordLength = 6
+
+// what someone outside the org sees of a file, no uploader or org details
+type sharedFile struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type sharedFolder struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func HandleCreateShareLink(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	type createShareStruct struct {
+		Org_id           string `json:"org_id" validate:"required"`
+		File_id          string `json:"file_id"`
+		Folder_id        string `json:"folder_id"`
+		Mode             string `json:"mode"`
+		Password         string `json:"password"`
+		Expires_in_hours int    `json:"expires_in_hours" validate:"gte=0"`
+		Max_downloads    int64  `json:"max_downloads" validate:"gte=0"`
+	}
+
+	var shareData createShareStruct
+
+	err := c.Bind().Body(&shareData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(shareData)
+	if err != nil || (len(shareData.File_id) == 0) == (len(shareData.Folder_id) == 0) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if len(shareData.Mode) == 0 {
+		shareData.Mode = database.ShareModeDownload
+	}
+
+	if shareData.Mode != database.ShareModeView && shareData.Mode != database.ShareModeDownload {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Mode must be view or download",
+		})
+	}
+
+	// only what the member can see themselves can be shared
+	resource := database.Resource{Type: database.ResourceFolder, ID: shareData.Folder_id}
+	var allowed bool
+	if len(shareData.File_id) > 0 {
+		resource = database.Resource{Type: database.ResourceFile, ID: shareData.File_id}
+		allowed, err = canAccessFileFolder(c, shareData.File_id, database.FolderPermissionView)
+	} else {
+		allowed, err = canAccessFolder(c, shareData.Folder_id, database.FolderPermissionView)
+	}
+
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !allowed {
+		return forbidden(c)
+	}
+
+	var passwordHash []byte
+	if len(shareData.Password) > 0 {
+		if len(shareData.Password) < minSharePasswordLength || len(shareData.Password) > auth.PasswordMaxLength() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Link passwords must be between %d and %d characters", minSharePasswordLength, auth.PasswordMaxLength()),
+			})
+		}
+
+		passwordHash, err = auth.GenerateHashedPassword(shareData.Password)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+
+	ttl := time.Duration(shareData.Expires_in_hours) * time.Hour
+
+	token, linkId, err := database.CreateShareLink(membership.OrgID, user.ID, resource, shareData.Mode, passwordHash, ttl, shareData.Max_downloads, auditActor(c))
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	// the token is only ever shown here, the database keeps its hash
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":    linkId,
+		"token": token,
+		"link":  fmt.Sprintf("%s/s/%s", appURL, url.PathEscape(token)),
+	})
+}
+
+// members who manage folders see every link in the org, everyone else sees the links they made
+func HandleGetShareLinks(c fiber.Ctx) error {
+	membership := CurrentMembership(c)
+
+	links, err := database.GetShareLinks(membership.OrgID, shareLinkOwnerScope(c))
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"links": links,
+	})
+}
+
+func HandleRevokeShareLink(c fiber.Ctx) error {
+	linkId := c.Query("link_id")
+
+	if len(linkId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.RevokeShareLink(CurrentMembership(c).OrgID, linkId, shareLinkOwnerScope(c), auditActor(c))
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// public, what the link points to
+// for a folder the optional folder-id query param opens one of the folders below the shared one
+func HandleViewShareLink(c fiber.Ctx) error {
+	link, access, ok := openShareLink(c)
+	if !ok {
+		return nil
+	}
+
+	err := database.RecordShareLinkView(link.ID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	response := fiber.Map{
+		"type":         link.ResourceType,
+		"name":         link.ResourceName,
+		"mode":         link.Mode,
+		"expiresAt":    link.ExpiresAt,
+		"maxDownloads": link.MaxDownloads,
+		"downloads":    link.DownloadCount,
+	}
+
+	if link.ResourceType == database.ResourceFile {
+		file, err := database.GetFileById(link.ResourceID, link.OrgID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		response["file"] = toSharedFile(*file)
+
+		return c.Status(fiber.StatusOK).JSON(response)
+	}
+
+	folderId := c.Query("folder-id", link.ResourceID)
+
+	within, err := database.FolderIsWithin(folderId, link.ResourceID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	if !within || !access.Allows(folderId, database.FolderPermissionView) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	folderName, err := database.GetFolderNameById(folderId, link.OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	folders, files := listSharedFolder(access, folderId, link.OrgID)
+
+	response["folder"] = fiber.Map{"id": folderId, "name": folderName}
+	response["folders"] = folders
+	response["files"] = files
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// public, streams one file through the same path as HandleDownloadFile
+// both modes count against the link's download limit, view links only differ in asking the browser to show the file rather than save it
+func HandleShareLinkFile(c fiber.Ctx) error {
+	link, access, ok := openShareLink(c)
+	if !ok {
+		return nil
+	}
+
+	fileId := link.ResourceID
+	if link.ResourceType == database.ResourceFolder {
+		fileId = c.Query("file-id")
+		if len(fileId) == 0 {
+			return c.SendStatus(fiber.StatusUnprocessableEntity)
+		}
+	}
+
+	file, err := database.GetFileById(fileId, link.OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if link.ResourceType == database.ResourceFolder {
+		// files at the root of the org are never inside a shared folder
+		if file.ParentFolderId == nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		parentId := strconv.FormatInt(*file.ParentFolderId, 10)
+
+		within, err := database.FolderIsWithin(parentId, link.ResourceID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		if !within || !access.Allows(parentId, database.FolderPermissionView) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+	}
+
+	// a file shown inline can be saved just the same, so every time its bytes go out it counts against the limit
+	err = database.ConsumeShareLinkDownload(link.ID)
+	if err != nil {
+		return shareError(c, err)
+	}
+
+	if link.Mode == database.ShareModeView {
+		return sendOrgFile(c, fileId, file.Name, file.Type, "inline")
+	}
+
+	return sendOrgFile(c, fileId, file.Name, file.Type, "attachment")
+}
+
+// looks up the token, checks the password and loads the folder access of the member who made the link
+// a link only ever shows what its maker can still see, so tightening a folder's access list also tightens the links into it
+// writes the response and returns false when the link can't be used
+func openShareLink(c fiber.Ctx) (*database.ShareLinkAccess, *database.FolderAccess, bool) {
+	link, err := database.GetShareLinkByToken(c.Params("token"))
+	if err != nil {
+		shareError(c, err)
+		return nil, nil, false
+	}
+
+	if len(link.PasswordHash) > 0 {
+		lockedUntil, err := database.ShareLinkLockedUntil(link.ID)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return nil, nil, false
+		}
+
+		if lockedUntil > 0 {
+			c.Set("Retry-After", strconv.FormatInt(lockedUntil-time.Now().Unix(), 10))
+			c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Too many wrong passwords. Please try again later",
+			})
+			return nil, nil, false
+		}
+
+		password := c.Get(sharePasswordHeader)
+
+		matches, _ := auth.CheckPasswordHash(password, link.PasswordHash)
+		if !matches {
+			// an empty password is the client asking whether one is needed, it doesn't count as a guess
+			if len(password) > 0 {
+				err = database.RecordFailedSharePassword(link.ID)
+				if err != nil {
+					c.SendStatus(fiber.StatusInternalServerError)
+					return nil, nil, false
+				}
+			}
+
+			c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":            "This link needs a password",
+				"passwordRequired": true,
+			})
+			return nil, nil, false
+		}
+	}
+
+	access, err := database.LoadMemberFolderAccess(link.CreatedBy, link.OrgID)
+	if err != nil {
+		if err == database.ErrNotOrgMember {
+			shareError(c, database.ErrInvalidToken)
+			return nil, nil, false
+		}
+		c.SendStatus(fiber.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	folderId := link.ResourceID
+	if link.ResourceType == database.ResourceFile {
+		folderId, err = database.GetFileFolderId(link.ResourceID)
+		if err != nil {
+			shareError(c, database.ErrInvalidToken)
+			return nil, nil, false
+		}
+	}
+
+	if !access.Allows(folderId, database.FolderPermissionView) {
+		shareError(c, database.ErrInvalidToken)
+		return nil, nil, false
+	}
+
+	return link, access, true
+}
+
+// empty when the caller can see and revoke every link in the org
+func shareLinkOwnerScope(c fiber.Ctx) string {
+	if CurrentMembership(c).Access.Has(database.CapFolderManage) {
+		return ""
+	}
+
+	return CurrentUser(c).ID
+}
+
+// the contents of a folder as someone outside the org sees them, limited to the subfolders the access allows
+// listed by id, folder names are only unique under their parent
+func listSharedFolder(access *database.FolderAccess, folderId string, orgId string) ([]sharedFolder, []sharedFile) {
+	folders := []sharedFolder{}
+	for _, folder := range access.FilterFolders(database.GetFolderChildrenById(folderId, orgId)) {
+		folders = append(folders, sharedFolder{ID: *folder.Id, Name: folder.Name, CreatedAt: folder.CreatedAt})
+	}
+
+	files := []sharedFile{}
+	for _, file := range access.FilterFiles(database.GetFolderFilesById(folderId, orgId)) {
+		files = append(files, toSharedFile(file))
+	}
+
+	return folders, files
+}
+
+func toSharedFile(file database.FileData) sharedFile {
+	return sharedFile{ID: *file.Id, Name: file.Name, Type: file.Type, Size: file.Size, CreatedAt: file.CreatedAt}
+}
+
+func shareError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrShareTargetNotFound, database.ErrShareLinkNotFound:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrInvalidToken, database.ErrShareLinkExhausted:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"fms/database"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	defaultDeliveryPageSize = 20
+	maxDeliveryPageSize     = 100
+)
+
+func HandleGetWebhookEvents(c fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"events": database.WebhookEvents,
+	})
+}
+
+func HandleGetWebhooks(c fiber.Ctx) error {
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhooks, err := database.GetWebhooks(CurrentMembership(c).OrgID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"webhooks": webhooks,
+	})
+}
+
+// leave events empty to get every event
+func HandleCreateWebhook(c fiber.Ctx) error {
+	user := CurrentUser(c)
+	membership := CurrentMembership(c)
+
+	type createWebhookStruct struct {
+		Org_id string   `json:"org_id" validate:"required"`
+		Url    string   `json:"url" validate:"required"`
+		Events []string `json:"events"`
+	}
+
+	var webhookData createWebhookStruct
+
+	err := c.Bind().Body(&webhookData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(webhookData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhookURL, ok := checkWebhookURL(c, webhookData.Url)
+	if !ok {
+		return nil
+	}
+
+	webhookId, secret, err := database.CreateWebhook(membership.OrgID, user.ID, webhookURL, uniqueEvents(webhookData.Events), auditActor(c))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	// the secret is only ever shown here, the receiver needs it to check the signature on every delivery
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":     webhookId,
+		"secret": secret,
+	})
+}
+
+// active is optional and leaves the webhook as it was when missing
+func HandleUpdateWebhook(c fiber.Ctx) error {
+	membership := CurrentMembership(c)
+
+	type updateWebhookStruct struct {
+		Org_id     string   `json:"org_id" validate:"required"`
+		Webhook_id string   `json:"webhook_id" validate:"required"`
+		Url        string   `json:"url" validate:"required"`
+		Events     []string `json:"events"`
+		Active     *bool    `json:"active"`
+	}
+
+	var webhookData updateWebhookStruct
+
+	err := c.Bind().Body(&webhookData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Internal server error.",
+		})
+	}
+
+	err = validator.New().Struct(webhookData)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Missing form data.",
+		})
+	}
+
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhookURL, ok := checkWebhookURL(c, webhookData.Url)
+	if !ok {
+		return nil
+	}
+
+	err = database.UpdateWebhook(membership.OrgID, webhookData.Webhook_id, webhookURL, uniqueEvents(webhookData.Events), webhookData.Active, auditActor(c))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func HandleDeleteWebhook(c fiber.Ctx) error {
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhookId := c.Query("webhook_id")
+
+	if len(webhookId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	err := database.DeleteWebhook(CurrentMembership(c).OrgID, webhookId, auditActor(c))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// one page of a webhook's delivery log, newest first, paged with cursor and limit like notifications
+func HandleGetWebhookDeliveries(c fiber.Ctx) error {
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhookId := c.Query("webhook_id")
+
+	if len(webhookId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultDeliveryPageSize)))
+	if err != nil || limit < 1 || limit > maxDeliveryPageSize {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("Limit must be between 1 and %d", maxDeliveryPageSize),
+		})
+	}
+
+	var before int64
+	cursor := c.Query("cursor")
+	if len(cursor) > 0 {
+		before, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || before < 1 {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+	}
+
+	deliveries, next, err := database.GetWebhookDeliveries(CurrentMembership(c).OrgID, webhookId, before, limit)
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	var nextCursor *string
+	if next != nil {
+		value := strconv.FormatInt(*next, 10)
+		nextCursor = &value
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"deliveries": deliveries,
+		"nextCursor": nextCursor,
+	})
+}
+
+// sends a past delivery again, whatever happened to it the first time
+func HandleRedeliverWebhook(c fiber.Ctx) error {
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	deliveryId := c.Query("delivery_id")
+
+	if len(deliveryId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	newId, err := database.RedeliverWebhook(CurrentMembership(c).OrgID, deliveryId, auditActor(c))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"deliveryId": newId,
+	})
+}
+
+// queues a ping event so the receiver can be checked without waiting for real activity
+func HandlePingWebhook(c fiber.Ctx) error {
+	if !canManageWebhooks(c) {
+		return nil
+	}
+
+	webhookId := c.Query("webhook_id")
+
+	if len(webhookId) == 0 {
+		return c.SendStatus(fiber.StatusUnprocessableEntity)
+	}
+
+	deliveryId, err := database.PingWebhook(CurrentMembership(c).OrgID, webhookId, auditActor(c))
+	if err != nil {
+		return webhookError(c, err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"deliveryId": deliveryId,
+	})
+}
+
+// webhooks hear about activity in every folder, restricted ones included
+// so pointing one somewhere, or reading what was sent, is limited to members who can already see past folder access lists
+func canManageWebhooks(c fiber.Ctx) bool {
+	if !CurrentMembership(c).Access.Has(database.CapFolderManage) {
+		forbidden(c)
+		return false
+	}
+
+	return true
+}
+
+// only plain http and https urls, http is allowed so a receiver on the same machine can be used for testing
+func checkWebhookURL(c fiber.Ctx, rawURL string) (string, bool) {
+	rawURL = strings.TrimSpace(rawURL)
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 || parsed.User != nil {
+		c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "Please enter a valid http or https URL",
+		})
+		return "", false
+	}
+
+	return rawURL, true
+}
+
+func uniqueEvents(events []string) []string {
+	unique := []string{}
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if len(event) > 0 && !slices.Contains(unique, event) {
+			unique = append(unique, event)
+		}
+	}
+
+	return unique
+}
+
+func webhookError(c fiber.Ctx, err error) error {
+	switch err {
+	case database.ErrWebhookNotFound, database.ErrWebhookDeliveryNotFound:
+		return c.SendStatus(fiber.StatusNotFound)
+	case database.ErrUnknownWebhookEvent:
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
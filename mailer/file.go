@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// writes every message to an .eml file instead of sending it
+// for local development and tests, the files open in any mail client
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	err := os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create mail directory: %s", err.Error())
+	}
+
+	body, err := buildMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.New().String())
+	path := filepath.Join(m.Dir, name)
+
+	err = os.WriteFile(path, body, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not write mail file: %s", err.Error())
+	}
+
+	log.Printf("mailer: wrote %q for %s to %s", msg.Subject, msg.To, path)
+	return nil
+}
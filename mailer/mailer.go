@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	// plain text body, always sent
+	Text string
+	// optional html body, sent alongside the text as multipart/alternative when set
+	HTML string
+	// extra headers such as List-Unsubscribe
+	Headers map[string]string
+}
+
+// anything that can deliver a message
+// the app only ever talks to this interface so the smtp server can be swapped for a file sink in development and tests
+type Mailer interface {
+	Send(msg Message) error
+}
+
+type Config struct {
+	// "smtp" or "file"
+	Driver string
+	From   string
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+
+	// directory the file driver writes messages to
+	Dir string
+}
+
+// the mailer the rest of the app sends through, configured once at startup
+// defaults to the file sink so nothing goes out by accident before Configure is called
+var current Mailer = &FileMailer{Dir: "maildrop", From: "no-reply@localhost"}
+
+func Configure(cfg Config) error {
+	switch cfg.Driver {
+	case "smtp":
+		if len(cfg.SMTPHost) == 0 {
+			return fmt.Errorf("mail driver smtp requires SMTP_HOST")
+		}
+		current = &SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		}
+	case "file", "":
+		current = &FileMailer{Dir: cfg.Dir, From: cfg.From}
+	default:
+		return fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+
+	log.Printf("mailer: using %s driver", cfg.Driver)
+	return nil
+}
+
+// swap in a different implementation, mostly useful for tests
+func Use(m Mailer) {
+	current = m
+}
+
+func Send(msg Message) error {
+	return current.Send(msg)
+}
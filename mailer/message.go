@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+)
+
+// builds the raw rfc 5322 message, shared by every driver so the file sink writes exactly what smtp would send
+func buildMessage(from string, msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", encodeHeader(msg.Subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	for key, value := range msg.Headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+
+	if len(msg.HTML) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+		buf.WriteString(msg.Text)
+		return buf.Bytes(), nil
+	}
+
+	boundary := "fms-alternative-boundary"
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(msg.Text)
+	buf.WriteString("\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	buf.WriteString(msg.HTML)
+	buf.WriteString("\r\n")
+
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
+
+// subjects can contain non ascii characters (org names etc) which need encoding in a header
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	addr := m.Host + ":" + strconv.Itoa(m.Port)
+
+	// local catchers like mailpit don't need auth, and net/smtp refuses plain auth over an unencrypted connection to anything but localhost anyway
+	var auth smtp.Auth
+	if len(m.Username) > 0 {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	body, err := buildMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	// the from setting can have a display name like "FMS <no-reply@example.com>", that only belongs in the header
+	// the envelope sender has to be the bare address or servers refuse the mail
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %s", m.From, err.Error())
+	}
+
+	// sendmail upgrades to tls by itself when the server advertises starttls
+	err = smtp.SendMail(addr, auth, from.Address, []string{msg.To}, body)
+	if err != nil {
+		return fmt.Errorf("could not send mail to %s: %s", msg.To, err.Error())
+	}
+
+	return nil
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"fms/auth"
+	"fms/config"
 	"fms/database"
+	"fms/digest"
+	"fms/handlers"
+	"fms/mailer"
+	"fms/oidc"
+	"fms/webhook"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/joho/godotenv"
@@ -32,18 +41,102 @@ func main() {
 		log.Fatal("ENV Error: DATABASE_TOKEN not found")
 	}
 
+	cfg := config.Load()
+
+	err = auth.SetPasswordPolicy(auth.PasswordPolicy{
+		MinLength:             cfg.PasswordMinLength,
+		MaxLength:             cfg.PasswordMaxLength,
+		BreachedPasswordsFile: cfg.BreachedPasswordsFile,
+	})
+	if err != nil {
+		log.Fatal("Config Error: " + err.Error())
+	}
+
+	err = auth.SetArgon2Params(auth.Argon2Params{
+		Memory:  cfg.Argon2Memory,
+		Time:    cfg.Argon2Time,
+		Threads: cfg.Argon2Threads,
+	})
+	if err != nil {
+		log.Fatal("Config Error: " + err.Error())
+	}
+
+	err = mailer.Configure(mailer.Config{
+		Driver:       cfg.MailDriver,
+		From:         cfg.MailFrom,
+		Dir:          cfg.MailDir,
+		SMTPHost:     cfg.SMTPHost,
+		SMTPPort:     cfg.SMTPPort,
+		SMTPUsername: cfg.SMTPUsername,
+		SMTPPassword: cfg.SMTPPassword,
+	})
+	if err != nil {
+		log.Fatal("Config Error: " + err.Error())
+	}
+
+	handlers.SetAppURL(cfg.AppURL)
+	handlers.SetSessionCookieDomain(cfg.SessionCookieDomain)
+
+	if len(cfg.OIDCProvidersFile) > 0 {
+		err = oidc.LoadProviders(cfg.OIDCProvidersFile)
+		if err != nil {
+			log.Fatal("Config Error: " + err.Error())
+		}
+	}
+
+	err = database.SetDefaultOrgLimits(database.OrgLimits{
+		OwnedOrgs:   cfg.OrgOwnedLimit,
+		Memberships: cfg.OrgMembershipLimit,
+	})
+	if err != nil {
+		log.Fatal("Config Error: " + err.Error())
+	}
+
+	if len(cfg.PlansFile) > 0 {
+		err = database.LoadPlanLimits(cfg.PlansFile)
+		if err != nil {
+			log.Fatal("Config Error: " + err.Error())
+		}
+	}
+
 	database.ConnectDatabase(dbURL, dbToken)
 
+	database.StartLoginThrottlePruning(time.Hour)
+
+	if cfg.NotificationRetentionDays > 0 {
+		database.StartNotificationRetention(time.Duration(cfg.NotificationRetentionDays)*24*time.Hour, 6*time.Hour)
+	}
+
+	if cfg.DigestIntervalMinutes > 0 {
+		digest.Configure(digest.Config{
+			AppURL: strings.TrimRight(cfg.AppURL, "/"),
+			APIURL: strings.TrimRight(cfg.APIURL, "/"),
+		})
+		digest.Start(time.Duration(cfg.DigestIntervalMinutes) * time.Minute)
+	}
+
+	if cfg.WebhookPollSeconds > 0 {
+		webhook.Configure(webhook.Config{AllowPrivateAddresses: cfg.WebhookAllowPrivateAddresses})
+		webhook.Start(time.Duration(cfg.WebhookPollSeconds) * time.Second)
+	}
+
 	// create a fiber app
 	// body limit automatically rejects requests that exceed the defined limit
 	// the response is HTTP 413
 	// format is mb * 1024 * 10
+	// cloudflared connects from the same machine so only loopback is trusted to set the client ip header
+	// anything else gets the raw remote address, otherwise the login throttle could be dodged by spoofing the header
 	app := fiber.New(fiber.Config{
-		BodyLimit: 10 * 1024 * 1024,
+		BodyLimit:   10 * 1024 * 1024,
+		ProxyHeader: "CF-Connecting-IP",
+		TrustProxy:  true,
+		TrustProxyConfig: fiber.TrustProxyConfig{
+			Loopback: true,
+		},
 	})
 
 	// setup the endpoints for the app
-	SetupRoutes(app)
+	SetupRoutes(app, cfg.AllowedOrigins)
 
 	fmt.Printf("app listening on http://localhost%s\n", port)
 
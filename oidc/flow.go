@@ -0,0 +1,147 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// everything that has to survive the round trip through the identity provider
+// the caller stores it server side keyed by state
+type LoginRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	URL          string
+}
+
+// starts an authorization code flow with pkce
+// state guards the callback against csrf, nonce ties the id token to this login, the verifier proves the code exchange comes from whoever started the flow
+func (p *Provider) NewLoginRequest() (LoginRequest, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return LoginRequest{}, err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return LoginRequest{}, err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return LoginRequest{}, err
+	}
+
+	verifier, err := randomString()
+	if err != nil {
+		return LoginRequest{}, err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return LoginRequest{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		URL:          discovery.AuthorizationEndpoint + separator + query.Encode(),
+	}, nil
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// swaps the authorization code for tokens and returns the verified id token claims
+func (p *Provider) Exchange(code string, codeVerifier string, nonce string) (*Claims, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	// client_secret_basic is the spec default, post is only used when the provider says it doesn't do basic
+	// public clients without a secret just identify themselves with client_id
+	switch {
+	case len(p.ClientSecret) == 0:
+		form.Set("client_id", p.ClientID)
+	case len(discovery.TokenEndpointAuth) > 0 && !slices.Contains(discovery.TokenEndpointAuth, "client_secret_basic"):
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	default:
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	request.Body = io.NopCloser(strings.NewReader(form.Encode()))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %s", err.Error())
+	}
+
+	defer response.Body.Close()
+
+	var tokens tokenResponse
+
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token response: %s", err.Error())
+	}
+
+	if response.StatusCode != http.StatusOK || len(tokens.Error) > 0 {
+		return nil, fmt.Errorf("token endpoint returned %d: %s %s", response.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	if len(tokens.IDToken) == 0 {
+		return nil, fmt.Errorf("token response has no id_token, is the openid scope configured")
+	}
+
+	return p.verifyIDToken(tokens.IDToken, nonce)
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,191 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the id token claims fms cares about
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+}
+
+// aud can be a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(data, &many)
+	if err != nil {
+		return err
+	}
+
+	*a = many
+	return nil
+}
+
+// allowance for clock drift between fms and the identity provider
+const clockSkew = 2 * time.Minute
+
+func (p *Provider) verifyIDToken(raw string, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("id token is not a jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode id token header: %s", err.Error())
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("could not decode id token signature: %s", err.Error())
+	}
+
+	p.mu.Lock()
+	keys := p.keys
+	p.mu.Unlock()
+
+	if keys == nil {
+		return nil, fmt.Errorf("no jwks loaded for %s", p.Name)
+	}
+
+	key, err := keys.get(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// claims are only trusted after the signature checks out
+	var claims Claims
+
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode id token claims: %s", err.Error())
+	}
+
+	now := time.Now()
+
+	if strings.TrimRight(claims.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("id token issuer %q does not match %q", claims.Issuer, p.Issuer)
+	}
+
+	if !slices.Contains(claims.Audience, p.ClientID) {
+		return nil, fmt.Errorf("id token was not issued for this client")
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, fmt.Errorf("id token authorized party does not match this client")
+	}
+
+	if now.Add(-clockSkew).Unix() > claims.Expiry {
+		return nil, fmt.Errorf("id token has expired")
+	}
+
+	if claims.IssuedAt > now.Add(clockSkew).Unix() {
+		return nil, fmt.Errorf("id token was issued in the future")
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token nonce does not match")
+	}
+
+	if len(claims.Subject) == 0 {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+
+	return &claims, nil
+}
+
+// only asymmetric algorithms are accepted
+// "none" and the hmac family are refused outright, hmac would make the client secret a signing key anyone holding it could forge with
+func verifySignature(alg string, key any, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported id token algorithm %q", alg)
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("key type does not match algorithm %q", alg)
+		}
+		err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+		if err != nil {
+			return fmt.Errorf("invalid id token signature")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("key type does not match algorithm %q", alg)
+		}
+		// jws ecdsa signatures are r and s concatenated, each padded to the curve size
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != size*2 {
+			return fmt.Errorf("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return fmt.Errorf("invalid id token signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported key type")
+}
+
+func decodeSegment(segment string, target any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, target)
+}
@@ -0,0 +1,150 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type keySet struct {
+	uri string
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+// providers rotate keys by publishing the new one before using it
+// so an unknown kid triggers one refetch, rate limited so forged tokens with random kids can't be used to hammer the provider
+const jwksRefetchInterval = time.Minute
+
+func (k *keySet) get(kid string) (any, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, exists := k.keys[kid]; exists {
+		return key, nil
+	}
+
+	if time.Since(k.fetchedAt) < jwksRefetchInterval && k.keys != nil {
+		return nil, fmt.Errorf("no signing key with id %q", kid)
+	}
+
+	err := k.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	key, exists := k.keys[kid]
+	if !exists {
+		return nil, fmt.Errorf("no signing key with id %q", kid)
+	}
+
+	return key, nil
+}
+
+func (k *keySet) fetch() error {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	k.fetchedAt = time.Now()
+
+	err := getJSON(k.uri, &document)
+	if err != nil {
+		return fmt.Errorf("could not fetch jwks: %s", err.Error())
+	}
+
+	keys := map[string]any{}
+
+	for _, jwk := range document.Keys {
+		// encryption keys can't verify signatures
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// one key in a format we don't support shouldn't stop the others from working
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	k.keys = keys
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("ec key is not on curve %s", jwk.Crv)
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
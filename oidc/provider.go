@@ -0,0 +1,174 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// one entry in the providers file
+type ProviderConfig struct {
+	// short url safe name, used in /oidc/:provider/login
+	Name string `json:"name"`
+	// what the login button says
+	DisplayName  string `json:"displayName"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// must match the redirect uri registered with the identity provider, points at /oidc/:provider/callback
+	RedirectURL string   `json:"redirectUrl"`
+	Scopes      []string `json:"scopes"`
+	// create an fms account on first login when no linked account exists
+	AllowSignup bool `json:"allowSignup"`
+	// link to an existing account whose verified email matches the provider's verified email
+	// only turn this on for providers that are trusted to verify email addresses
+	LinkByEmail bool `json:"linkByEmail"`
+}
+
+// the parts of the discovery document the relying party needs
+type discoveryDocument struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenEndpointAuth     []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type Provider struct {
+	ProviderConfig
+
+	mu          sync.Mutex
+	discovery   *discoveryDocument
+	discoveryAt time.Time
+	keys        *keySet
+}
+
+// discovery documents rarely change, refetching once an hour picks up endpoint moves without a restart
+const discoveryTTL = time.Hour
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+var providers = map[string]*Provider{}
+
+// reads the providers file, a json array of ProviderConfig
+// nothing is fetched from the issuers here so an identity provider being down doesn't stop the app from booting
+func LoadProviders(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read oidc providers file: %s", err.Error())
+	}
+
+	var configs []ProviderConfig
+
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return fmt.Errorf("could not parse oidc providers file: %s", err.Error())
+	}
+
+	loaded := map[string]*Provider{}
+
+	for _, cfg := range configs {
+		if !providerNamePattern.MatchString(cfg.Name) {
+			return fmt.Errorf("oidc provider name %q must be lowercase letters, numbers and dashes", cfg.Name)
+		}
+
+		if _, exists := loaded[cfg.Name]; exists {
+			return fmt.Errorf("oidc provider %q is configured twice", cfg.Name)
+		}
+
+		if len(cfg.Issuer) == 0 || len(cfg.ClientID) == 0 || len(cfg.RedirectURL) == 0 {
+			return fmt.Errorf("oidc provider %q needs an issuer, clientId and redirectUrl", cfg.Name)
+		}
+
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+
+		if len(cfg.DisplayName) == 0 {
+			cfg.DisplayName = cfg.Name
+		}
+
+		cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+
+		loaded[cfg.Name] = &Provider{ProviderConfig: cfg}
+	}
+
+	providers = loaded
+	return nil
+}
+
+func GetProvider(name string) (*Provider, bool) {
+	provider, exists := providers[name]
+	return provider, exists
+}
+
+// public details for the login page, never includes the client secret
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+func ListProviders() []ProviderInfo {
+	list := []ProviderInfo{}
+	for _, provider := range providers {
+		list = append(list, ProviderInfo{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	return list
+}
+
+func (p *Provider) getDiscovery() (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveryAt) < discoveryTTL {
+		return p.discovery, nil
+	}
+
+	var doc discoveryDocument
+
+	err := getJSON(p.Issuer+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch discovery document for %s: %s", p.Name, err.Error())
+	}
+
+	// the spec requires this to match exactly, a mismatch means a misconfigured issuer or someone in the middle
+	if strings.TrimRight(doc.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match configured issuer %q", doc.Issuer, p.Issuer)
+	}
+
+	if len(doc.AuthorizationEndpoint) == 0 || len(doc.TokenEndpoint) == 0 || len(doc.JWKSURI) == 0 {
+		return nil, fmt.Errorf("discovery document for %s is missing required endpoints", p.Name)
+	}
+
+	// a new jwks uri means the old keys can't be trusted to still be current
+	if p.discovery == nil || p.discovery.JWKSURI != doc.JWKSURI {
+		p.keys = &keySet{uri: doc.JWKSURI}
+	}
+
+	p.discovery = &doc
+	p.discoveryAt = time.Now()
+
+	return p.discovery, nil
+}
+
+func getJSON(url string, target any) error {
+	response, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", response.StatusCode, url)
+	}
+
+	return json.NewDecoder(response.Body).Decode(target)
+}
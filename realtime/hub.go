@@ -0,0 +1,101 @@
+package realtime
+
+import "sync"
+
+// how many events a subscriber can fall behind by before it starts missing them
+const subscriberBuffer = 64
+
+// in-process broker, events only reach clients connected to this server
+type Hub struct {
+	mu     sync.RWMutex
+	byUser map[string]map[*hubSubscription]struct{}
+	byOrg  map[string]map[*hubSubscription]struct{}
+}
+
+type hubSubscription struct {
+	hub    *Hub
+	userId string
+	orgIds []string
+	events chan Event
+	once   sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		byUser: map[string]map[*hubSubscription]struct{}{},
+		byOrg:  map[string]map[*hubSubscription]struct{}{},
+	}
+}
+
+// a subscriber that can't keep up misses events rather than holding up whoever published them
+// clients refetch what they are showing when they reconnect, so a dropped event is never lost for good
+func (h *Hub) Publish(event Event) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	subscribers := h.byOrg[event.OrgID]
+	if len(event.UserID) > 0 {
+		subscribers = h.byUser[event.UserID]
+	}
+
+	for sub := range subscribers {
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (h *Hub) Subscribe(userId string, orgIds []string) Subscription {
+	sub := &hubSubscription{
+		hub:    h,
+		userId: userId,
+		orgIds: orgIds,
+		events: make(chan Event, subscriberBuffer),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	addSubscriber(h.byUser, userId, sub)
+	for _, orgId := range orgIds {
+		addSubscriber(h.byOrg, orgId, sub)
+	}
+
+	return sub
+}
+
+func (s *hubSubscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *hubSubscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		defer s.hub.mu.Unlock()
+
+		removeSubscriber(s.hub.byUser, s.userId, s)
+		for _, orgId := range s.orgIds {
+			removeSubscriber(s.hub.byOrg, orgId, s)
+		}
+
+		// publishers hold the read lock while sending, so nothing can send on the channel once it's closed here
+		close(s.events)
+	})
+}
+
+func addSubscriber(index map[string]map[*hubSubscription]struct{}, key string, sub *hubSubscription) {
+	if index[key] == nil {
+		index[key] = map[*hubSubscription]struct{}{}
+	}
+	index[key][sub] = struct{}{}
+}
+
+func removeSubscriber(index map[string]map[*hubSubscription]struct{}, key string, sub *hubSubscription) {
+	delete(index[key], sub)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
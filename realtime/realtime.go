@@ -0,0 +1,58 @@
+package realtime
+
+import "log"
+
+// something that happened which connected clients may want to hear about straight away
+type Event struct {
+	// "notification" or "folder.changed"
+	Type string `json:"type"`
+	// the org the event belongs to, empty for events that aren't tied to an org
+	OrgID string `json:"orgId,omitempty"`
+	// set for events meant for one user, empty for events meant for everyone in OrgID
+	UserID string `json:"-"`
+	// for folder events, the folder whose contents changed, empty for the org's root
+	// subscribers check their own folder access before passing the event on
+	FolderID string `json:"folderId,omitempty"`
+	Data     any    `json:"data"`
+}
+
+// what changed inside a folder, "file.added", "file.deleted", "folder.added" or "folder.deleted"
+type FolderChange struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+}
+
+// anything that can fan events out to the users connected to this server
+// the in-process hub is enough while the app runs as a single server, a broker backed by something like redis pub/sub can sit behind this interface when it doesn't
+type Broker interface {
+	Publish(event Event) error
+	// events for the user and for the orgs they were in when they connected
+	Subscribe(userId string, orgIds []string) Subscription
+}
+
+type Subscription interface {
+	Events() <-chan Event
+	// safe to call more than once, the events channel is closed afterwards
+	Close()
+}
+
+// the broker the rest of the app publishes through, swapped with Use
+var current Broker = NewHub()
+
+// swap in a different implementation, for an external broker or for tests
+func Use(b Broker) {
+	current = b
+}
+
+// pushing an event is never worth failing the request that caused it, so errors are only logged
+func Publish(event Event) {
+	err := current.Publish(event)
+	if err != nil {
+		log.Printf("realtime: could not publish %s event: %v", event.Type, err.Error())
+	}
+}
+
+func Subscribe(userId string, orgIds []string) Subscription {
+	return current.Subscribe(userId, orgIds)
+}
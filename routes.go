@@ -1,18 +1,20 @@
 package main
 
 import (
+	"fms/database"
 	"fms/handlers"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/cors"
+	"github.com/gofiber/fiber/v3/middleware/csrf"
 )
 
-func SetupRoutes(app *fiber.App) {
+func SetupRoutes(app *fiber.App, allowedOrigins []string) {
 
 	// configuring the app
 	app.Use(cors.New(cors.Config{
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Content-Length", "Accept-Language", "Accept-Encoding", "Connection", "Access-Control-Allow-Origin"},
-		AllowOrigins:     []string{"http://localhost:5173", "https://fmsatiya.live"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Content-Length", "Accept-Language", "Accept-Encoding", "Connection", "Access-Control-Allow-Origin", csrf.HeaderName, "X-Share-Password"},
+		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "HEAD", "PUT", "DELETE", "PATCH", "OPTIONS"},
 		AllowCredentials: true,
 	}))
@@ -30,44 +32,190 @@ func SetupRoutes(app *fiber.App) {
 		return c.Next()
 	})
 
+	// works out who is calling once for every request, the route groups below decide what that caller is allowed to reach
+	app.Use(handlers.ResolvePrincipal)
+
+	// every POST, PUT, PATCH and DELETE needs a matching X-Csrf-Token header and csrf_ cookie, and an Origin or Referer from the allowed list
+	// the token is kept server side as well so a cookie planted by a sibling subdomain isn't enough on its own
+	// samesite none because the client can be on a different site to the api (localhost in development), the token check is what protects the request
+	// bearer token requests are skipped, a browser never attaches that header on its own so they can't be forged cross site
+	// so is unsubscribing, mail clients post to it without a token of ours and the unsubscribe token in the link is the proof
+	app.Use(csrf.New(csrf.Config{
+		Next: func(c fiber.Ctx) bool {
+			return handlers.IsBearerRequest(c) || c.Path() == "/unsubscribe"
+		},
+		TrustedOrigins: allowedOrigins,
+		CookieSameSite: "None",
+		CookieSecure:   true,
+		CookieHTTPOnly: true,
+		ErrorHandler: func(c fiber.Ctx, err error) error {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Invalid or missing CSRF token",
+			})
+		},
+	}))
+
 	app.Get("/", func(c fiber.Ctx) error {
 		return c.SendString("Hello world!")
 	})
 
-	// auth routes
-	app.Post("/register", handlers.HandleRegister)
-	app.Post("/login", handlers.HandleLogin)
-	app.Get("/logout", handlers.HandleLogout)
-	app.Get("/auth-user", handlers.AuthRequest)
-
-	// org-related routes
-	app.Post("/add-org", handlers.HandleAddOrg)
-	app.Get("/owned-org", handlers.HandleGetOwnedOrgDetails)
-	app.Get("view-org", handlers.HandleViewOrg)
-	app.Get("/view-org-members", handlers.HandleViewOrgMembers)
-	app.Get("/invite-user", handlers.HandleInviteUser)
-	app.Put("/change-org-name", handlers.HandleChangeOrgName)
-	app.Put("/update-member-role", handlers.HandleChangeMemberRole)
-	app.Delete("/remove-member", handlers.HandleRemoveMember)
-	app.Delete("/delete-org", handlers.HandleDeleteOrg)
-
-	// folder-related routes
-	app.Get("/view-folder-children", handlers.HandleViewFolderChildren)
-	app.Post("/add-folder", handlers.HandleCreateFolder)
-	app.Post("/add-file", handlers.HandleUploadFile)
-	app.Delete("/delete-file", handlers.HandleDeleteFile)
-	app.Delete("/delete-folder", handlers.HandleDeleteFolder)
-	app.Get("/download-file", handlers.HandleDownloadFile)
-
-	// user-related routes
-	app.Get("/view-user-orgs", handlers.HandleViewUserOrgs)
-	app.Get("/users", handlers.HandleSearchUsers)
-	app.Get("/user-invites", handlers.HandleGetUserInvites)
-	app.Get("/accept-invite", handlers.HandleAcceptInvite)
-	app.Get("/decline-invite", handlers.HandleDeclineInvite)
-	app.Get("notifications", handlers.HandleGetUserNotifications)
-	app.Get("/read-notification", handlers.HandleMarkNotificationAsRead)
-	app.Post("/change-password", handlers.HandleChangePassword)
-	app.Post("/change-username", handlers.HandleChangeUsername)
-	app.Delete("/delete-account", handlers.HandleDeleteAccount)
+	// the client can't read the csrf cookie across origins, so it fetches the token from here and sends it back in the header
+	app.Get("/csrf-token", handlers.HandleGetCSRFToken)
+
+	// public routes
+	// register and login are reached before there is a session, the rest carry their own proof (a token or the sso state)
+	public := routeGroup{app: app}
+	public.Post("/register", handlers.HandleRegister)
+	public.Post("/login", handlers.HandleLogin)
+	public.Post("/verify-email", handlers.HandleVerifyEmail)
+	public.Post("/forgot-password", handlers.HandleForgotPassword)
+	public.Post("/reset-password", handlers.HandleResetPassword)
+	public.Get("/oidc/providers", handlers.HandleListOIDCProviders)
+	public.Get("/oidc/:provider/login", handlers.HandleOIDCLogin)
+	public.Get("/oidc/:provider/callback", handlers.HandleOIDCCallback)
+	public.Get("/s/:token", handlers.HandleViewShareLink)
+	public.Get("/s/:token/file", handlers.HandleShareLinkFile)
+	public.Get("/r/:token", handlers.HandleViewFileRequest)
+	public.Post("/r/:token", handlers.HandleUploadToFileRequest)
+	public.Post("/unsubscribe", handlers.HandleUnsubscribe)
+
+	// any signed in user
+	authenticated := routeGroup{app: app, middleware: []fiber.Handler{handlers.RequireAuth}}
+	authenticated.Post("/logout", handlers.HandleLogout)
+	authenticated.Get("/auth-user", handlers.AuthRequest)
+	authenticated.Post("/add-org", handlers.HandleAddOrg)
+	authenticated.Get("/view-user-orgs", handlers.HandleViewUserOrgs)
+	authenticated.Get("/user-invites", handlers.HandleGetUserInvites)
+	authenticated.Post("/accept-invite", handlers.HandleAcceptInvite)
+	authenticated.Post("/decline-invite", handlers.HandleDeclineInvite)
+	authenticated.Get("/invite-link", handlers.HandleGetInviteLinkPreview)
+	authenticated.Post("/join", handlers.HandleJoinByInviteLink)
+	authenticated.Get("/discover-orgs", handlers.HandleDiscoverOrgs)
+	authenticated.Get("/join-requests", handlers.HandleGetUserJoinRequests)
+	authenticated.Post("/request-to-join", handlers.HandleRequestToJoin)
+	authenticated.Delete("/cancel-join-request", handlers.HandleCancelJoinRequest)
+	authenticated.Get("/ownership-transfers", handlers.HandleGetOwnershipTransfers)
+	authenticated.Post("/accept-ownership-transfer", handlers.HandleAcceptOwnershipTransfer)
+	authenticated.Post("/decline-ownership-transfer", handlers.HandleDeclineOwnershipTransfer)
+	authenticated.Get("/shared-with-me", handlers.HandleGetSharedWithMe)
+	authenticated.Delete("/shared-with-me", handlers.HandleRemoveSharedWithMe)
+	authenticated.Get("/shared-item", handlers.HandleViewSharedItem)
+	authenticated.Get("/shared-item/download", handlers.HandleDownloadSharedFile)
+	authenticated.Post("/shared-item/upload", handlers.HandleUploadToSharedFolder)
+	authenticated.Delete("/shared-item/file", handlers.HandleDeleteSharedFile)
+	authenticated.Get("/notifications", handlers.HandleGetUserNotifications)
+	authenticated.Get("/unread-notification-count", handlers.HandleGetUnreadNotificationCount)
+	authenticated.Get("/event-catalogue", handlers.HandleGetEventCatalogue)
+	authenticated.Delete("/delete-notification", handlers.HandleDeleteNotification)
+	authenticated.Get("/events", handlers.HandleEvents)
+	authenticated.Put("/read-notification", handlers.HandleMarkNotificationAsRead)
+	authenticated.Get("/digest-settings", handlers.HandleGetDigestSettings)
+	authenticated.Put("/digest-settings", handlers.HandleSetDigestSettings)
+	authenticated.Post("/change-password", handlers.HandleChangePassword)
+	authenticated.Post("/change-username", handlers.HandleChangeUsername)
+	authenticated.Post("/change-email", handlers.HandleChangeEmail)
+	authenticated.Post("/resend-verification", handlers.HandleResendVerification)
+	authenticated.Delete("/delete-account", handlers.HandleDeleteAccount)
+
+	// any member, whatever their role
+	orgMember := routeGroup{app: app, middleware: []fiber.Handler{handlers.RequireOrgMember}}
+	orgMember.Post("/leave-org", handlers.HandleLeaveOrg)
+	orgMember.Get("/notification-preferences", handlers.HandleGetNotificationPreferences)
+	orgMember.Put("/notification-preference", handlers.HandleSetNotificationPreference)
+	orgMember.Delete("/notification-preference", handlers.HandleClearNotificationPreference)
+	orgMember.Post("/mute-folder", handlers.HandleMuteFolder)
+	orgMember.Delete("/mute-folder", handlers.HandleUnmuteFolder)
+
+	// org routes, each one names the capability the caller needs in the org named in the request
+	can := func(capability string) routeGroup {
+		return routeGroup{app: app, middleware: []fiber.Handler{handlers.RequireCapability(capability)}}
+	}
+
+	can(database.CapOrgView).Get("/view-org", handlers.HandleViewOrg)
+	can(database.CapOrgView).Get("/view-folder-children", handlers.HandleViewFolderChildren)
+	can(database.CapOrgView).Get("/download-file", handlers.HandleDownloadFile)
+	can(database.CapOrgView).Get("/org-roles", handlers.HandleGetOrgRoles)
+	can(database.CapOrgView).Get("/view-org-members", handlers.HandleViewOrgMembers)
+	can(database.CapOrgView).Get("/org-groups", handlers.HandleGetOrgGroups)
+	can(database.CapOrgView).Get("/group-members", handlers.HandleGetGroupMembers)
+	can(database.CapFolderCreate).Post("/add-folder", handlers.HandleCreateFolder)
+	can(database.CapFileUpload).Post("/add-file", handlers.HandleUploadFile)
+	can(database.CapFileDelete).Delete("/delete-file", handlers.HandleDeleteFile)
+	can(database.CapFileDelete).Delete("/delete-folder", handlers.HandleDeleteFolder)
+	can(database.CapMemberInvite).Get("/users", handlers.HandleSearchUsers)
+	can(database.CapMemberInvite).Post("/invite-user", handlers.HandleInviteUser)
+	can(database.CapMemberInvite).Post("/invite-email", handlers.HandleInviteByEmail)
+	can(database.CapMemberInvite).Get("/org-invites", handlers.HandleGetOrgInvites)
+	can(database.CapMemberInvite).Post("/resend-invite", handlers.HandleResendInvite)
+	can(database.CapMemberInvite).Delete("/revoke-invite", handlers.HandleRevokeInvite)
+	can(database.CapMemberInvite).Get("/invite-links", handlers.HandleGetInviteLinks)
+	can(database.CapMemberInvite).Post("/add-invite-link", handlers.HandleCreateInviteLink)
+	can(database.CapMemberInvite).Delete("/revoke-invite-link", handlers.HandleRevokeInviteLink)
+	can(database.CapMemberInvite).Get("/org-join-requests", handlers.HandleGetOrgJoinRequests)
+	can(database.CapMemberInvite).Post("/approve-join-request", handlers.HandleApproveJoinRequest)
+	can(database.CapMemberInvite).Post("/deny-join-request", handlers.HandleDenyJoinRequest)
+	can(database.CapMemberManage).Put("/update-member-role", handlers.HandleChangeMemberRole)
+	can(database.CapMemberManage).Delete("/remove-member", handlers.HandleRemoveMember)
+	can(database.CapMemberManage).Post("/add-group", handlers.HandleAddOrgGroup)
+	can(database.CapMemberManage).Put("/update-group", handlers.HandleUpdateOrgGroup)
+	can(database.CapMemberManage).Delete("/delete-group", handlers.HandleDeleteOrgGroup)
+	can(database.CapMemberManage).Post("/add-group-member", handlers.HandleAddGroupMember)
+	can(database.CapMemberManage).Delete("/remove-group-member", handlers.HandleRemoveGroupMember)
+	can(database.CapOrgSettings).Get("/owned-org", handlers.HandleGetOwnedOrgDetails)
+	can(database.CapOrgSettings).Put("/change-org-name", handlers.HandleChangeOrgName)
+	can(database.CapOrgSettings).Put("/org-discoverable", handlers.HandleSetOrgDiscoverable)
+	can(database.CapOrgDelete).Delete("/delete-org", handlers.HandleDeleteOrg)
+	can(database.CapOrgTransfer).Post("/transfer-ownership", handlers.HandleTransferOwnership)
+	can(database.CapOrgTransfer).Delete("/cancel-ownership-transfer", handlers.HandleCancelOwnershipTransfer)
+	can(database.CapOrgSettings).Post("/add-org-role", handlers.HandleAddOrgRole)
+	can(database.CapOrgSettings).Put("/update-org-role", handlers.HandleUpdateOrgRole)
+	can(database.CapOrgSettings).Delete("/delete-org-role", handlers.HandleDeleteOrgRole)
+	can(database.CapFileUpload).Post("/add-file-request", handlers.HandleCreateFileRequest)
+	can(database.CapFileUpload).Get("/file-requests", handlers.HandleGetFileRequests)
+	can(database.CapFileUpload).Get("/file-request-uploads", handlers.HandleGetFileRequestUploads)
+	can(database.CapFileUpload).Delete("/revoke-file-request", handlers.HandleRevokeFileRequest)
+	can(database.CapShareCreate).Post("/share-with-user", handlers.HandleShareWithUser)
+	can(database.CapShareCreate).Get("/resource-grants", handlers.HandleGetResourceGrants)
+	can(database.CapShareCreate).Delete("/revoke-resource-grant", handlers.HandleRevokeResourceGrant)
+	can(database.CapShareCreate).Post("/add-share-link", handlers.HandleCreateShareLink)
+	can(database.CapShareCreate).Get("/share-links", handlers.HandleGetShareLinks)
+	can(database.CapShareCreate).Delete("/revoke-share-link", handlers.HandleRevokeShareLink)
+	can(database.CapOrgSettings).Get("/webhook-events", handlers.HandleGetWebhookEvents)
+	can(database.CapOrgSettings).Get("/webhooks", handlers.HandleGetWebhooks)
+	can(database.CapOrgSettings).Post("/add-webhook", handlers.HandleCreateWebhook)
+	can(database.CapOrgSettings).Put("/update-webhook", handlers.HandleUpdateWebhook)
+	can(database.CapOrgSettings).Delete("/delete-webhook", handlers.HandleDeleteWebhook)
+	can(database.CapOrgSettings).Get("/webhook-deliveries", handlers.HandleGetWebhookDeliveries)
+	can(database.CapOrgSettings).Post("/redeliver-webhook", handlers.HandleRedeliverWebhook)
+	can(database.CapOrgSettings).Post("/ping-webhook", handlers.HandlePingWebhook)
+	can(database.CapFolderManage).Get("/folder-acl", handlers.HandleGetFolderACL)
+	can(database.CapFolderManage).Post("/set-folder-acl", handlers.HandleSetFolderACL)
+	can(database.CapFolderManage).Delete("/delete-folder-acl", handlers.HandleDeleteFolderACL)
+	can(database.CapFolderManage).Put("/restrict-folder", handlers.HandleRestrictFolder)
+	can(database.CapAuditView).Get("/audit-log", handlers.HandleGetAuditLog)
+	can(database.CapAuditView).Get("/audit-log/export", handlers.HandleExportAuditLog)
+	can(database.CapAuditView).Get("/audit-log/verify", handlers.HandleVerifyAuditLog)
+}
+
+// routes that share the same access requirements
+// fiber's own groups need a path prefix, these routes are all at the top level so the middleware is attached to each route instead
+type routeGroup struct {
+	app        *fiber.App
+	middleware []fiber.Handler
+}
+
+func (g routeGroup) Get(path string, handler fiber.Handler) {
+	g.app.Get(path, handler, g.middleware...)
+}
+
+func (g routeGroup) Post(path string, handler fiber.Handler) {
+	g.app.Post(path, handler, g.middleware...)
+}
+
+func (g routeGroup) Put(path string, handler fiber.Handler) {
+	g.app.Put(path, handler, g.middleware...)
+}
+
+func (g routeGroup) Delete(path string, handler fiber.Handler) {
+	g.app.Delete(path, handler, g.middleware...)
 }
@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fms/database"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// the first retry waits this long and every one after waits twice as long as the last
+	retryBase = 30 * time.Second
+	// seven retries over a little more than an hour before a delivery is given up on
+	maxAttempts = 8
+	// deliveries taken per run, small enough that they are all sent well inside the lease
+	batchSize = 20
+	// how long a claimed delivery is held before another run can pick it up again
+	claimLease = 5 * time.Minute
+	// only the start of the response is kept for the delivery log
+	maxResponseBody = 1024
+)
+
+var errPrivateAddress = errors.New("refusing to connect to a private, loopback or link local address")
+
+type Config struct {
+	// lets webhooks reach loopback and private network addresses, only for trying them out against a receiver on the same machine
+	AllowPrivateAddresses bool
+}
+
+var current = Config{}
+
+func Configure(cfg Config) {
+	current = cfg
+}
+
+// redirects aren't followed, the receiver should be configured with the url it really lives at
+// any org member who can manage settings picks the url and can read back the start of the response, so the address is checked
+// after dns has resolved it, otherwise a hostname could point at the server's own network
+// no proxy either, a proxy would make the connection on our behalf and skip the check
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: checkAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        20,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// shared address space used by carrier grade nat, not covered by IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// runs for every address the dialer tries, after the hostname has been resolved
+func checkAddress(network string, address string, _ syscall.RawConn) error {
+	if current.AllowPrivateAddresses {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := addrPort.Addr().Unmap()
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return errPrivateAddress
+	}
+
+	return nil
+}
+
+// works through the delivery queue straight away and then every interval for as long as the server is up
+// the queue lives in the database so anything still pending when the server stops goes out after it starts again
+func Start(interval time.Duration) {
+	go func() {
+		for {
+			sent, err := SendDue(time.Now())
+			if err != nil {
+				log.Printf("error: could not send webhook deliveries: %v", err.Error())
+			} else if sent > 0 {
+				log.Printf("webhook: attempted %d deliveries", sent)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// sends every due delivery, returns how many were attempted
+func SendDue(now time.Time) (int, error) {
+	attempted := 0
+
+	for {
+		deliveries, err := database.ClaimWebhookDeliveries(now, claimLease, batchSize)
+		if err != nil {
+			return attempted, err
+		}
+
+		for _, delivery := range deliveries {
+			attemptedAt := time.Now()
+			attempt := send(delivery)
+
+			if !attempt.Succeeded && delivery.Attempts+1 < maxAttempts {
+				next := attemptedAt.Add(retryBase << delivery.Attempts)
+				attempt.NextAttemptAt = &next
+			}
+
+			err := database.RecordWebhookAttempt(delivery.ID, attempt, attemptedAt)
+			if err != nil {
+				log.Printf("error: could not record webhook delivery %d: %v", delivery.ID, err.Error())
+			}
+		}
+
+		attempted += len(deliveries)
+
+		if len(deliveries) < batchSize {
+			return attempted, nil
+		}
+	}
+}
+
+func send(delivery database.QueuedWebhookDelivery) database.WebhookAttempt {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return database.WebhookAttempt{Error: err.Error()}
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FMS-Webhooks/1.0")
+	req.Header.Set("X-FMS-Event", delivery.Event)
+	req.Header.Set("X-FMS-Event-Id", delivery.EventID)
+	req.Header.Set("X-FMS-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-FMS-Timestamp", timestamp)
+	req.Header.Set("X-FMS-Signature", "sha256="+Sign(delivery.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return database.WebhookAttempt{Error: err.Error()}
+	}
+
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return database.WebhookAttempt{StatusCode: resp.StatusCode, Error: err.Error()}
+	}
+
+	attempt := database.WebhookAttempt{
+		StatusCode:   resp.StatusCode,
+		ResponseBody: string(responseBody),
+		Succeeded:    resp.StatusCode >= 200 && resp.StatusCode < 300,
+	}
+
+	if !attempt.Succeeded {
+		attempt.Error = fmt.Sprintf("receiver responded with %d", resp.StatusCode)
+	}
+
+	return attempt
+}
+
+// hex hmac-sha256 of the timestamp, a dot and the raw body, keyed with the webhook's secret
+// the timestamp is signed along with the body so a captured delivery can't be replayed later with a new one
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}